@@ -0,0 +1,154 @@
+// Package analytics computes risk and performance statistics from a series
+// of period returns: volatility, Sharpe and Sortino ratios, drawdowns, and
+// beta and correlation against a benchmark. Returns are fractions (0.01 is
+// 1%) and rates are annual; perYear is how many periods make a year.
+//
+// Each function returns nil when the series is too short or flat for the
+// statistic to mean anything.
+package analytics
+
+import (
+	"math"
+	"time"
+)
+
+// Volatility is the annualized sample standard deviation of the returns.
+func Volatility(returns []float64, perYear float64) *float64 {
+	sd, ok := stdev(returns)
+	if !ok {
+		return nil
+	}
+	v := sd * math.Sqrt(perYear)
+	return &v
+}
+
+// Sharpe is the annualized mean return over the risk-free rate, per unit
+// of volatility.
+func Sharpe(returns []float64, riskFree, perYear float64) *float64 {
+	sd, ok := stdev(returns)
+	if !ok || sd == 0 {
+		return nil
+	}
+	s := (mean(returns) - periodRate(riskFree, perYear)) / sd * math.Sqrt(perYear)
+	return &s
+}
+
+// Sortino is Sharpe with only the periods that fell short of the risk-free
+// rate counting as risk.
+func Sortino(returns []float64, riskFree, perYear float64) *float64 {
+	if len(returns) < 2 {
+		return nil
+	}
+	rf := periodRate(riskFree, perYear)
+	var sum float64
+	for _, r := range returns {
+		if r < rf {
+			sum += (r - rf) * (r - rf)
+		}
+	}
+	downside := math.Sqrt(sum / float64(len(returns)))
+	if downside == 0 {
+		return nil
+	}
+	s := (mean(returns) - rf) / downside * math.Sqrt(perYear)
+	return &s
+}
+
+// Point is a period return and when the period ended.
+type Point struct {
+	At     time.Time
+	Return float64
+}
+
+// Drawdown is the deepest fall from a peak, as a negative fraction.
+type Drawdown struct {
+	Depth  float64
+	Peak   time.Time
+	Trough time.Time
+}
+
+// MaxDrawdown chains the returns from start and finds the deepest fall
+// from a running peak. It is nil when the series never falls.
+func MaxDrawdown(start time.Time, points []Point) *Drawdown {
+	value, peak, peakAt := 1.0, 1.0, start
+	var worst *Drawdown
+	for _, p := range points {
+		value *= 1 + p.Return
+		if value > peak {
+			peak, peakAt = value, p.At
+			continue
+		}
+		if depth := value/peak - 1; depth < 0 && (worst == nil || depth < worst.Depth) {
+			worst = &Drawdown{Depth: depth, Peak: peakAt, Trough: p.At}
+		}
+	}
+	return worst
+}
+
+// Beta is how far the returns move with the benchmark's: their covariance
+// over the benchmark's variance. The series are paired by index.
+func Beta(returns, benchmark []float64) *float64 {
+	if len(returns) != len(benchmark) || len(returns) < 2 {
+		return nil
+	}
+	vb, _ := variance(benchmark)
+	if vb == 0 {
+		return nil
+	}
+	b := covariance(returns, benchmark) / vb
+	return &b
+}
+
+// Correlation is the Pearson correlation of the returns with the benchmark's.
+func Correlation(returns, benchmark []float64) *float64 {
+	if len(returns) != len(benchmark) || len(returns) < 2 {
+		return nil
+	}
+	va, _ := variance(returns)
+	vb, _ := variance(benchmark)
+	if va == 0 || vb == 0 {
+		return nil
+	}
+	c := covariance(returns, benchmark) / math.Sqrt(va*vb)
+	return &c
+}
+
+// periodRate converts an annual rate to one period's.
+func periodRate(annual, perYear float64) float64 {
+	return math.Pow(1+annual, 1/perYear) - 1
+}
+
+func mean(xs []float64) float64 {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+// variance is the sample variance, and false for fewer than two values.
+func variance(xs []float64) (float64, bool) {
+	if len(xs) < 2 {
+		return 0, false
+	}
+	m := mean(xs)
+	var v float64
+	for _, x := range xs {
+		v += (x - m) * (x - m)
+	}
+	return v / float64(len(xs)-1), true
+}
+
+func stdev(xs []float64) (float64, bool) {
+	v, ok := variance(xs)
+	return math.Sqrt(v), ok
+}
+
+func covariance(xs, ys []float64) float64 {
+	mx, my := mean(xs), mean(ys)
+	var sum float64
+	for i := range xs {
+		sum += (xs[i] - mx) * (ys[i] - my)
+	}
+	return sum / float64(len(xs)-1)
+}
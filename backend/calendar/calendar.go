@@ -0,0 +1,300 @@
+// Package calendar knows when exchanges are open: regular and extended
+// sessions, weekends, holidays and early closes, loaded from the embedded
+// markets.json. Crypto trades around the clock and has no market here.
+package calendar
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // exchange time zones resolve even on slim images
+
+	"github.com/sahniaditya/flux-backend/prices"
+)
+
+//go:embed markets.json
+var marketsJSON []byte
+
+// Sessions reported by Market.Session.
+const (
+	SessionPre     = "pre_market"
+	SessionRegular = "regular"
+	SessionPost    = "post_market"
+	SessionClosed  = "closed"
+)
+
+// lookahead bounds the search for the next open or close; no exchange closes
+// for longer than this.
+const lookahead = 14
+
+// Market is one exchange's trading calendar.
+type Market struct {
+	Name     string
+	Aliases  []string // other exchanges on the same calendar
+	Location *time.Location
+
+	open, close               time.Duration // since local midnight
+	extOpen, extClose         time.Duration
+	earlyClose, earlyExtClose time.Duration
+	holidays                  map[string]string
+	earlyCloses               map[string]bool
+	through                   string    // last date the holiday list covers
+	pastRange                 sync.Once // warns about dates past it
+}
+
+type marketSpec struct {
+	Name               string            `json:"name"`
+	Aliases            []string          `json:"aliases"`
+	Timezone           string            `json:"timezone"`
+	Default            bool              `json:"default"`
+	Symbols            []string          `json:"symbols"`
+	Suffixes           []string          `json:"suffixes"`
+	Open               string            `json:"open"`
+	Close              string            `json:"close"`
+	ExtendedOpen       string            `json:"extended_open"`
+	ExtendedClose      string            `json:"extended_close"`
+	EarlyClose         string            `json:"early_close"`
+	EarlyExtendedClose string            `json:"early_extended_close"`
+	Holidays           map[string]string `json:"holidays"`
+	HolidaysFrom       string            `json:"holidays_from"`
+	EarlyCloses        []string          `json:"early_closes"`
+}
+
+// Calendar maps symbols to their exchange's market.
+type Calendar struct {
+	markets    []*Market
+	bySymbol   map[string]*Market
+	suffixes   map[string]*Market
+	fallback   *Market
+	assetClass func(symbol string) string
+}
+
+// New loads the embedded calendar. assetClass (normally prices.Feed.AssetClass)
+// tells crypto, which is always open, from equities; equities with no listed
+// exchange trade on the default market.
+func New(assetClass func(symbol string) string) (*Calendar, error) {
+	var file struct {
+		Markets []marketSpec `json:"markets"`
+	}
+	if err := json.Unmarshal(marketsJSON, &file); err != nil {
+		return nil, fmt.Errorf("parse markets.json: %w", err)
+	}
+
+	cal := &Calendar{
+		bySymbol:   make(map[string]*Market),
+		suffixes:   make(map[string]*Market),
+		assetClass: assetClass,
+	}
+	specs := make(map[string]marketSpec)
+	for _, spec := range file.Markets {
+		specs[spec.Name] = spec
+	}
+	for _, spec := range file.Markets {
+		m, err := spec.build(specs)
+		if err != nil {
+			return nil, fmt.Errorf("market %s: %w", spec.Name, err)
+		}
+		cal.markets = append(cal.markets, m)
+		for _, s := range spec.Symbols {
+			cal.bySymbol[strings.ToUpper(s)] = m
+		}
+		for _, s := range spec.Suffixes {
+			cal.suffixes[strings.ToUpper(s)] = m
+		}
+		if spec.Default {
+			cal.fallback = m
+		}
+	}
+	return cal, nil
+}
+
+func (spec marketSpec) build(specs map[string]marketSpec) (*Market, error) {
+	loc, err := time.LoadLocation(spec.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	m := &Market{
+		Name:        spec.Name,
+		Aliases:     spec.Aliases,
+		Location:    loc,
+		holidays:    spec.Holidays,
+		earlyCloses: make(map[string]bool),
+	}
+	if spec.HolidaysFrom != "" {
+		m.holidays = specs[spec.HolidaysFrom].Holidays
+	}
+	for _, d := range spec.EarlyCloses {
+		m.earlyCloses[d] = true
+	}
+	// Lists run a calendar year at a time, so the last holiday's year is
+	// covered to its end.
+	for d := range m.holidays {
+		if end := d[:4] + "-12-31"; end > m.through {
+			m.through = end
+		}
+	}
+
+	// Markets without extended hours trade only their regular session, and
+	// early closes default to the regular close.
+	extOpen, extClose := or(spec.ExtendedOpen, spec.Open), or(spec.ExtendedClose, spec.Close)
+	earlyClose := or(spec.EarlyClose, spec.Close)
+	for _, f := range []struct {
+		dst *time.Duration
+		raw string
+	}{
+		{&m.open, spec.Open},
+		{&m.close, spec.Close},
+		{&m.extOpen, extOpen},
+		{&m.extClose, extClose},
+		{&m.earlyClose, earlyClose},
+		{&m.earlyExtClose, or(spec.EarlyExtendedClose, earlyClose)},
+	} {
+		if *f.dst, err = parseClock(f.raw); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func or(v, fallback string) string {
+	if v == "" {
+		return fallback
+	}
+	return v
+}
+
+// parseClock reads "HH:MM" as a duration since midnight.
+func parseClock(raw string) (time.Duration, error) {
+	t, err := time.Parse("15:04", raw)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q: %w", raw, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Markets lists every market in the calendar.
+func (cal *Calendar) Markets() []*Market {
+	return cal.markets
+}
+
+// Market returns the exchange a symbol trades on, or nil when it trades
+// around the clock. A nil calendar treats every symbol as always open.
+func (cal *Calendar) Market(symbol string) *Market {
+	if cal == nil || (cal.assetClass != nil && cal.assetClass(symbol) == prices.AssetCrypto) {
+		return nil
+	}
+	symbol = strings.ToUpper(strings.TrimSpace(symbol))
+	if m, ok := cal.bySymbol[symbol]; ok {
+		return m
+	}
+	if i := strings.LastIndex(symbol, "."); i > 0 {
+		if m, ok := cal.suffixes[symbol[i:]]; ok {
+			return m
+		}
+	}
+	return cal.fallback
+}
+
+// IsOpen reports whether symbol can trade at t; extended includes the pre-
+// and post-market sessions.
+func (cal *Calendar) IsOpen(symbol string, extended bool, t time.Time) bool {
+	m := cal.Market(symbol)
+	return m == nil || m.IsOpen(t, extended)
+}
+
+// NextOpen is when symbol can next trade: t itself if it is open.
+func (cal *Calendar) NextOpen(symbol string, extended bool, t time.Time) time.Time {
+	if m := cal.Market(symbol); m != nil {
+		return m.NextOpen(t, extended)
+	}
+	return t
+}
+
+// Holiday returns the holiday's name if the market is closed for one on the
+// local date of t.
+func (m *Market) Holiday(t time.Time) (string, bool) {
+	name, ok := m.holidays[t.In(m.Location).Format("2006-01-02")]
+	return name, ok
+}
+
+// hours returns the session bounds on the local date of day, or ok=false when
+// the market doesn't trade that day.
+func (m *Market) hours(day time.Time, extended bool) (open, close time.Time, ok bool) {
+	local := day.In(m.Location)
+	if wd := local.Weekday(); wd == time.Saturday || wd == time.Sunday {
+		return open, close, false
+	}
+	date := local.Format("2006-01-02")
+	if date > m.through {
+		m.pastRange.Do(func() {
+			log.Printf("⚠️ %s holidays are only listed through %s; treating %s and later weekdays as trading days. Extend calendar/markets.json.",
+				m.Name, m.through, date)
+		})
+	}
+	if _, holiday := m.Holiday(local); holiday {
+		return open, close, false
+	}
+	from, to := m.open, m.close
+	if extended {
+		from, to = m.extOpen, m.extClose
+	}
+	if m.earlyCloses[date] {
+		to = m.earlyClose
+		if extended {
+			to = m.earlyExtClose
+		}
+	}
+	// Build wall-clock times so DST changes don't shift the session.
+	at := func(d time.Duration) time.Time {
+		return time.Date(local.Year(), local.Month(), local.Day(), int(d/time.Hour), int(d%time.Hour/time.Minute), 0, 0, m.Location)
+	}
+	return at(from), at(to), true
+}
+
+// IsOpen reports whether the market trades at t.
+func (m *Market) IsOpen(t time.Time, extended bool) bool {
+	open, close, ok := m.hours(t, extended)
+	return ok && !t.Before(open) && t.Before(close)
+}
+
+// Session names the session in progress at t.
+func (m *Market) Session(t time.Time) string {
+	switch {
+	case m.IsOpen(t, false):
+		return SessionRegular
+	case !m.IsOpen(t, true):
+		return SessionClosed
+	}
+	if open, _, _ := m.hours(t, false); t.Before(open) {
+		return SessionPre
+	}
+	return SessionPost
+}
+
+// NextOpen is the start of the next session at or after t, or t itself when
+// the market is open.
+func (m *Market) NextOpen(t time.Time, extended bool) time.Time {
+	if m.IsOpen(t, extended) {
+		return t
+	}
+	for day := 0; day <= lookahead; day++ {
+		if open, _, ok := m.hours(t.In(m.Location).AddDate(0, 0, day), extended); ok && open.After(t) {
+			return open
+		}
+	}
+	return t
+}
+
+// NextClose is the end of the session in progress at t, or of the next one.
+func (m *Market) NextClose(t time.Time, extended bool) time.Time {
+	for day := 0; day <= lookahead; day++ {
+		if _, close, ok := m.hours(t.In(m.Location).AddDate(0, 0, day), extended); ok && close.After(t) {
+			return close
+		}
+	}
+	return t
+}
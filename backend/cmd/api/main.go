@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -16,8 +17,12 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/sahniaditya/flux-backend/calendar"
 	appdb "github.com/sahniaditya/flux-backend/db"
+	"github.com/sahniaditya/flux-backend/fees"
+	"github.com/sahniaditya/flux-backend/halts"
 	"github.com/sahniaditya/flux-backend/handlers"
+	"github.com/sahniaditya/flux-backend/instruments"
 	"github.com/sahniaditya/flux-backend/prices"
 	"github.com/sahniaditya/flux-backend/worker"
 )
@@ -83,8 +88,108 @@ func main() {
 		StockInterval:  45 * time.Second,
 	})
 
-	// Start the background order execution worker
-	worker.Start(db, feed)
+	// Commission schedules per asset class, e.g.
+	// FEE_SCHEDULES='{"equity":{"per_share":0.005,"min":1},"crypto":{"maker_bps":10,"taker_bps":20}}'.
+	// Unset, trading is free.
+	feeSchedules, err := fees.ParseSchedules(getEnv("FEE_SCHEDULES", ""))
+	if err != nil {
+		log.Fatal("Invalid FEE_SCHEDULES:", err)
+	}
+	feeEngine := fees.NewEngine(feeSchedules, feed.AssetClass)
+
+	// Tick size, lot size, minimums and fractional trading per symbol or asset
+	// class, over the built-in defaults, e.g.
+	// INSTRUMENT_RULES='{"symbols":{"DOGE":{"lot_size":1}},"classes":{"equity":{"min_notional":5}}}'.
+	ruleConfig, err := instruments.ParseConfig(getEnv("INSTRUMENT_RULES", ""))
+	if err != nil {
+		log.Fatal("Invalid INSTRUMENT_RULES:", err)
+	}
+	rules := instruments.NewRegistry(ruleConfig, feed.AssetClass)
+
+	// Exchange hours and holidays; equity orders queue while their market is closed.
+	cal, err := calendar.New(feed.AssetClass)
+	if err != nil {
+		log.Fatal("Invalid trading calendar:", err)
+	}
+
+	// Trading halts: admins place them, and the circuit breaker halts a symbol
+	// for CIRCUIT_BREAKER_HALT when it moves more than CIRCUIT_BREAKER_PERCENT
+	// within CIRCUIT_BREAKER_WINDOW (0 disables the breaker).
+	breakerPercent, err := strconv.ParseFloat(getEnv("CIRCUIT_BREAKER_PERCENT", "10"), 64)
+	if err != nil {
+		log.Fatal("Invalid CIRCUIT_BREAKER_PERCENT:", err)
+	}
+	breakerWindow, err := time.ParseDuration(getEnv("CIRCUIT_BREAKER_WINDOW", "5m"))
+	if err != nil {
+		log.Fatal("Invalid CIRCUIT_BREAKER_WINDOW:", err)
+	}
+	breakerHalt, err := time.ParseDuration(getEnv("CIRCUIT_BREAKER_HALT", "15m"))
+	if err != nil {
+		log.Fatal("Invalid CIRCUIT_BREAKER_HALT:", err)
+	}
+	hr := halts.New(db, feed.AssetClass, halts.Config{
+		BreakerPercent: breakerPercent,
+		BreakerWindow:  breakerWindow,
+		BreakerHalt:    breakerHalt,
+		OnChange:       feed.Broadcast,
+	})
+	feed.SetHaltStatus(hr.Status)
+	feed.OnTick(hr.Observe)
+	hr.Start(context.Background())
+
+	// Start the background order execution worker.
+	// LIQUIDITY_DEPTH="BTC:5000000,AAPL:2000000" sets USD fillable per tick; larger orders fill over several ticks.
+	defaultDepth, err := strconv.ParseFloat(getEnv("LIQUIDITY_DEFAULT_DEPTH", "1000000"), 64)
+	if err != nil {
+		log.Fatal("Invalid LIQUIDITY_DEFAULT_DEPTH:", err)
+	}
+	// SLIPPAGE="fixed:5,volatility:1.5,impact:10" combines spread, volatility and
+	// size-impact models. Unset, fills are at the reference price.
+	liquidity := worker.ParseDepth(getEnv("LIQUIDITY_DEPTH", ""), defaultDepth)
+	slippage, err := worker.ParseSlippage(getEnv("SLIPPAGE", "none"), liquidity)
+	if err != nil {
+		log.Fatal("Invalid SLIPPAGE:", err)
+	}
+	// BORROW_RATE is the annual fee on short positions in margin accounts, charged daily.
+	borrowRate, err := strconv.ParseFloat(getEnv("BORROW_RATE", "0.03"), 64)
+	if err != nil {
+		log.Fatal("Invalid BORROW_RATE:", err)
+	}
+	// MARGIN_LOAN_RATE is the annual interest on margin loans, accrued daily.
+	loanRate, err := strconv.ParseFloat(getEnv("MARGIN_LOAN_RATE", "0.08"), 64)
+	if err != nil {
+		log.Fatal("Invalid MARGIN_LOAN_RATE:", err)
+	}
+	// EQUITY_SNAPSHOTS_HOURLY adds hourly equity snapshots to the daily ones.
+	hourlySnapshots := getEnv("EQUITY_SNAPSHOTS_HOURLY", "false") == "true"
+	// BENCHMARK_SYMBOL is the default benchmark for portfolio analytics and
+	// BENCHMARK_SYMBOLS lists more, e.g. "QQQ,^NSEI". Their prices are recorded
+	// with every equity snapshot, so each needs a live quote (see STOCK_SYMBOLS),
+	// and analytics accepts only these benchmarks.
+	benchmarks := []string{prices.NormalizeSymbol(getEnv("BENCHMARK_SYMBOL", "SPY"))}
+	for _, s := range strings.Split(getEnv("BENCHMARK_SYMBOLS", ""), ",") {
+		if s = prices.NormalizeSymbol(strings.TrimSpace(s)); s != "" && !slices.Contains(benchmarks, s) {
+			benchmarks = append(benchmarks, s)
+		}
+	}
+	// RISK_FREE_RATE is the default annual risk-free rate for Sharpe and Sortino ratios.
+	riskFreeRate, err := strconv.ParseFloat(getEnv("RISK_FREE_RATE", "0.04"), 64)
+	if err != nil {
+		log.Fatal("Invalid RISK_FREE_RATE:", err)
+	}
+	worker.Start(db, feed, worker.Config{
+		Liquidity:       liquidity,
+		Fees:            feeEngine,
+		Slippage:        slippage,
+		ListenDSN:       connStr,
+		BorrowRate:      borrowRate,
+		LoanRate:        loanRate,
+		Calendar:        cal,
+		Halts:           hr,
+		Rules:           rules,
+		HourlySnapshots: hourlySnapshots,
+		Benchmarks:      benchmarks,
+	})
 
 	feed.Start(context.Background())
 
@@ -92,8 +197,8 @@ func main() {
 	// Basic CORS to allow frontend at a different origin (dev: localhost:3000).
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		if c.Request.Method == http.MethodOptions {
 			c.AbortWithStatus(http.StatusOK)
 			return
@@ -115,17 +220,42 @@ func main() {
 
 	secret := getEnv("JWT_SECRET", "dev-secret")
 	auth := handlers.AuthMiddleware(secret)
-	r.POST("/trade/buy", auth, handlers.TradeBuy(db))
-	r.POST("/trade/sell", auth, handlers.TradeSell(db))
-	r.POST("/wallet/topup", auth, handlers.TopUpWallet(db))
-	r.POST("/orders", auth, handlers.PlaceOrder(db, feed)) // New endpoint with validation
-	r.GET("/portfolio", auth, handlers.GetPortfolio(db))
+	// Mutating routes honour an Idempotency-Key header so clients can retry safely.
+	idem := handlers.Idempotency(db)
+	admin := handlers.AdminOnly(db)
+	r.POST("/trade/buy", auth, idem, handlers.TradeBuy(db, feed, feeEngine, rules, cal, hr))
+	r.POST("/trade/sell", auth, idem, handlers.TradeSell(db, feed, feeEngine, rules, cal, hr))
+	r.POST("/wallet/topup", auth, idem, handlers.TopUpWallet(db))
+	r.POST("/orders", auth, idem, handlers.PlaceOrder(db, feed, feeEngine, rules, cal, hr)) // New endpoint with validation
+	r.GET("/orders", auth, handlers.ListOrders(db))
+	r.POST("/orders/groups", auth, idem, handlers.PlaceOrderGroup(db, feed, feeEngine, rules, cal, hr))
+	r.GET("/orders/groups/:id", auth, handlers.GetOrderGroup(db))
+	r.DELETE("/orders/groups/:id", auth, idem, handlers.CancelOrderGroup(db))
+	r.GET("/orders/:id", auth, handlers.GetOrder(db))
+	r.DELETE("/orders/:id", auth, idem, handlers.CancelOrder(db))
+	r.PATCH("/orders/:id", auth, idem, handlers.ModifyOrder(db, feed, feeEngine, rules, hr))
+	r.GET("/portfolio", auth, handlers.GetPortfolio(db, feed))
+	r.GET("/account/margin", auth, handlers.GetMargin(db, feed))
+	r.PUT("/account/margin", auth, idem, handlers.SetMargin(db, feed))
+	r.GET("/portfolio/history", auth, handlers.GetPortfolioHistory(db))
+	r.GET("/portfolio/analytics", auth, handlers.GetPortfolioAnalytics(db, riskFreeRate, benchmarks))
+	r.GET("/portfolio/lots", auth, handlers.ListLots(db))
+	r.GET("/transactions", auth, handlers.ListTransactions(db))
+	r.GET("/transactions/export", auth, handlers.ExportTransactions(db))
+	r.PUT("/account/lot-method", auth, idem, handlers.SetLotMethod(db))
 	// Market data + news (public)
 	r.GET("/api/market-data/:symbol/:interval", handlers.MarketData())
 	r.GET("/api/news/:symbol", handlers.News())
 	// Symbols + company info (public, cached)
 	r.GET("/api/symbols", handlers.Symbols())
 	r.GET("/api/company/:symbol", handlers.CompanyInfo())
+	// Exchange sessions and holidays (public)
+	r.GET("/api/market-hours", handlers.MarketHours(cal))
+	r.GET("/api/halts", handlers.ListHalts(hr))
+	r.POST("/admin/halts", auth, admin, idem, handlers.PlaceHalt(hr))
+	r.DELETE("/admin/halts/:id", auth, admin, idem, handlers.LiftHalt(hr))
+	// Reconciles wallets, holdings and margin loans against the journal
+	r.GET("/admin/ledger/check", auth, admin, handlers.CheckLedger(db))
 
 	apiPort := os.Getenv("PORT")
 	if apiPort == "" {
@@ -6,6 +6,8 @@ CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     email VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE, -- May place and lift trading halts.
+    lot_method VARCHAR(4) NOT NULL DEFAULT 'fifo' CHECK (lot_method IN ('fifo', 'lifo', 'hifo')), -- Tax lots sells close first.
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -14,6 +16,7 @@ CREATE TABLE IF NOT EXISTS wallets (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID REFERENCES users(id) ON DELETE CASCADE,
     balance DECIMAL(20, 2) DEFAULT 0.00 CHECK (balance >= 0),
+    reserved DECIMAL(20, 2) NOT NULL DEFAULT 0.00 CHECK (reserved >= 0), -- Held for pending buy orders
     currency VARCHAR(3) DEFAULT 'USD',
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     CONSTRAINT unique_user_wallet UNIQUE (user_id, currency)
@@ -24,8 +27,9 @@ CREATE TABLE IF NOT EXISTS holdings (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID REFERENCES users(id) ON DELETE CASCADE,
     symbol VARCHAR(10) NOT NULL, -- e.g., 'BTC', 'ETH'
-    quantity DECIMAL(20, 8) NOT NULL DEFAULT 0,
-    average_buy_price DECIMAL(20, 2) NOT NULL DEFAULT 0,
+    quantity DECIMAL(20, 8) NOT NULL DEFAULT 0, -- Negative for short positions in margin accounts
+    reserved_quantity DECIMAL(20, 8) NOT NULL DEFAULT 0 CHECK (reserved_quantity >= 0), -- Held for pending sell orders
+    average_buy_price DECIMAL(20, 8) NOT NULL DEFAULT 0, -- Average entry price, fees included; for shorts, proceeds per unit
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     CONSTRAINT unique_user_holding UNIQUE (user_id, symbol)
 );
@@ -34,29 +38,296 @@ CREATE TABLE IF NOT EXISTS holdings (
 CREATE TABLE IF NOT EXISTS transactions (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID REFERENCES users(id) ON DELETE CASCADE,
-    type VARCHAR(10) NOT NULL CHECK (type IN ('DEPOSIT', 'WITHDRAW', 'BUY', 'SELL')),
+    type VARCHAR(10) NOT NULL CHECK (type IN ('DEPOSIT', 'WITHDRAW', 'BUY', 'SELL', 'BORROW_FEE', 'INTEREST')),
     symbol VARCHAR(10), -- NULL for Deposits/Withdraws
     quantity DECIMAL(20, 8),
-    price_per_unit DECIMAL(20, 2),
-    total_amount DECIMAL(20, 2) NOT NULL,
+    price_per_unit DECIMAL(20, 8),
+    total_amount DECIMAL(20, 2) NOT NULL, -- Cash moved: notional plus fee on buys, minus fee on sells.
+    fee DECIMAL(20, 2) NOT NULL DEFAULT 0,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
 CREATE INDEX IF NOT EXISTS idx_transactions_user_id ON transactions(user_id);
 
--- 5. Orders (Limit, Stop, Market)
+-- 5. Orders (Market, Limit, Stop, Stop-Limit, Trailing)
 CREATE TABLE IF NOT EXISTS orders (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     symbol VARCHAR(10) NOT NULL,
     side VARCHAR(4) NOT NULL CHECK (side IN ('buy', 'sell')),
-    type VARCHAR(10) NOT NULL CHECK (type IN ('market', 'limit', 'stop')),
+    type VARCHAR(20) NOT NULL CHECK (type IN ('market', 'limit', 'stop', 'stop_limit', 'trailing_stop', 'trailing_percent')),
     quantity DECIMAL(20, 8) NOT NULL,
-    price DECIMAL(20, 2), -- Limit or Stop price. Null for market orders.
-    status VARCHAR(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'filled', 'cancelled', 'rejected')),
+    price DECIMAL(20, 8), -- Limit or Stop price. Null for market orders.
+    stop_price DECIMAL(20, 8), -- Stop trigger for stop_limit orders.
+    trail_amount DECIMAL(20, 8), -- Absolute offset for trailing_stop orders.
+    trail_percent DECIMAL(12, 8), -- Percent offset for trailing_percent orders.
+    water_mark DECIMAL(20, 8), -- High-water (sell) or low-water (buy) mark for trailing orders.
+    triggered_at TIMESTAMP WITH TIME ZONE, -- When a stop_limit's stop was crossed.
+    time_in_force VARCHAR(3) NOT NULL DEFAULT 'gtc' CHECK (time_in_force IN ('gtc', 'day', 'ioc', 'fok', 'gtd')),
+    expires_at TIMESTAMP WITH TIME ZONE, -- Session close for DAY orders, client-supplied for GTD.
+    extended_hours BOOLEAN NOT NULL DEFAULT FALSE, -- Equities may fill in pre- and post-market sessions.
+    reserved_cash DECIMAL(20, 2) NOT NULL DEFAULT 0, -- Wallet funds held by a pending buy.
+    reserved_quantity DECIMAL(20, 8) NOT NULL DEFAULT 0, -- Holding quantity held by a pending sell.
+    filled_quantity DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    average_fill_price DECIMAL(20, 8), -- Volume-weighted over order_fills. Null until the first fill.
+    status VARCHAR(20) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'inactive', 'partially_filled', 'filled', 'cancelled', 'rejected', 'expired')),
+    source VARCHAR(12) NOT NULL DEFAULT 'user' CHECK (source IN ('user', 'liquidation')), -- Who placed it.
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     executed_at TIMESTAMP WITH TIME ZONE
 );
 
 CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders(user_id);
-CREATE INDEX IF NOT EXISTS idx_orders_status ON orders(status);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_orders_status ON orders(status);
+
+-- 6. Order Fills (one row per execution; an order may fill over several ticks)
+CREATE TABLE IF NOT EXISTS order_fills (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    symbol VARCHAR(10) NOT NULL,
+    side VARCHAR(4) NOT NULL CHECK (side IN ('buy', 'sell')),
+    quantity DECIMAL(20, 8) NOT NULL CHECK (quantity > 0),
+    price DECIMAL(20, 8) NOT NULL, -- Execution price after slippage.
+    reference_price DECIMAL(20, 8), -- Feed price the fill was priced from.
+    fee DECIMAL(20, 2) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_fills_order_id ON order_fills(order_id);
+CREATE INDEX IF NOT EXISTS idx_order_fills_user_id ON order_fills(user_id);
+
+-- 7. Idempotency Keys (stored responses for safely retried mutations)
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL, -- sha256 of method, path with query, and body
+    status_code INT, -- Null while the first request is still running; a retry takes over after a minute.
+    response_body BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, key)
+);
+
+-- 8. Order change notifications (the worker LISTENs on order_events to keep its trigger index current)
+CREATE OR REPLACE FUNCTION notify_order_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('order_events', NEW.id::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS orders_notify ON orders;
+CREATE TRIGGER orders_notify AFTER INSERT OR UPDATE ON orders
+    FOR EACH ROW EXECUTE FUNCTION notify_order_change();
+
+-- 9. Margin Accounts (a row here switches the user from a cash account to margin)
+CREATE TABLE IF NOT EXISTS margin_accounts (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    initial_margin DECIMAL(5, 4) NOT NULL DEFAULT 0.5 CHECK (initial_margin > 0 AND initial_margin <= 1),
+    maintenance_margin DECIMAL(5, 4) NOT NULL DEFAULT 0.25 CHECK (maintenance_margin > 0),
+    max_leverage DECIMAL(5, 2) NOT NULL DEFAULT 2 CHECK (max_leverage >= 1), -- Gross exposure allowed per dollar of equity.
+    loan_balance DECIMAL(20, 2) NOT NULL DEFAULT 0 CHECK (loan_balance >= 0), -- Cash borrowed to buy on margin.
+    margin_call_at TIMESTAMP WITH TIME ZONE, -- Set while equity is below maintenance.
+    borrow_fee_charged_on DATE, -- Last day short positions were charged their borrow fee.
+    interest_charged_on DATE, -- Last day the loan accrued interest.
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (maintenance_margin <= initial_margin)
+);
+
+-- 10. Order Groups (brackets and one-cancels-other pairs)
+-- A bracket's exits wait as 'inactive' orders until its entry fills.
+CREATE TABLE IF NOT EXISTS order_groups (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(10) NOT NULL CHECK (type IN ('bracket', 'oco')),
+    status VARCHAR(10) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'completed', 'cancelled')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS group_id UUID REFERENCES order_groups(id) ON DELETE CASCADE;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS group_role VARCHAR(12)
+    CHECK (group_role IN ('entry', 'take_profit', 'stop_loss', 'leg'));
+CREATE INDEX IF NOT EXISTS idx_orders_group_id ON orders(group_id) WHERE group_id IS NOT NULL;
+
+-- 11. Trading Halts (admin halts and volatility circuit breakers)
+CREATE TABLE IF NOT EXISTS trading_halts (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    scope VARCHAR(12) NOT NULL CHECK (scope IN ('global', 'asset_class', 'symbol')),
+    target VARCHAR(20) NOT NULL DEFAULT '', -- Symbol or asset class; empty for a global halt.
+    reason TEXT NOT NULL,
+    source VARCHAR(16) NOT NULL CHECK (source IN ('admin', 'circuit_breaker')),
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL, -- The admin; null for the circuit breaker.
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE, -- Automatic resume. Null halts until lifted.
+    lifted_at TIMESTAMP WITH TIME ZONE
+);
+
+-- At most one live halt per scope and target.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_trading_halts_active ON trading_halts(scope, target) WHERE lifted_at IS NULL;
+
+-- 12. Ledger (double-entry journal of every cash, position and loan movement)
+-- wallets.balance, holdings.quantity and margin_accounts.loan_balance are
+-- running totals of the journal's cash, position and loan accounts.
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(12) NOT NULL CHECK (kind IN ('opening', 'deposit', 'buy', 'sell', 'borrow', 'repay', 'interest', 'borrow_fee')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_journal_entries_user_id ON journal_entries(user_id);
+
+-- Amounts are signed debits; each entry's lines sum to zero per asset.
+CREATE TABLE IF NOT EXISTS journal_lines (
+    id BIGSERIAL PRIMARY KEY,
+    entry_id UUID NOT NULL REFERENCES journal_entries(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    account VARCHAR(10) NOT NULL CHECK (account IN ('cash', 'position', 'loan', 'fees', 'interest', 'capital', 'trading')),
+    asset VARCHAR(10) NOT NULL, -- 'USD' or the symbol
+    amount DECIMAL(28, 8) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_journal_lines_entry_id ON journal_lines(entry_id);
+CREATE INDEX IF NOT EXISTS idx_journal_lines_balance ON journal_lines(user_id, account, asset);
+
+-- 13. Tax Lots (one per fill that opens or adds to a position)
+-- cost is what the open units cost, fees included; for short lots, what
+-- they raised.
+CREATE TABLE IF NOT EXISTS tax_lots (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    symbol VARCHAR(10) NOT NULL,
+    side VARCHAR(5) NOT NULL CHECK (side IN ('long', 'short')),
+    quantity DECIMAL(20, 8) NOT NULL CHECK (quantity > 0), -- Units opened
+    remaining DECIMAL(20, 8) NOT NULL CHECK (remaining >= 0), -- Units still open
+    cost DECIMAL(24, 8) NOT NULL, -- Of the remaining units
+    transaction_id UUID REFERENCES transactions(id) ON DELETE SET NULL, -- The fill that opened it
+    opened_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    closed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_tax_lots_open ON tax_lots(user_id, symbol) WHERE remaining > 0;
+
+-- 14. Lot Closures (realized gains and losses, one row per lot a fill closes)
+CREATE TABLE IF NOT EXISTS lot_closures (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    lot_id UUID NOT NULL REFERENCES tax_lots(id) ON DELETE CASCADE,
+    transaction_id UUID REFERENCES transactions(id) ON DELETE SET NULL, -- The fill that closed it
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    symbol VARCHAR(10) NOT NULL,
+    quantity DECIMAL(20, 8) NOT NULL,
+    cost_basis DECIMAL(24, 8) NOT NULL, -- Paid for the units: at entry for longs, to cover for shorts
+    proceeds DECIMAL(24, 8) NOT NULL, -- Received for the units: on the sale for longs, at entry for shorts
+    realized_pnl DECIMAL(24, 8) NOT NULL, -- proceeds - cost_basis
+    closed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_lot_closures_user_id ON lot_closures(user_id, closed_at);
+
+-- 15. Equity Snapshots (each account's value at the start of every day, and hour if enabled)
+CREATE TABLE IF NOT EXISTS equity_snapshots (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    granularity VARCHAR(2) NOT NULL CHECK (granularity IN ('1h', '1d')),
+    period TIMESTAMP WITH TIME ZONE NOT NULL, -- Start of the hour or UTC day
+    taken_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP, -- When it was valued; deposits before it are in it
+    cash DECIMAL(20, 2) NOT NULL,
+    loan DECIMAL(20, 2) NOT NULL DEFAULT 0,
+    market_value DECIMAL(24, 8) NOT NULL, -- Longs less shorts, of the holdings that could be priced
+    equity DECIMAL(24, 8) NOT NULL, -- cash - loan + market_value
+    holdings JSONB NOT NULL DEFAULT '[]', -- [{"symbol", "quantity", "price"}]; price null when unavailable
+    complete BOOLEAN NOT NULL, -- Every holding was priced
+    PRIMARY KEY (user_id, granularity, period)
+);
+
+-- 16. Benchmark Prices (feed prices of benchmark symbols, taken with the equity snapshots)
+CREATE TABLE IF NOT EXISTS benchmark_prices (
+    symbol VARCHAR(10) NOT NULL,
+    granularity VARCHAR(2) NOT NULL CHECK (granularity IN ('1h', '1d')),
+    period TIMESTAMP WITH TIME ZONE NOT NULL,
+    price DECIMAL(20, 8) NOT NULL,
+    taken_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (symbol, granularity, period)
+);
+
+-- Upgrades for databases created before the columns above existed.
+-- Every statement here must be safe to run on each startup.
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS reserved DECIMAL(20, 2) NOT NULL DEFAULT 0.00 CHECK (reserved >= 0);
+ALTER TABLE holdings ADD COLUMN IF NOT EXISTS reserved_quantity DECIMAL(20, 8) NOT NULL DEFAULT 0 CHECK (reserved_quantity >= 0);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fee DECIMAL(20, 2) NOT NULL DEFAULT 0;
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_type_check;
+ALTER TABLE transactions ADD CONSTRAINT transactions_type_check
+    CHECK (type IN ('DEPOSIT', 'WITHDRAW', 'BUY', 'SELL', 'BORROW_FEE', 'INTEREST'));
+ALTER TABLE orders ALTER COLUMN type TYPE VARCHAR(20);
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_type_check;
+ALTER TABLE orders ADD CONSTRAINT orders_type_check
+    CHECK (type IN ('market', 'limit', 'stop', 'stop_limit', 'trailing_stop', 'trailing_percent'));
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS stop_price DECIMAL(20, 8);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS trail_amount DECIMAL(20, 8);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS trail_percent DECIMAL(12, 8);
+-- Widened from DECIMAL(7, 4), which rounded the percent the handler accepts.
+ALTER TABLE orders ALTER COLUMN trail_percent TYPE DECIMAL(12, 8);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS water_mark DECIMAL(20, 8);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS triggered_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS time_in_force VARCHAR(3) NOT NULL DEFAULT 'gtc'
+    CHECK (time_in_force IN ('gtc', 'day', 'ioc', 'fok', 'gtd'));
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE orders ALTER COLUMN status TYPE VARCHAR(20);
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
+ALTER TABLE orders ADD CONSTRAINT orders_status_check
+    CHECK (status IN ('pending', 'inactive', 'partially_filled', 'filled', 'cancelled', 'rejected', 'expired'));
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS reserved_cash DECIMAL(20, 2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS reserved_quantity DECIMAL(20, 8) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS filled_quantity DECIMAL(20, 8) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS average_fill_price DECIMAL(20, 8);
+-- Orders filled before partial fills existed were filled in full.
+UPDATE orders SET filled_quantity = quantity WHERE status = 'filled' AND filled_quantity = 0;
+
+CREATE INDEX IF NOT EXISTS idx_orders_expires_at ON orders(expires_at) WHERE expires_at IS NOT NULL;
+ALTER TABLE order_fills ADD COLUMN IF NOT EXISTS fee DECIMAL(20, 2) NOT NULL DEFAULT 0;
+ALTER TABLE order_fills ADD COLUMN IF NOT EXISTS reference_price DECIMAL(20, 8);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS source VARCHAR(12) NOT NULL DEFAULT 'user'
+    CHECK (source IN ('user', 'liquidation'));
+ALTER TABLE margin_accounts ADD COLUMN IF NOT EXISTS max_leverage DECIMAL(5, 2) NOT NULL DEFAULT 2 CHECK (max_leverage >= 1);
+ALTER TABLE margin_accounts ADD COLUMN IF NOT EXISTS loan_balance DECIMAL(20, 2) NOT NULL DEFAULT 0 CHECK (loan_balance >= 0);
+ALTER TABLE margin_accounts ADD COLUMN IF NOT EXISTS interest_charged_on DATE;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS extended_hours BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+-- Prices carry up to eight decimal places so sub-cent coins keep their ticks.
+ALTER TABLE holdings ALTER COLUMN average_buy_price TYPE DECIMAL(20, 8);
+ALTER TABLE transactions ALTER COLUMN price_per_unit TYPE DECIMAL(20, 8);
+ALTER TABLE orders ALTER COLUMN price TYPE DECIMAL(20, 8);
+ALTER TABLE orders ALTER COLUMN stop_price TYPE DECIMAL(20, 8);
+ALTER TABLE orders ALTER COLUMN trail_amount TYPE DECIMAL(20, 8);
+ALTER TABLE orders ALTER COLUMN water_mark TYPE DECIMAL(20, 8);
+ALTER TABLE orders ALTER COLUMN average_fill_price TYPE DECIMAL(20, 8);
+ALTER TABLE order_fills ALTER COLUMN price TYPE DECIMAL(20, 8);
+ALTER TABLE order_fills ALTER COLUMN reference_price TYPE DECIMAL(20, 8);
+-- Balances from before the ledger open it: one 'opening' entry per user with
+-- cash, a position or a loan, against capital. Users with journal entries
+-- are skipped, so this books each balance once.
+WITH balances AS (
+    SELECT user_id, 'cash' AS account, currency AS asset, balance AS amount FROM wallets WHERE balance <> 0
+    UNION ALL SELECT user_id, 'position', symbol, quantity FROM holdings WHERE quantity <> 0
+    UNION ALL SELECT user_id, 'loan', 'USD', -loan_balance FROM margin_accounts WHERE loan_balance <> 0
+), opened AS (
+    INSERT INTO journal_entries (user_id, kind)
+    SELECT DISTINCT b.user_id, 'opening' FROM balances b
+    WHERE NOT EXISTS (SELECT 1 FROM journal_entries j WHERE j.user_id = b.user_id)
+    RETURNING id, user_id
+)
+INSERT INTO journal_lines (entry_id, user_id, account, asset, amount)
+SELECT o.id, o.user_id, b.account, b.asset, b.amount FROM opened o JOIN balances b ON b.user_id = o.user_id
+UNION ALL
+SELECT o.id, o.user_id, 'capital', b.asset, -b.amount FROM opened o JOIN balances b ON b.user_id = o.user_id;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS lot_method VARCHAR(4) NOT NULL DEFAULT 'fifo'
+    CHECK (lot_method IN ('fifo', 'lifo', 'hifo'));
+-- Positions from before tax lots open a single lot at their average price.
+INSERT INTO tax_lots (user_id, symbol, side, quantity, remaining, cost)
+SELECT h.user_id, h.symbol, CASE WHEN h.quantity > 0 THEN 'long' ELSE 'short' END,
+    ABS(h.quantity), ABS(h.quantity), ABS(h.quantity) * h.average_buy_price
+FROM holdings h
+WHERE h.quantity <> 0 AND h.user_id IS NOT NULL
+    AND NOT EXISTS (SELECT 1 FROM tax_lots l WHERE l.user_id = h.user_id AND l.symbol = h.symbol AND l.remaining > 0);
+-- Transaction history pages by time and looks up each fill's realized gain.
+CREATE INDEX IF NOT EXISTS idx_transactions_user_created ON transactions(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_lot_closures_transaction_id ON lot_closures(transaction_id);
@@ -0,0 +1,500 @@
+// Package decimal is the fixed-point number every price, quantity and cash
+// amount is kept in, so balances and positions add up exactly where float64
+// would drift: 0.1 + 0.2 of a coin is 0.3 of it.
+//
+// A Decimal is a count of 10^-8 units held in 128 bits, far more than any
+// balance the database can hold. Sums and differences are exact; products
+// and quotients round half away from zero to eight places, as Postgres
+// numeric does. A result too large to hold panics rather than wrapping. The
+// zero value is 0, and Decimals compare with ==.
+package decimal
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// Places is the number of digits kept after the decimal point.
+const Places = 8
+
+// maxInputDigits bounds the integer digits accepted from clients, so no
+// product of two inputs can outgrow a Decimal.
+const maxInputDigits = 15
+
+var (
+	ErrSyntax  = errors.New("invalid decimal")
+	ErrRange   = errors.New("decimal out of range")
+	ErrInexact = fmt.Errorf("more than %d decimal places", Places)
+)
+
+var (
+	bigScale  = big.NewInt(1e8)
+	bigMask64 = new(big.Int).SetUint64(math.MaxUint64)
+)
+
+// Decimal is a fixed-point number with Places digits after the point.
+type Decimal struct {
+	hi int64  // two's complement high word of the 10^-8 unit count
+	lo uint64 // low word
+}
+
+// Zero is 0.
+var Zero Decimal
+
+// New returns coef × 10^exp, rounded to Places.
+func New(coef int64, exp int32) Decimal {
+	b := big.NewInt(coef)
+	shift := int64(exp) + Places
+	if shift < 0 {
+		return fromBig(quoRound(b, pow10(-shift)))
+	}
+	return fromBig(b.Mul(b, pow10(shift)))
+}
+
+// FromInt returns n.
+func FromInt(n int64) Decimal {
+	return New(n, 0)
+}
+
+// FromFloat returns f rounded to Places. NaN and infinities are 0; it is
+// meant for values that arrive as floats, such as upstream price feeds.
+func FromFloat(f float64) Decimal {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Zero
+	}
+	d, _ := Parse(strconv.FormatFloat(f, 'f', Places, 64))
+	return d
+}
+
+// Parse reads a decimal such as "-12.5" or "1e-7", rounding it to Places.
+func Parse(s string) (Decimal, error) {
+	d, _, err := parse(s)
+	return d, err
+}
+
+// MustParse is Parse for constants; it panics on bad input.
+func MustParse(s string) Decimal {
+	d, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// parse reads s and reports whether it fit in Places without rounding.
+func parse(s string) (d Decimal, exact bool, err error) {
+	s = strings.TrimSpace(s)
+	mant, exp := s, int64(0)
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		if exp, err = strconv.ParseInt(s[i+1:], 10, 32); err != nil {
+			return Zero, false, fmt.Errorf("%w: %q", ErrSyntax, s)
+		}
+		mant = s[:i]
+	}
+	neg := false
+	if mant != "" && (mant[0] == '-' || mant[0] == '+') {
+		neg = mant[0] == '-'
+		mant = mant[1:]
+	}
+	intPart, frac, _ := strings.Cut(mant, ".")
+	digits := intPart + frac
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return Zero, false, fmt.Errorf("%w: %q", ErrSyntax, s)
+	}
+	b, _ := new(big.Int).SetString(digits, 10)
+	if neg {
+		b.Neg(b)
+	}
+	// b × 10^(exp - len(frac)) in units of 10^-Places.
+	shift := exp - int64(len(frac)) + Places
+	if shift > 40 && b.Sign() != 0 {
+		return Zero, false, fmt.Errorf("%w: %q", ErrRange, s)
+	}
+	if shift >= 0 {
+		b.Mul(b, pow10(shift))
+		exact = true
+	} else {
+		if -shift > 60 {
+			return Zero, b.Sign() == 0, nil
+		}
+		div := pow10(-shift)
+		exact = new(big.Int).Rem(b, div).Sign() == 0
+		b = quoRound(b, div)
+	}
+	if b.BitLen() > 120 {
+		return Zero, false, fmt.Errorf("%w: %q", ErrRange, s)
+	}
+	return fromBig(b), exact, nil
+}
+
+func pow10(n int64) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(n), nil)
+}
+
+// quoRound divides n by m, rounding half away from zero.
+func quoRound(n, m *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(n, m, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+	r.Abs(r).Lsh(r, 1)
+	if r.CmpAbs(m) >= 0 {
+		if n.Sign() == m.Sign() {
+			q.Add(q, big.NewInt(1))
+		} else {
+			q.Sub(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+func (d Decimal) big() *big.Int {
+	b := new(big.Int).Lsh(big.NewInt(d.hi), 64)
+	return b.Add(b, new(big.Int).SetUint64(d.lo))
+}
+
+func fromBig(b *big.Int) Decimal {
+	if b.BitLen() > 127 {
+		panic("decimal: overflow")
+	}
+	lo := new(big.Int).And(b, bigMask64).Uint64()
+	hi := new(big.Int).Rsh(b, 64).Int64()
+	return Decimal{hi: hi, lo: lo}
+}
+
+// Add returns d + e.
+func (d Decimal) Add(e Decimal) Decimal {
+	lo, carry := bits.Add64(d.lo, e.lo, 0)
+	r := Decimal{hi: d.hi + e.hi + int64(carry), lo: lo}
+	// Adding like signs can only overflow into the opposite sign.
+	if (d.hi < 0) == (e.hi < 0) && (r.hi < 0) != (d.hi < 0) {
+		panic("decimal: overflow")
+	}
+	return r
+}
+
+// Sub returns d - e.
+func (d Decimal) Sub(e Decimal) Decimal {
+	lo, borrow := bits.Sub64(d.lo, e.lo, 0)
+	r := Decimal{hi: d.hi - e.hi - int64(borrow), lo: lo}
+	if (d.hi < 0) != (e.hi < 0) && (r.hi < 0) != (d.hi < 0) {
+		panic("decimal: overflow")
+	}
+	return r
+}
+
+// Neg returns -d.
+func (d Decimal) Neg() Decimal {
+	return Zero.Sub(d)
+}
+
+// Abs returns |d|.
+func (d Decimal) Abs() Decimal {
+	if d.hi < 0 {
+		return d.Neg()
+	}
+	return d
+}
+
+// Mul returns d × e rounded to Places.
+func (d Decimal) Mul(e Decimal) Decimal {
+	if d.IsZero() || e.IsZero() {
+		return Zero
+	}
+	p := new(big.Int).Mul(d.big(), e.big())
+	return fromBig(quoRound(p, bigScale))
+}
+
+// Div returns d / e rounded to Places. It panics when e is zero.
+func (d Decimal) Div(e Decimal) Decimal {
+	if e.IsZero() {
+		panic("decimal: division by zero")
+	}
+	n := new(big.Int).Mul(d.big(), bigScale)
+	return fromBig(quoRound(n, e.big()))
+}
+
+// Cmp returns -1, 0 or +1 as d is less than, equal to or greater than e.
+func (d Decimal) Cmp(e Decimal) int {
+	switch {
+	case d.hi < e.hi:
+		return -1
+	case d.hi > e.hi:
+		return 1
+	case d.lo < e.lo:
+		return -1
+	case d.lo > e.lo:
+		return 1
+	}
+	return 0
+}
+
+// Sign returns -1, 0 or +1.
+func (d Decimal) Sign() int {
+	return d.Cmp(Zero)
+}
+
+// Comparisons.
+func (d Decimal) IsZero() bool               { return d == Zero }
+func (d Decimal) IsPositive() bool           { return d.Sign() > 0 }
+func (d Decimal) IsNegative() bool           { return d.hi < 0 }
+func (d Decimal) LessThan(e Decimal) bool    { return d.Cmp(e) < 0 }
+func (d Decimal) GreaterThan(e Decimal) bool { return d.Cmp(e) > 0 }
+
+// Min returns the smaller of a and b.
+func Min(a, b Decimal) Decimal {
+	if a.Cmp(b) <= 0 {
+		return a
+	}
+	return b
+}
+
+// Max returns the larger of a and b.
+func Max(a, b Decimal) Decimal {
+	if a.Cmp(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+// Round rounds d half away from zero to places digits after the point.
+func (d Decimal) Round(places int32) Decimal {
+	if places >= Places {
+		return d
+	}
+	unit := pow10(int64(Places - places))
+	q := quoRound(d.big(), unit)
+	return fromBig(q.Mul(q, unit))
+}
+
+// Truncate drops the digits after places, rounding toward zero.
+func (d Decimal) Truncate(places int32) Decimal {
+	if places >= Places {
+		return d
+	}
+	unit := pow10(int64(Places - places))
+	q := new(big.Int).Quo(d.big(), unit)
+	return fromBig(q.Mul(q, unit))
+}
+
+// RoundTo rounds d half away from zero to a multiple of step, such as a
+// price tick. A step that isn't positive leaves d as it is.
+func (d Decimal) RoundTo(step Decimal) Decimal {
+	if !step.IsPositive() {
+		return d
+	}
+	unit := step.big()
+	q := quoRound(d.big(), unit)
+	return fromBig(q.Mul(q, unit))
+}
+
+// TruncateTo rounds d toward zero to a multiple of step, such as a lot.
+// A step that isn't positive leaves d as it is.
+func (d Decimal) TruncateTo(step Decimal) Decimal {
+	if !step.IsPositive() {
+		return d
+	}
+	unit := step.big()
+	q := new(big.Int).Quo(d.big(), unit)
+	return fromBig(q.Mul(q, unit))
+}
+
+// RoundUp rounds d away from zero to places digits after the point.
+func (d Decimal) RoundUp(places int32) Decimal {
+	t := d.Truncate(places)
+	if t == d {
+		return t
+	}
+	step := New(1, -places)
+	if d.IsNegative() {
+		return t.Sub(step)
+	}
+	return t.Add(step)
+}
+
+// Float64 returns the nearest float64, for statistics and models that
+// don't need exact money.
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// String formats d with as few digits after the point as it needs.
+func (d Decimal) String() string {
+	s := d.fixed(Places)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// StringFixed rounds d to places and formats it with exactly that many
+// digits after the point.
+func (d Decimal) StringFixed(places int32) string {
+	if places < 0 {
+		places = 0
+	}
+	if places > Places {
+		return d.fixed(Places) + strings.Repeat("0", int(places-Places))
+	}
+	return d.Round(places).fixed(places)
+}
+
+// fixed formats d, already a multiple of 10^-places, with places decimals.
+func (d Decimal) fixed(places int32) string {
+	b := d.big()
+	neg := b.Sign() < 0
+	digits := b.Abs(b).String()
+	if len(digits) <= Places {
+		digits = strings.Repeat("0", Places-len(digits)+1) + digits
+	}
+	cut := len(digits) - Places
+	s := digits[:cut]
+	if places > 0 {
+		s += "." + digits[cut:cut+int(places)]
+	}
+	if neg && strings.Trim(s, "0.") != "" {
+		s = "-" + s
+	}
+	return s
+}
+
+// Format implements fmt.Formatter: %v and %s print String, and %f prints
+// a fixed number of places (%.2f for cents).
+func (d Decimal) Format(f fmt.State, verb rune) {
+	var s string
+	switch verb {
+	case 'f':
+		if p, ok := f.Precision(); ok {
+			s = d.StringFixed(int32(p))
+		} else {
+			s = d.fixed(Places)
+		}
+	case 'v', 's':
+		s = d.String()
+	default:
+		fmt.Fprintf(f, "%%!%c(decimal=%s)", verb, d.String())
+		return
+	}
+	if w, ok := f.Width(); ok && len(s) < w {
+		pad := strings.Repeat(" ", w-len(s))
+		if f.Flag('-') {
+			s += pad
+		} else {
+			s = pad + s
+		}
+	}
+	fmt.Fprint(f, s)
+}
+
+// MarshalJSON writes d as a JSON number.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON reads a JSON number or numeric string. Client input is held
+// to Places digits after the point and a sane magnitude rather than rounded.
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	s = strings.Trim(s, `"`)
+	v, exact, err := parse(s)
+	if err != nil {
+		return err
+	}
+	if !exact {
+		return fmt.Errorf("%s has %w", s, ErrInexact)
+	}
+	if v.Abs().Cmp(New(1, maxInputDigits)) >= 0 {
+		return fmt.Errorf("%w: %s", ErrRange, s)
+	}
+	*d = v
+	return nil
+}
+
+// Scan implements sql.Scanner for NUMERIC columns.
+func (d *Decimal) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return d.scanString(string(v))
+	case string:
+		return d.scanString(v)
+	case int64:
+		*d = FromInt(v)
+		return nil
+	case float64:
+		*d = FromFloat(v)
+		return nil
+	case nil:
+		return errors.New("decimal: cannot scan NULL; use NullDecimal")
+	}
+	return fmt.Errorf("decimal: cannot scan %T", src)
+}
+
+func (d *Decimal) scanString(s string) error {
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// Value implements driver.Valuer; Postgres reads the text as numeric.
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// NullDecimal is a Decimal that may be NULL.
+type NullDecimal struct {
+	Decimal Decimal
+	Valid   bool
+}
+
+// NewNull returns a valid NullDecimal holding d.
+func NewNull(d Decimal) NullDecimal {
+	return NullDecimal{Decimal: d, Valid: true}
+}
+
+// NullFrom is NULL for a nil pointer and *p otherwise.
+func NullFrom(p *Decimal) NullDecimal {
+	if p == nil {
+		return NullDecimal{}
+	}
+	return NewNull(*p)
+}
+
+// Ptr returns nil for NULL and a pointer to a copy of the value otherwise.
+func (n NullDecimal) Ptr() *Decimal {
+	if !n.Valid {
+		return nil
+	}
+	d := n.Decimal
+	return &d
+}
+
+// Scan implements sql.Scanner.
+func (n *NullDecimal) Scan(src any) error {
+	if src == nil {
+		*n = NullDecimal{}
+		return nil
+	}
+	n.Valid = true
+	return n.Decimal.Scan(src)
+}
+
+// Value implements driver.Valuer.
+func (n NullDecimal) Value() (driver.Value, error) {
+	if !n.Valid {
+		return nil, nil
+	}
+	return n.Decimal.Value()
+}
@@ -0,0 +1,333 @@
+package decimal
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"0", "0"},
+		{"-0", "0"},
+		{"+1.5", "1.5"},
+		{"-12.5", "-12.5"},
+		{"  42  ", "42"},
+		{"0.1", "0.1"},
+		{".5", "0.5"},
+		{"5.", "5"},
+		{"1e-7", "0.0000001"},
+		{"1.5E3", "1500"},
+		{"0.00000001", "0.00000001"},
+		{"123456789012345.12345678", "123456789012345.12345678"},
+		// Beyond Places rounds half away from zero.
+		{"0.000000005", "0.00000001"},
+		{"0.000000004", "0"},
+		{"-0.000000005", "-0.00000001"},
+		{"1.999999995", "2"},
+		{"1e-70", "0"},
+	}
+	for _, tt := range tests {
+		d, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if got := d.String(); got != tt.want {
+			t.Errorf("Parse(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+		// What String prints parses back to the same value.
+		if back := MustParse(d.String()); back != d {
+			t.Errorf("Parse(%q) round trip = %s, want %s", tt.in, back, d)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		in   string
+		want error
+	}{
+		{"", ErrSyntax},
+		{"-", ErrSyntax},
+		{".", ErrSyntax},
+		{"abc", ErrSyntax},
+		{"1.2.3", ErrSyntax},
+		{"1,000", ErrSyntax},
+		{"--1", ErrSyntax},
+		{"1e", ErrSyntax},
+		{"1ex", ErrSyntax},
+		{"NaN", ErrSyntax},
+		{"1e50", ErrRange},
+		{"1000000000000000000000000000000000000000", ErrRange},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.in); !errors.Is(err, tt.want) {
+			t.Errorf("Parse(%q) error = %v, want %v", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		a, b               string
+		sum, diff, product string
+		quotient           string
+	}{
+		{"0.1", "0.2", "0.3", "-0.1", "0.02", "0.5"},
+		{"1", "3", "4", "-2", "3", "0.33333333"},
+		{"2", "3", "5", "-1", "6", "0.66666667"},
+		{"-2", "3", "1", "-5", "-6", "-0.66666667"},
+		{"-1", "-3", "-4", "2", "3", "0.33333333"},
+		{"100.5", "-0.25", "100.25", "100.75", "-25.125", "-402"},
+		// Products round half away from zero: 0.00000005 × 0.1 = 0.000000005.
+		{"0.00000005", "0.1", "0.10000005", "-0.09999995", "0.00000001", "0.0000005"},
+		{"-0.00000005", "0.1", "0.09999995", "-0.10000005", "-0.00000001", "-0.0000005"},
+		{"0.00000004", "0.1", "0.10000004", "-0.09999996", "0", "0.0000004"},
+		// Quotients too: 1/16 = 0.0625, 0.00000001/2 = 0.000000005.
+		{"0.00000001", "2", "2.00000001", "-1.99999999", "0.00000002", "0.00000001"},
+		{"-0.00000001", "2", "1.99999999", "-2.00000001", "-0.00000002", "-0.00000001"},
+		{"123456789012345", "1000", "123456789013345", "123456789011345", "123456789012345000", "123456789012.345"},
+	}
+	for _, tt := range tests {
+		a, b := MustParse(tt.a), MustParse(tt.b)
+		check := func(op, got, want string) {
+			if got != want {
+				t.Errorf("%s %s %s = %s, want %s", tt.a, op, tt.b, got, want)
+			}
+		}
+		check("+", a.Add(b).String(), tt.sum)
+		check("-", a.Sub(b).String(), tt.diff)
+		check("×", a.Mul(b).String(), tt.product)
+		check("÷", a.Div(b).String(), tt.quotient)
+	}
+}
+
+func TestAddCarries(t *testing.T) {
+	// Values straddling the 64-bit low word carry and borrow into the high word.
+	big := MustParse("184467440737.09551615") // 2^64 - 1 units
+	one := MustParse("0.00000001")
+	if got := big.Add(one).String(); got != "184467440737.09551616" {
+		t.Errorf("carry = %s", got)
+	}
+	if got := big.Add(one).Sub(one); got != big {
+		t.Errorf("borrow = %s, want %s", got, big)
+	}
+	if got := Zero.Sub(one).Add(one); got != Zero {
+		t.Errorf("-1 unit + 1 unit = %s, want 0", got)
+	}
+	if got := big.Neg().Abs(); got != big {
+		t.Errorf("Abs(-x) = %s, want %s", got, big)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	mustPanic := func(name string, f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s didn't panic", name)
+			}
+		}()
+		f()
+	}
+	huge := MustParse("1e25")
+	mustPanic("Mul overflow", func() { huge.Mul(huge) })
+	mustPanic("Div overflow", func() { huge.Div(MustParse("0.00000001")) })
+	mustPanic("Div by zero", func() { FromInt(1).Div(Zero) })
+
+	// The largest client inputs multiply without overflowing.
+	max := MustParse("999999999999999.99999999")
+	if got := max.Mul(max).String(); got != "999999999999999999999980000000" {
+		t.Errorf("max × max = %s", got)
+	}
+	if got := max.Neg().Mul(max).String(); got != "-999999999999999999999980000000" {
+		t.Errorf("-max × max = %s", got)
+	}
+
+	// Sums that don't fit panic instead of wrapping round to the other sign.
+	top := max.Mul(max)
+	mustPanic("Add overflow", func() { top.Add(top) })
+	mustPanic("Sub overflow", func() { top.Neg().Sub(top) })
+	if got := top.Add(top.Neg()); got != Zero {
+		t.Errorf("x + -x = %s", got)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	a, b := MustParse("-1.5"), MustParse("0.00000001")
+	if a.Cmp(b) != -1 || b.Cmp(a) != 1 || a.Cmp(a) != 0 {
+		t.Error("Cmp ordering")
+	}
+	if !a.IsNegative() || a.IsPositive() || !b.IsPositive() || Zero.Sign() != 0 {
+		t.Error("sign predicates")
+	}
+	if Min(a, b) != a || Max(a, b) != b {
+		t.Error("Min/Max")
+	}
+	if MustParse("1.50") != MustParse("1.5") {
+		t.Error("equal values compare unequal with ==")
+	}
+}
+
+func TestRounding(t *testing.T) {
+	tests := []struct {
+		in                       string
+		places                   int32
+		round, truncate, roundUp string
+	}{
+		{"1.005", 2, "1.01", "1", "1.01"},
+		{"1.004", 2, "1", "1", "1.01"},
+		{"-1.005", 2, "-1.01", "-1", "-1.01"},
+		{"-1.004", 2, "-1", "-1", "-1.01"},
+		{"2.5", 0, "3", "2", "3"},
+		{"-2.5", 0, "-3", "-2", "-3"},
+		{"1.23", 2, "1.23", "1.23", "1.23"},
+		{"1.23456789", 8, "1.23456789", "1.23456789", "1.23456789"},
+		{"1.23456789", 10, "1.23456789", "1.23456789", "1.23456789"},
+	}
+	for _, tt := range tests {
+		d := MustParse(tt.in)
+		if got := d.Round(tt.places).String(); got != tt.round {
+			t.Errorf("%s.Round(%d) = %s, want %s", tt.in, tt.places, got, tt.round)
+		}
+		if got := d.Truncate(tt.places).String(); got != tt.truncate {
+			t.Errorf("%s.Truncate(%d) = %s, want %s", tt.in, tt.places, got, tt.truncate)
+		}
+		if got := d.RoundUp(tt.places).String(); got != tt.roundUp {
+			t.Errorf("%s.RoundUp(%d) = %s, want %s", tt.in, tt.places, got, tt.roundUp)
+		}
+	}
+}
+
+func TestRoundToStep(t *testing.T) {
+	tests := []struct {
+		in, step         string
+		roundTo, truncTo string
+	}{
+		{"10.07", "0.05", "10.05", "10.05"},
+		{"10.075", "0.05", "10.1", "10.05"},
+		{"-10.075", "0.05", "-10.1", "-10.05"},
+		{"7", "5", "5", "5"},
+		{"7.5", "5", "10", "5"},
+		{"0.123456789", "0.001", "0.123", "0.123"},
+		{"3.3", "0", "3.3", "3.3"},
+		{"3.3", "-1", "3.3", "3.3"},
+	}
+	for _, tt := range tests {
+		d, step := MustParse(tt.in), MustParse(tt.step)
+		if got := d.RoundTo(step).String(); got != tt.roundTo {
+			t.Errorf("%s.RoundTo(%s) = %s, want %s", tt.in, tt.step, got, tt.roundTo)
+		}
+		if got := d.TruncateTo(step).String(); got != tt.truncTo {
+			t.Errorf("%s.TruncateTo(%s) = %s, want %s", tt.in, tt.step, got, tt.truncTo)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		in     string
+		places int32
+		str    string
+		fixed  string
+	}{
+		{"0", 2, "0", "0.00"},
+		{"1.5", 2, "1.5", "1.50"},
+		{"-1.5", 0, "-1.5", "-2"},
+		{"-0.004", 2, "-0.004", "0.00"},
+		{"0.00000001", 8, "0.00000001", "0.00000001"},
+		{"12.345", 10, "12.345", "12.3450000000"},
+		{"-1234567.891", 1, "-1234567.891", "-1234567.9"},
+	}
+	for _, tt := range tests {
+		d := MustParse(tt.in)
+		if got := d.String(); got != tt.str {
+			t.Errorf("%s.String() = %s, want %s", tt.in, got, tt.str)
+		}
+		if got := d.StringFixed(tt.places); got != tt.fixed {
+			t.Errorf("%s.StringFixed(%d) = %s, want %s", tt.in, tt.places, got, tt.fixed)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		A Decimal  `json:"a"`
+		B Decimal  `json:"b"`
+		C *Decimal `json:"c"`
+	}
+	if err := json.Unmarshal([]byte(`{"a": 1.25, "b": "-0.5", "c": null}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.A.String() != "1.25" || v.B.String() != "-0.5" || v.C != nil {
+		t.Errorf("unmarshalled %s, %s, %v", v.A, v.B, v.C)
+	}
+	out, _ := json.Marshal(v)
+	if string(out) != `{"a":1.25,"b":-0.5,"c":null}` {
+		t.Errorf("marshalled %s", out)
+	}
+
+	// Client input isn't rounded or allowed to grow past what products can hold.
+	for _, in := range []string{`0.000000001`, `"1e15"`, `-1000000000000000`, `"x"`} {
+		var d Decimal
+		if err := json.Unmarshal([]byte(in), &d); err == nil {
+			t.Errorf("Unmarshal(%s) = %s, want an error", in, d)
+		}
+	}
+}
+
+func TestScanValue(t *testing.T) {
+	tests := []struct {
+		src  any
+		want string
+	}{
+		{[]byte("123.45600000"), "123.456"},
+		{"-0.00000001", "-0.00000001"},
+		{[]byte("99999999999999999999.99999999"), "99999999999999999999.99999999"},
+		{int64(-7), "-7"},
+		{float64(0.1), "0.1"},
+	}
+	for _, tt := range tests {
+		var d Decimal
+		if err := d.Scan(tt.src); err != nil {
+			t.Errorf("Scan(%v): %v", tt.src, err)
+			continue
+		}
+		if d.String() != tt.want {
+			t.Errorf("Scan(%v) = %s, want %s", tt.src, d, tt.want)
+		}
+		v, err := d.Value()
+		if err != nil || v != tt.want {
+			t.Errorf("Value() = %v, %v, want %s", v, err, tt.want)
+		}
+	}
+
+	var d Decimal
+	if err := d.Scan(nil); err == nil {
+		t.Error("Scan(nil) into Decimal succeeded")
+	}
+	if err := d.Scan(true); err == nil {
+		t.Error("Scan(bool) succeeded")
+	}
+	if err := d.Scan("12abc"); err == nil {
+		t.Error("Scan of a malformed numeric succeeded")
+	}
+
+	var n NullDecimal
+	if err := n.Scan(nil); err != nil || n.Valid || n.Ptr() != nil {
+		t.Errorf("NullDecimal Scan(nil) = %+v, %v", n, err)
+	}
+	if v, _ := n.Value(); v != nil {
+		t.Errorf("NULL Value() = %v", v)
+	}
+	if err := n.Scan([]byte("2.50")); err != nil || !n.Valid || n.Ptr().String() != "2.5" {
+		t.Errorf("NullDecimal Scan(2.50) = %+v, %v", n, err)
+	}
+	if NullFrom(nil).Valid || NullFrom(n.Ptr()) != n {
+		t.Error("NullFrom")
+	}
+}
@@ -0,0 +1,75 @@
+// Package fees prices commissions for trades using per-asset-class schedules.
+package fees
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/precision"
+)
+
+// Schedule is one asset class's commission. Components add up; the result is
+// then raised to Minimum if it falls short of it.
+type Schedule struct {
+	Flat     decimal.Decimal `json:"flat"`      // Fixed USD per trade
+	PerShare decimal.Decimal `json:"per_share"` // USD per unit traded
+	BPS      decimal.Decimal `json:"bps"`       // Basis points of notional
+	MakerBPS decimal.Decimal `json:"maker_bps"` // Replaces BPS for resting orders (crypto venues)
+	TakerBPS decimal.Decimal `json:"taker_bps"` // Replaces BPS for orders that take liquidity
+	Minimum  decimal.Decimal `json:"min"`       // Floor per trade, applied only when the fee is non-zero
+}
+
+var basisPoints = decimal.FromInt(10000)
+
+// Fee returns the commission for trading quantity at price, in cents.
+func (s Schedule) Fee(quantity, price decimal.Decimal, maker bool) decimal.Decimal {
+	bps := s.BPS
+	if maker && s.MakerBPS.IsPositive() {
+		bps = s.MakerBPS
+	} else if !maker && s.TakerBPS.IsPositive() {
+		bps = s.TakerBPS
+	}
+	fee := s.Flat.Add(s.PerShare.Mul(quantity)).Add(quantity.Mul(price).Mul(bps).Div(basisPoints))
+	if fee.IsPositive() && fee.LessThan(s.Minimum) {
+		fee = s.Minimum
+	}
+	return precision.Cash(fee)
+}
+
+// Engine picks a schedule by the symbol's asset class.
+type Engine struct {
+	schedules  map[string]Schedule
+	assetClass func(symbol string) string
+}
+
+// NewEngine builds an engine. assetClass maps a symbol to a schedule key
+// (normally prices.Feed.AssetClass);
+// symbols whose class has no schedule trade free, as does everything with no
+// schedules at all.
+func NewEngine(schedules map[string]Schedule, assetClass func(symbol string) string) *Engine {
+	return &Engine{schedules: schedules, assetClass: assetClass}
+}
+
+// Fee returns the commission for a trade in symbol. A nil engine charges nothing.
+func (e *Engine) Fee(symbol string, quantity, price decimal.Decimal, maker bool) decimal.Decimal {
+	if e == nil {
+		return decimal.Zero
+	}
+	return e.schedules[e.assetClass(symbol)].Fee(quantity, price, maker)
+}
+
+// ParseSchedules reads a JSON object keyed by asset class, e.g.
+// {"equity":{"per_share":0.005,"min":1},"crypto":{"maker_bps":10,"taker_bps":20}}.
+// An empty spec returns no schedules: trading is free unless configured.
+func ParseSchedules(spec string) (map[string]Schedule, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	var out map[string]Schedule
+	if err := json.Unmarshal([]byte(spec), &out); err != nil {
+		return nil, fmt.Errorf("parse fee schedules: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,195 @@
+// Package funds holds and releases buying power for working orders.
+//
+// Placing an order earmarks the cash (buys) or shares (sells) it may need by
+// raising wallets.reserved or holdings.reserved_quantity, and records the
+// amount on the order itself. Whatever ends the order's life — fill, cancel,
+// expiry or rejection — calls ReleaseOrder in the same transaction.
+package funds
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/precision"
+)
+
+var (
+	ErrNoWallet             = errors.New("wallet not found")
+	ErrNoHolding            = errors.New("you don't own this asset")
+	ErrInsufficientFunds    = errors.New("insufficient funds")
+	ErrInsufficientHoldings = errors.New("insufficient holdings")
+)
+
+// HoldForOrder reserves cash for a buy or shares for a sell and records the
+// hold on the order. cash is the buy's estimated cost including fees; sells
+// ignore it. The order row must already exist in tx.
+func HoldForOrder(ctx context.Context, tx *sql.Tx, orderID, userID, side, symbol string, quantity, cash decimal.Decimal) error {
+	if side == "buy" {
+		amount := precision.Cash(cash)
+		var balance, reserved decimal.Decimal
+		err := tx.QueryRowContext(ctx,
+			`SELECT balance, reserved FROM wallets WHERE user_id=$1 AND currency='USD' FOR UPDATE`,
+			userID).Scan(&balance, &reserved)
+		if err == sql.ErrNoRows {
+			return ErrNoWallet
+		} else if err != nil {
+			return err
+		}
+		if available := balance.Sub(reserved); available.LessThan(amount) {
+			return fmt.Errorf("%w (need $%.2f, have $%.2f available)", ErrInsufficientFunds, amount, available)
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE wallets SET reserved = reserved + $1 WHERE user_id=$2 AND currency='USD'`,
+			amount, userID); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET reserved_cash=$1 WHERE id=$2`, amount, orderID)
+		return err
+	}
+
+	var held, reserved decimal.Decimal
+	err := tx.QueryRowContext(ctx,
+		`SELECT quantity, reserved_quantity FROM holdings WHERE user_id=$1 AND symbol=$2 FOR UPDATE`,
+		userID, symbol).Scan(&held, &reserved)
+	if err == sql.ErrNoRows {
+		return ErrNoHolding
+	} else if err != nil {
+		return err
+	}
+	if available := held.Sub(reserved); available.LessThan(quantity) {
+		return fmt.Errorf("%w (have %s available, selling %s)", ErrInsufficientHoldings, available, quantity)
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE holdings SET reserved_quantity = reserved_quantity + $1 WHERE user_id=$2 AND symbol=$3`,
+		quantity, userID, symbol); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET reserved_quantity=$1 WHERE id=$2`, quantity, orderID)
+	return err
+}
+
+// HoldForMarginOrder is HoldForOrder for margin accounts. It holds whatever
+// cash (buys) or long shares (sells) are free, up to what the order needs;
+// the rest is bought on the loan or sold short, which the margin check
+// covers instead of a hold.
+func HoldForMarginOrder(ctx context.Context, tx *sql.Tx, orderID, userID, side, symbol string, quantity, cash decimal.Decimal) error {
+	if side == "buy" {
+		var balance, reserved decimal.Decimal
+		err := tx.QueryRowContext(ctx,
+			`SELECT balance, reserved FROM wallets WHERE user_id=$1 AND currency='USD' FOR UPDATE`,
+			userID).Scan(&balance, &reserved)
+		if err == sql.ErrNoRows {
+			return ErrNoWallet
+		} else if err != nil {
+			return err
+		}
+		hold := decimal.Min(precision.Cash(cash), decimal.Max(balance.Sub(reserved), decimal.Zero))
+		if !hold.IsPositive() {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE wallets SET reserved = reserved + $1 WHERE user_id=$2 AND currency='USD'`,
+			hold, userID); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET reserved_cash=$1 WHERE id=$2`, hold, orderID)
+		return err
+	}
+
+	var held, reserved decimal.Decimal
+	err := tx.QueryRowContext(ctx,
+		`SELECT quantity, reserved_quantity FROM holdings WHERE user_id=$1 AND symbol=$2 FOR UPDATE`,
+		userID, symbol).Scan(&held, &reserved)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	hold := decimal.Min(quantity, decimal.Max(held.Sub(reserved), decimal.Zero))
+	if !hold.IsPositive() {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE holdings SET reserved_quantity = reserved_quantity + $1 WHERE user_id=$2 AND symbol=$3`,
+		hold, userID, symbol); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET reserved_quantity=$1 WHERE id=$2`, hold, orderID)
+	return err
+}
+
+// ReleaseOrder gives back whatever the order still holds. It is idempotent:
+// the order's recorded hold is zeroed so a second call is a no-op.
+func ReleaseOrder(ctx context.Context, tx *sql.Tx, orderID string) error {
+	var userID, symbol string
+	var cash, qty decimal.Decimal
+	if err := tx.QueryRowContext(ctx,
+		`SELECT user_id, symbol, reserved_cash, reserved_quantity FROM orders WHERE id=$1 FOR UPDATE`,
+		orderID).Scan(&userID, &symbol, &cash, &qty); err != nil {
+		return err
+	}
+	if cash.IsPositive() {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE wallets SET reserved = GREATEST(reserved - $1, 0) WHERE user_id=$2 AND currency='USD'`,
+			cash, userID); err != nil {
+			return err
+		}
+	}
+	if qty.IsPositive() {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE holdings SET reserved_quantity = GREATEST(reserved_quantity - $1, 0) WHERE user_id=$2 AND symbol=$3`,
+			qty, userID, symbol); err != nil {
+			return err
+		}
+	}
+	if cash.IsZero() && qty.IsZero() {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `UPDATE orders SET reserved_cash=0, reserved_quantity=0 WHERE id=$1`, orderID)
+	return err
+}
+
+// ReleaseFill gives back the part of an order's hold used by a partial fill of
+// qty out of the remaining quantity. Buys release the same fraction of their
+// cash hold; sells release exactly the shares filled.
+func ReleaseFill(ctx context.Context, tx *sql.Tx, orderID string, qty, remaining decimal.Decimal) error {
+	var userID, symbol string
+	var cash, heldQty decimal.Decimal
+	if err := tx.QueryRowContext(ctx,
+		`SELECT user_id, symbol, reserved_cash, reserved_quantity FROM orders WHERE id=$1 FOR UPDATE`,
+		orderID).Scan(&userID, &symbol, &cash, &heldQty); err != nil {
+		return err
+	}
+	if !remaining.IsPositive() {
+		return nil
+	}
+	cashPart := precision.Cash(cash.Mul(qty).Div(remaining))
+	qtyPart := decimal.Min(heldQty, qty)
+	if cashPart.IsPositive() {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE wallets SET reserved = GREATEST(reserved - $1, 0) WHERE user_id=$2 AND currency='USD'`,
+			cashPart, userID); err != nil {
+			return err
+		}
+	}
+	if qtyPart.IsPositive() {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE holdings SET reserved_quantity = GREATEST(reserved_quantity - $1, 0) WHERE user_id=$2 AND symbol=$3`,
+			qtyPart, userID, symbol); err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx,
+		`UPDATE orders SET reserved_cash=GREATEST(reserved_cash - $1, 0), reserved_quantity=GREATEST(reserved_quantity - $2, 0) WHERE id=$3`,
+		cashPart, qtyPart, orderID)
+	return err
+}
+
+// IsUserError reports whether err is a funds check the client should see as a 400.
+func IsUserError(err error) bool {
+	return errors.Is(err, ErrNoWallet) || errors.Is(err, ErrNoHolding) ||
+		errors.Is(err, ErrInsufficientFunds) || errors.Is(err, ErrInsufficientHoldings)
+}
@@ -0,0 +1,222 @@
+// Package groups links orders into brackets and one-cancels-other pairs.
+//
+// A bracket is an entry order plus two exits, a take-profit limit and a
+// stop-loss, which wait as 'inactive' orders until the entry fills and then
+// work as an OCO pair sized to what the entry filled. In an OCO pair the
+// first leg to fill cancels the other.
+//
+// The legs of a pair share one hold, recorded on a single leg. Whichever leg
+// fills, its siblings are cancelled and their holds released in the fill's
+// transaction before the fill is checked, so the cash or shares are there
+// for it. If the check then rejects the fill, the cancellation is rolled
+// back and the siblings keep working with the pair's hold, so the position
+// keeps its protection. Any other order in a group that ends without filling
+// ends the group.
+package groups
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/funds"
+	"github.com/sahniaditya/flux-backend/margin"
+)
+
+const working = `('pending', 'partially_filled', 'inactive')`
+
+// Cancel ends the group: every order in it that is still working or waiting
+// is cancelled and its hold released. It returns the ids it cancelled.
+func Cancel(ctx context.Context, tx *sql.Tx, groupID string) ([]string, error) {
+	ids, err := cancelOrders(ctx, tx, groupID, "")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE order_groups SET status='cancelled' WHERE id=$1 AND status='active'`, groupID)
+	return ids, err
+}
+
+// OnFill runs before an order's fill is checked and booked. When the order
+// is an exit or an OCO leg its siblings are cancelled and the group is done.
+// Entries leave the group alone. It returns the ids it cancelled.
+func OnFill(ctx context.Context, tx *sql.Tx, orderID string) ([]string, error) {
+	groupID, role, err := membership(ctx, tx, orderID)
+	if err != nil || groupID == "" || role == "entry" {
+		return nil, err
+	}
+	ids, err := cancelOrders(ctx, tx, groupID, orderID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE order_groups SET status='completed' WHERE id=$1 AND status='active'`, groupID)
+	return ids, err
+}
+
+// OnEntryDone activates a bracket's exits once its entry has filled all it
+// will, sized to the filled quantity. The take-profit carries the pair's
+// hold. It returns the ids it activated.
+func OnEntryDone(ctx context.Context, tx *sql.Tx, entryID string, filled decimal.Decimal) ([]string, error) {
+	groupID, role, err := membership(ctx, tx, entryID)
+	if err != nil || groupID == "" || role != "entry" || !filled.IsPositive() {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE orders SET status='pending', quantity=$1
+		WHERE group_id=$2 AND status='inactive'
+		RETURNING id, user_id, symbol, side, group_role, COALESCE(GREATEST(price, stop_price), price, stop_price, 0)`,
+		filled, groupID)
+	if err != nil {
+		return nil, err
+	}
+	type exit struct {
+		id, userID, symbol, side, role string
+		price                          decimal.Decimal
+	}
+	var exits []exit
+	for rows.Next() {
+		var e exit
+		if err := rows.Scan(&e.id, &e.userID, &e.symbol, &e.side, &e.role, &e.price); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		exits = append(exits, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	var holder *exit
+	for i := range exits {
+		ids = append(ids, exits[i].id)
+		if exits[i].role == "take_profit" || holder == nil {
+			holder = &exits[i]
+		}
+	}
+	if holder == nil {
+		return ids, nil
+	}
+
+	// Buy-to-cover exits hold enough cash for the dearer of the two legs.
+	cash := decimal.Zero
+	for _, e := range exits {
+		cash = decimal.Max(cash, filled.Mul(e.price))
+	}
+	acct, err := margin.Load(ctx, tx, holder.userID)
+	if err != nil {
+		return nil, err
+	}
+	if acct != nil {
+		err = funds.HoldForMarginOrder(ctx, tx, holder.id, holder.userID, holder.side, holder.symbol, filled, cash)
+	} else {
+		err = funds.HoldForOrder(ctx, tx, holder.id, holder.userID, holder.side, holder.symbol, filled, cash)
+	}
+	// The exits still work without a hold; the fill is checked either way.
+	if err != nil && !funds.IsUserError(err) {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// OnEnd runs when an order leaves the book before filling completely:
+// cancelled, expired or rejected. An entry that filled in part still gets
+// its exits for what it filled; otherwise the rest of the group goes with
+// it. It returns the ids it activated or cancelled.
+func OnEnd(ctx context.Context, tx *sql.Tx, orderID string) ([]string, error) {
+	groupID, role, err := membership(ctx, tx, orderID)
+	if err != nil || groupID == "" {
+		return nil, err
+	}
+	if role == "entry" {
+		var filled decimal.Decimal
+		if err := tx.QueryRowContext(ctx, `SELECT filled_quantity FROM orders WHERE id=$1`, orderID).Scan(&filled); err != nil {
+			return nil, err
+		}
+		if filled.IsPositive() {
+			return OnEntryDone(ctx, tx, orderID, filled)
+		}
+	}
+	return Cancel(ctx, tx, groupID)
+}
+
+// OnReject runs when an order's fill is rejected, after OnFill's
+// cancellations have been rolled back. An exit or OCO leg hands its hold to
+// a sibling that is still working and leaves the group to it; an entry ends
+// the group as OnEnd does. It returns the ids it touched.
+func OnReject(ctx context.Context, tx *sql.Tx, orderID string) ([]string, error) {
+	groupID, role, err := membership(ctx, tx, orderID)
+	if err != nil || groupID == "" {
+		return nil, err
+	}
+	if role == "entry" {
+		// Free the entry's hold first so its exits can hold in its place.
+		if err := funds.ReleaseOrder(ctx, tx, orderID); err != nil {
+			return nil, err
+		}
+		return OnEnd(ctx, tx, orderID)
+	}
+	var siblingID string
+	err = tx.QueryRowContext(ctx, `
+		SELECT id FROM orders WHERE group_id=$1 AND id<>$2 AND status IN ('pending', 'partially_filled')
+		ORDER BY created_at, id LIMIT 1`, groupID, orderID).Scan(&siblingID)
+	if err == sql.ErrNoRows {
+		_, err = tx.ExecContext(ctx, `UPDATE order_groups SET status='cancelled' WHERE id=$1 AND status='active'`, groupID)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The legs trade the same side of the same symbol, so the hold moves
+	// between their rows and the wallet or holding reservation stays put.
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE orders s SET reserved_cash = s.reserved_cash + r.reserved_cash,
+			reserved_quantity = s.reserved_quantity + r.reserved_quantity
+		FROM orders r WHERE s.id=$1 AND r.id=$2`, siblingID, orderID); err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET reserved_cash=0, reserved_quantity=0 WHERE id=$1`, orderID)
+	return []string{siblingID}, err
+}
+
+// GroupOf returns the order's group id, or "" when it isn't in one.
+func GroupOf(ctx context.Context, tx *sql.Tx, orderID string) (string, error) {
+	groupID, _, err := membership(ctx, tx, orderID)
+	return groupID, err
+}
+
+func membership(ctx context.Context, tx *sql.Tx, orderID string) (groupID, role string, err error) {
+	var g, r sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT group_id, group_role FROM orders WHERE id=$1`, orderID).Scan(&g, &r)
+	return g.String, r.String, err
+}
+
+func cancelOrders(ctx context.Context, tx *sql.Tx, groupID, exceptID string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE orders SET status='cancelled'
+		WHERE group_id=$1 AND id::text <> $2 AND status IN `+working+`
+		RETURNING id`, groupID, exceptID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if err := funds.ReleaseOrder(ctx, tx, id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
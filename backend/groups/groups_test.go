@@ -0,0 +1,247 @@
+package groups
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/sahniaditya/flux-backend/db/dbtest"
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/funds"
+)
+
+var ctx = context.Background()
+
+type leg struct {
+	role, side, typ, price, status string
+}
+
+// placeGroup inserts a group of AAPL orders for 10 units and returns the
+// group id and the order ids, in leg order.
+func placeGroup(t *testing.T, tx *sql.Tx, userID, typ string, legs ...leg) (string, []string) {
+	t.Helper()
+	var groupID string
+	if err := tx.QueryRow(`INSERT INTO order_groups (user_id, type) VALUES ($1, $2) RETURNING id`,
+		userID, typ).Scan(&groupID); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, l := range legs {
+		var price decimal.NullDecimal
+		if l.price != "" {
+			price = decimal.NewNull(decimal.MustParse(l.price))
+		}
+		var id string
+		if err := tx.QueryRow(`
+			INSERT INTO orders (user_id, symbol, side, type, quantity, price, status, group_id, group_role)
+			VALUES ($1, 'AAPL', $2, $3, 10, $4, $5, $6, $7) RETURNING id`,
+			userID, l.side, l.typ, price, l.status, groupID, l.role).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return groupID, ids
+}
+
+type orderState struct {
+	status      string
+	reservedQty decimal.Decimal
+}
+
+func state(t *testing.T, tx *sql.Tx, orderID string) orderState {
+	t.Helper()
+	var s orderState
+	if err := tx.QueryRow(`SELECT status, reserved_quantity FROM orders WHERE id=$1`, orderID).
+		Scan(&s.status, &s.reservedQty); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func groupStatus(t *testing.T, tx *sql.Tx, groupID string) string {
+	t.Helper()
+	var status string
+	if err := tx.QueryRow(`SELECT status FROM order_groups WHERE id=$1`, groupID).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func reservedShares(t *testing.T, tx *sql.Tx, userID string) decimal.Decimal {
+	t.Helper()
+	var qty decimal.Decimal
+	if err := tx.QueryRow(`SELECT reserved_quantity FROM holdings WHERE user_id=$1 AND symbol='AAPL'`, userID).
+		Scan(&qty); err != nil {
+		t.Fatal(err)
+	}
+	return qty
+}
+
+// filledBracket places a long bracket whose entry has filled 10 and armed
+// its exits, and returns the group, entry, take-profit and stop-loss ids.
+func filledBracket(t *testing.T, tx *sql.Tx) (userID, groupID, entry, tp, sl string) {
+	t.Helper()
+	userID = dbtest.User(t, tx, "10000")
+	groupID, ids := placeGroup(t, tx, userID, "bracket",
+		leg{"entry", "buy", "market", "", "pending"},
+		leg{"take_profit", "sell", "limit", "110", "inactive"},
+		leg{"stop_loss", "sell", "stop", "90", "inactive"})
+	entry, tp, sl = ids[0], ids[1], ids[2]
+
+	// The entry is an entry: filling it leaves the group alone.
+	if cancelled, err := OnFill(ctx, tx, entry); err != nil || len(cancelled) != 0 {
+		t.Fatalf("entry fill cancelled %v, %v", cancelled, err)
+	}
+	dbtest.Holding(t, tx, userID, "AAPL", "10")
+	if _, err := tx.Exec(`UPDATE orders SET status='filled', filled_quantity=10 WHERE id=$1`, entry); err != nil {
+		t.Fatal(err)
+	}
+	activated, err := OnEntryDone(ctx, tx, entry, decimal.FromInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activated) != 2 {
+		t.Fatalf("activated %v, want both exits", activated)
+	}
+	return userID, groupID, entry, tp, sl
+}
+
+func TestBracketEntryFillArmsExits(t *testing.T) {
+	tx := dbtest.Tx(t)
+	userID, groupID, _, tp, sl := filledBracket(t, tx)
+
+	ten := decimal.FromInt(10)
+	if s := state(t, tx, tp); s.status != "pending" || s.reservedQty != ten {
+		t.Errorf("take-profit %+v, want pending holding 10", s)
+	}
+	if s := state(t, tx, sl); s.status != "pending" || !s.reservedQty.IsZero() {
+		t.Errorf("stop-loss %+v, want pending with the hold on its sibling", s)
+	}
+	if got := reservedShares(t, tx, userID); got != ten {
+		t.Errorf("holding reserves %s, want 10", got)
+	}
+	if got := groupStatus(t, tx, groupID); got != "active" {
+		t.Errorf("group %s, want active", got)
+	}
+}
+
+func TestExitFillCancelsSibling(t *testing.T) {
+	tx := dbtest.Tx(t)
+	userID, groupID, _, tp, sl := filledBracket(t, tx)
+
+	// The stop-loss fills: the take-profit goes, and with it the pair's hold.
+	cancelled, err := OnFill(ctx, tx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cancelled, []string{tp}) {
+		t.Errorf("cancelled %v, want the take-profit", cancelled)
+	}
+	if s := state(t, tx, tp); s.status != "cancelled" || !s.reservedQty.IsZero() {
+		t.Errorf("take-profit %+v, want cancelled and released", s)
+	}
+	if got := reservedShares(t, tx, userID); !got.IsZero() {
+		t.Errorf("holding still reserves %s", got)
+	}
+	if got := groupStatus(t, tx, groupID); got != "completed" {
+		t.Errorf("group %s, want completed", got)
+	}
+}
+
+// A fill the checks reject rolls back to before OnFill, as the worker does,
+// and the group keeps working with its hold.
+func TestRejectedFillLeavesGroup(t *testing.T) {
+	tx := dbtest.Tx(t)
+	userID, groupID, _, tp, sl := filledBracket(t, tx)
+
+	if _, err := tx.Exec(`SAVEPOINT group_fill`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OnFill(ctx, tx, tp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT group_fill`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`UPDATE orders SET status='rejected' WHERE id=$1`, tp); err != nil {
+		t.Fatal(err)
+	}
+	touched, err := OnReject(ctx, tx, tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := funds.ReleaseOrder(ctx, tx, tp); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(touched, []string{sl}) {
+		t.Errorf("touched %v, want the stop-loss", touched)
+	}
+	ten := decimal.FromInt(10)
+	if s := state(t, tx, sl); s.status != "pending" || s.reservedQty != ten {
+		t.Errorf("stop-loss %+v, want pending and holding 10", s)
+	}
+	if s := state(t, tx, tp); !s.reservedQty.IsZero() {
+		t.Errorf("rejected take-profit still holds %s", s.reservedQty)
+	}
+	if got := reservedShares(t, tx, userID); got != ten {
+		t.Errorf("holding reserves %s, want 10", got)
+	}
+	if got := groupStatus(t, tx, groupID); got != "active" {
+		t.Errorf("group %s, want active", got)
+	}
+}
+
+func TestUnfilledEntryEndsBracket(t *testing.T) {
+	tx := dbtest.Tx(t)
+	userID := dbtest.User(t, tx, "10000")
+	groupID, ids := placeGroup(t, tx, userID, "bracket",
+		leg{"entry", "buy", "limit", "100", "pending"},
+		leg{"take_profit", "sell", "limit", "110", "inactive"},
+		leg{"stop_loss", "sell", "stop", "90", "inactive"})
+	if _, err := tx.Exec(`UPDATE orders SET status='cancelled' WHERE id=$1`, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, err := OnEnd(ctx, tx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cancelled) != 2 {
+		t.Errorf("cancelled %v, want both exits", cancelled)
+	}
+	for _, id := range ids[1:] {
+		if s := state(t, tx, id); s.status != "cancelled" {
+			t.Errorf("exit %s is %s, want cancelled", id, s.status)
+		}
+	}
+	if got := groupStatus(t, tx, groupID); got != "cancelled" {
+		t.Errorf("group %s, want cancelled", got)
+	}
+}
+
+func TestOCOFillCancelsOtherLeg(t *testing.T) {
+	tx := dbtest.Tx(t)
+	userID := dbtest.User(t, tx, "10000")
+	dbtest.Holding(t, tx, userID, "AAPL", "10")
+	groupID, ids := placeGroup(t, tx, userID, "oco",
+		leg{"leg", "sell", "limit", "120", "pending"},
+		leg{"leg", "sell", "stop", "80", "pending"})
+	if err := funds.HoldForOrder(ctx, tx, ids[1], userID, "sell", "AAPL", decimal.FromInt(10), decimal.Zero); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, err := OnFill(ctx, tx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cancelled, []string{ids[1]}) {
+		t.Errorf("cancelled %v, want the other leg", cancelled)
+	}
+	if got := reservedShares(t, tx, userID); !got.IsZero() {
+		t.Errorf("holding still reserves %s", got)
+	}
+	if got := groupStatus(t, tx, groupID); got != "completed" {
+		t.Errorf("group %s, want completed", got)
+	}
+}
@@ -0,0 +1,347 @@
+// Package halts stops trading in a symbol, an asset class or everything.
+//
+// Admins place and lift halts; the volatility circuit breaker halts a symbol
+// on its own when feed ticks move more than a set percentage within a window,
+// and lifts the halt after a cooldown. Halts live in trading_halts so every
+// replica sees them; each Registry keeps an in-memory copy, reloaded every
+// few seconds, so checks on the order path never touch the database.
+package halts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sahniaditya/flux-backend/prices"
+)
+
+// Scopes a halt can cover.
+const (
+	ScopeGlobal     = "global"
+	ScopeAssetClass = "asset_class"
+	ScopeSymbol     = "symbol"
+)
+
+// Sources of a halt.
+const (
+	SourceAdmin          = "admin"
+	SourceCircuitBreaker = "circuit_breaker"
+)
+
+const reloadInterval = 5 * time.Second
+
+var ErrHalted = errors.New("trading halted")
+
+// Halt is one active halt. Target is the symbol or asset class, empty for a
+// global halt.
+type Halt struct {
+	ID        string     `json:"id"`
+	Scope     string     `json:"scope"`
+	Target    string     `json:"target,omitempty"`
+	Reason    string     `json:"reason"`
+	Source    string     `json:"source"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Automatic resume; nil halts until lifted
+}
+
+func (h Halt) active(now time.Time) bool {
+	return h.ExpiresAt == nil || now.Before(*h.ExpiresAt)
+}
+
+func (h Halt) describe() string {
+	switch h.Scope {
+	case ScopeGlobal:
+		return "all trading is halted: " + h.Reason
+	case ScopeAssetClass:
+		return h.Target + " trading is halted: " + h.Reason
+	}
+	return h.Target + " is halted: " + h.Reason
+}
+
+// Config sets up the circuit breaker. A zero BreakerPercent disables it.
+type Config struct {
+	BreakerPercent float64       // Largest move allowed within BreakerWindow, in percent
+	BreakerWindow  time.Duration // How far back ticks are compared
+	BreakerHalt    time.Duration // How long a tripped breaker halts the symbol
+	OnChange       func()        // Called after halts are placed, lifted or expire
+}
+
+type key struct{ scope, target string }
+
+type sample struct {
+	at    time.Time
+	price float64
+}
+
+// Registry answers whether a symbol may trade.
+type Registry struct {
+	db         *sql.DB
+	assetClass func(symbol string) string
+	cfg        Config
+
+	mu      sync.RWMutex
+	halts   map[key]Halt
+	history map[string][]sample // breaker ticks per symbol, oldest first
+}
+
+// New builds a registry. assetClass (normally prices.Feed.AssetClass) matches
+// symbols to asset-class halts.
+func New(db *sql.DB, assetClass func(symbol string) string, cfg Config) *Registry {
+	return &Registry{
+		db:         db,
+		assetClass: assetClass,
+		cfg:        cfg,
+		halts:      make(map[key]Halt),
+		history:    make(map[string][]sample),
+	}
+}
+
+// Start loads the active halts and keeps reloading them until ctx ends.
+func (r *Registry) Start(ctx context.Context) {
+	if err := r.reload(ctx); err != nil {
+		log.Println("Loading trading halts failed:", err)
+	}
+	go func() {
+		t := time.NewTicker(reloadInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := r.reload(ctx); err != nil {
+					log.Println("Reloading trading halts failed:", err)
+				}
+			}
+		}
+	}()
+}
+
+func (r *Registry) reload(ctx context.Context) error {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, scope, target, reason, source, created_at, expires_at FROM trading_halts
+		WHERE lifted_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	next := make(map[key]Halt)
+	for rows.Next() {
+		var h Halt
+		var expires sql.NullTime
+		if err := rows.Scan(&h.ID, &h.Scope, &h.Target, &h.Reason, &h.Source, &h.CreatedAt, &expires); err != nil {
+			return err
+		}
+		if expires.Valid {
+			h.ExpiresAt = &expires.Time
+		}
+		next[key{h.Scope, h.Target}] = h
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	changed := len(next) != len(r.halts)
+	for k, h := range next {
+		if prev, ok := r.halts[k]; !ok || prev.ID != h.ID {
+			changed = true
+		}
+	}
+	r.halts = next
+	r.mu.Unlock()
+	if changed {
+		r.changed()
+	}
+	return nil
+}
+
+func (r *Registry) changed() {
+	if r.cfg.OnChange != nil {
+		go r.cfg.OnChange()
+	}
+}
+
+// Lookup returns the halt that stops symbol from trading, most specific
+// first. A nil registry halts nothing.
+func (r *Registry) Lookup(symbol string) (Halt, bool) {
+	if r == nil {
+		return Halt{}, false
+	}
+	symbol = prices.NormalizeSymbol(symbol)
+	now := time.Now()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, k := range []key{{ScopeSymbol, symbol}, {ScopeAssetClass, r.assetClass(symbol)}, {ScopeGlobal, ""}} {
+		if h, ok := r.halts[k]; ok && h.active(now) {
+			return h, true
+		}
+	}
+	return Halt{}, false
+}
+
+// Check returns an ErrHalted error describing the halt when symbol can't trade.
+func (r *Registry) Check(symbol string) error {
+	if h, ok := r.Lookup(symbol); ok {
+		return fmt.Errorf("%w: %s", ErrHalted, h.describe())
+	}
+	return nil
+}
+
+// Status reports a symbol's halt for the price feed's snapshots.
+func (r *Registry) Status(symbol string) (reason string, halted bool) {
+	h, ok := r.Lookup(symbol)
+	return h.Reason, ok
+}
+
+// Active lists the halts in force.
+func (r *Registry) Active() []Halt {
+	if r == nil {
+		return []Halt{}
+	}
+	now := time.Now()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := []Halt{}
+	for _, h := range r.halts {
+		if h.active(now) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// Place halts the scope and target, replacing any halt already on it.
+// createdBy is the admin's user id, empty for the circuit breaker.
+func (r *Registry) Place(ctx context.Context, scope, target, reason, source, createdBy string, until *time.Time) (Halt, error) {
+	if scope == ScopeSymbol {
+		target = prices.NormalizeSymbol(target)
+	}
+	if scope == ScopeGlobal {
+		target = ""
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Halt{}, err
+	}
+	defer tx.Rollback()
+
+	// Expired halts still hold their slot in the unique index until lifted.
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE trading_halts SET lifted_at=expires_at
+		WHERE scope=$1 AND target=$2 AND lifted_at IS NULL AND expires_at <= NOW()`, scope, target); err != nil {
+		return Halt{}, err
+	}
+	h := Halt{Scope: scope, Target: target, Reason: reason, Source: source, ExpiresAt: until}
+	var by sql.NullString
+	if createdBy != "" {
+		by = sql.NullString{String: createdBy, Valid: true}
+	}
+	if err := tx.QueryRowContext(ctx, `
+		INSERT INTO trading_halts (scope, target, reason, source, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (scope, target) WHERE lifted_at IS NULL
+		DO UPDATE SET reason=EXCLUDED.reason, source=EXCLUDED.source, created_by=EXCLUDED.created_by,
+		              expires_at=EXCLUDED.expires_at, created_at=NOW()
+		RETURNING id, created_at`,
+		scope, target, reason, source, by, until).Scan(&h.ID, &h.CreatedAt); err != nil {
+		return Halt{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Halt{}, err
+	}
+
+	r.mu.Lock()
+	r.halts[key{scope, target}] = h
+	r.mu.Unlock()
+	r.changed()
+	log.Printf("⛔ Trading halted (%s %s): %s", scope, target, reason)
+	return h, nil
+}
+
+// Lift ends a halt. It reports false when no active halt has that id.
+func (r *Registry) Lift(ctx context.Context, id string) (bool, error) {
+	var scope, target string
+	err := r.db.QueryRowContext(ctx, `
+		UPDATE trading_halts SET lifted_at=NOW() WHERE id=$1 AND lifted_at IS NULL
+		RETURNING scope, target`, id).Scan(&scope, &target)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	delete(r.halts, key{scope, target})
+	r.mu.Unlock()
+	r.changed()
+	log.Printf("▶️ Trading resumed (%s %s)", scope, target)
+	return true, nil
+}
+
+// Observe feeds a tick to the circuit breaker. It must see every tick before
+// anything trades on it, so a runaway price halts the symbol first. It
+// reports false for a tick that tripped the breaker, which the feed drops.
+func (r *Registry) Observe(t prices.Ticker) bool {
+	if r == nil || r.cfg.BreakerPercent <= 0 || !t.Price.IsPositive() {
+		return true
+	}
+	symbol := prices.NormalizeSymbol(t.Symbol)
+	price := t.Price.Float64()
+	now := time.Now()
+
+	r.mu.Lock()
+	hist := r.history[symbol]
+	cutoff := now.Add(-r.cfg.BreakerWindow)
+	i := 0
+	for i < len(hist) && hist[i].at.Before(cutoff) {
+		i++
+	}
+	hist = append(hist[i:], sample{now, price})
+	low, high := price, price
+	for _, s := range hist {
+		if s.price < low {
+			low = s.price
+		}
+		if s.price > high {
+			high = s.price
+		}
+	}
+	move := (high/low - 1) * 100
+	tripped := move > r.cfg.BreakerPercent
+	if tripped {
+		// Start over so the halt's own prices don't trip it again on resume.
+		hist = nil
+	}
+	r.history[symbol] = hist
+	r.mu.Unlock()
+
+	if !tripped {
+		return true
+	}
+	if h, ok := r.Lookup(symbol); ok && h.Scope == ScopeSymbol {
+		return false
+	}
+	until := now.Add(r.cfg.BreakerHalt)
+	reason := fmt.Sprintf("circuit breaker: price moved %.1f%% within %s", move, r.cfg.BreakerWindow)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := r.Place(ctx, ScopeSymbol, symbol, reason, SourceCircuitBreaker, "", &until); err != nil {
+		// Halt this replica anyway; the next reload reconciles.
+		log.Printf("Persisting circuit breaker halt for %s failed: %v", symbol, err)
+		r.mu.Lock()
+		r.halts[key{ScopeSymbol, symbol}] = Halt{Scope: ScopeSymbol, Target: symbol, Reason: reason,
+			Source: SourceCircuitBreaker, CreatedAt: now, ExpiresAt: &until}
+		r.mu.Unlock()
+		r.changed()
+	}
+	return false
+}
+
+// IsHalted reports whether err came from a halt.
+func IsHalted(err error) bool {
+	return errors.Is(err, ErrHalted)
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/analytics"
+	"github.com/sahniaditya/flux-backend/lots"
+	"github.com/sahniaditya/flux-backend/models"
+	"github.com/sahniaditya/flux-backend/precision"
+	"github.com/sahniaditya/flux-backend/prices"
+	"github.com/sahniaditya/flux-backend/snapshots"
+)
+
+// periodsPerYear annualizes statistics by snapshot granularity. Snapshots
+// are taken every calendar day, weekends included.
+var periodsPerYear = map[string]float64{
+	snapshots.Daily:  365,
+	snapshots.Hourly: 365 * 24,
+}
+
+// GetPortfolioAnalytics returns risk and performance statistics over a range
+// of equity snapshots: volatility, Sharpe and Sortino ratios, max drawdown,
+// win rate and average win and loss per closed lot, and beta and correlation
+// against a benchmark. Query params: range (as for history; default 1Y),
+// granularity (1h or 1d; default 1d), benchmark (one of benchmarks, whose
+// prices the worker records; default the first) and risk_free_rate (annual,
+// as a fraction; default defaultRiskFree).
+func GetPortfolioAnalytics(db *sql.DB, defaultRiskFree float64, benchmarks []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		riskFree, benchmark := defaultRiskFree, benchmarks[0]
+		rng := strings.ToUpper(c.DefaultQuery("range", "1Y"))
+		from, ok := historyRange(rng, time.Now())
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "range must be 1D, 1W, 1M, 3M, 6M, 1Y, YTD or ALL"})
+			return
+		}
+		granularity := strings.ToLower(c.DefaultQuery("granularity", snapshots.Daily))
+		perYear, ok := periodsPerYear[granularity]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "granularity must be 1h or 1d"})
+			return
+		}
+		if raw := c.Query("risk_free_rate"); raw != "" {
+			rate, err := strconv.ParseFloat(raw, 64)
+			if err != nil || rate <= -1 || rate >= 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "risk_free_rate must be an annual rate such as 0.04"})
+				return
+			}
+			riskFree = rate
+		}
+		if raw := c.Query("benchmark"); raw != "" {
+			benchmark = prices.NormalizeSymbol(raw)
+			if !slices.Contains(benchmarks, benchmark) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "benchmark must be one of " + strings.Join(benchmarks, ", ")})
+				return
+			}
+		}
+
+		history, err := snapshots.History(c, db, userID, granularity, from)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "history lookup failed"})
+			return
+		}
+		var flows []snapshots.Flow
+		if len(history) > 0 {
+			if flows, err = snapshots.Flows(c, db, userID, history[0].TakenAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "cash flow lookup failed"})
+				return
+			}
+		}
+		bench, err := snapshots.Benchmark(c, db, benchmark, granularity, from)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "benchmark lookup failed"})
+			return
+		}
+		closed, err := lots.ClosedSince(c, db, userID, from)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "closed lot lookup failed"})
+			return
+		}
+
+		resp := models.PortfolioAnalytics{
+			Range: rng, Granularity: granularity, RiskFreeRate: riskFree,
+			Benchmark: benchmark, ClosedLots: closed.Count,
+		}
+		if periods := snapshots.PeriodReturns(history, flows); len(periods) > 0 {
+			returns := make([]float64, len(periods))
+			points := make([]analytics.Point, len(periods))
+			var paired, benchReturns []float64
+			for i, p := range periods {
+				returns[i] = p.Return
+				points[i] = analytics.Point{At: p.To.Period, Return: p.Return}
+				start, okStart := bench[p.From.Period.Unix()]
+				end, okEnd := bench[p.To.Period.Unix()]
+				if okStart && okEnd {
+					paired = append(paired, p.Return)
+					benchReturns = append(benchReturns, end.Div(start).Float64()-1)
+				}
+			}
+			resp.Periods = len(periods)
+			resp.TotalReturn = snapshots.TWR(history, flows)
+			resp.Volatility = analytics.Volatility(returns, perYear)
+			resp.SharpeRatio = analytics.Sharpe(returns, riskFree, perYear)
+			resp.SortinoRatio = analytics.Sortino(returns, riskFree, perYear)
+			if dd := analytics.MaxDrawdown(periods[0].From.Period, points); dd != nil {
+				resp.MaxDrawdown, resp.DrawdownPeak, resp.DrawdownTrough = &dd.Depth, &dd.Peak, &dd.Trough
+			}
+			resp.BenchmarkPeriods = len(paired)
+			resp.Beta = analytics.Beta(paired, benchReturns)
+			resp.Correlation = analytics.Correlation(paired, benchReturns)
+		}
+		if closed.Count > 0 {
+			rate := float64(closed.Wins) / float64(closed.Count)
+			resp.WinRate = &rate
+		}
+		if closed.Wins > 0 {
+			win := precision.Cash(closed.AverageWin)
+			resp.AverageWin = &win
+		}
+		if closed.Losses > 0 {
+			loss := precision.Cash(closed.AverageLoss)
+			resp.AverageLoss = &loss
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
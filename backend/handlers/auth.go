@@ -5,10 +5,15 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/ledger"
 	"github.com/sahniaditya/flux-backend/models" // Make sure this matches your go.mod module name
 	"golang.org/x/crypto/bcrypt"
 )
 
+// startingCash is the paper money every new account is funded with.
+var startingCash = decimal.FromInt(100000)
+
 // RegisterUser handles creating a new user + wallet atomically
 func RegisterUser(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -52,9 +57,12 @@ func RegisterUser(db *sql.DB) gin.HandlerFunc {
 
 		// 5. Create Wallet with $100k Paper Money
 		_, err = tx.Exec(`
-			INSERT INTO wallets (user_id, balance, currency) 
-			VALUES ($1, 100000.00, 'USD')`,
+			INSERT INTO wallets (user_id, currency) 
+			VALUES ($1, 'USD')`,
 			userID)
+		if err == nil {
+			err = ledger.Deposit(c, tx, userID, startingCash)
+		}
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create wallet"})
@@ -77,7 +85,7 @@ func RegisterUser(db *sql.DB) gin.HandlerFunc {
 		c.JSON(http.StatusCreated, gin.H{
 			"message": "User registered successfully",
 			"user_id": userID,
-			"balance": 100000.00,
+			"balance": startingCash,
 			"token":   token,
 		})
 	}
@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/calendar"
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/fees"
+	"github.com/sahniaditya/flux-backend/groups"
+	"github.com/sahniaditya/flux-backend/halts"
+	"github.com/sahniaditya/flux-backend/instruments"
+	"github.com/sahniaditya/flux-backend/margin"
+	"github.com/sahniaditya/flux-backend/models"
+)
+
+// groupLeg is one order of a group about to be placed.
+type groupLeg struct {
+	role   string
+	side   string
+	status string
+	models.OrderLeg
+}
+
+// PlaceOrderGroup places a bracket (an entry with take-profit and stop-loss
+// exits that start working once it fills) or an OCO pair (two orders where
+// the first to fill cancels the other). A bracket holds funds for its entry
+// and an OCO pair for whichever leg needs more; the exits hold when they
+// activate. Equity groups placed while the market is closed queue until it
+// opens; halted symbols take no new groups. Every order in the group must
+// meet the symbol's instrument rules.
+func PlaceOrderGroup(db *sql.DB, priceCheck PriceChecker, feeEngine *fees.Engine, rules *instruments.Registry, cal *calendar.Calendar, hr *halts.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req models.OrderGroupRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid input: " + err.Error()})
+			return
+		}
+		req.Symbol = strings.ToUpper(strings.TrimSpace(req.Symbol))
+		if !req.Quantity.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quantity must be positive"})
+			return
+		}
+		if !checkHalt(c, hr, req.Symbol) {
+			return
+		}
+
+		livePrice, err := priceCheck.GetPrice(req.Symbol)
+		if err != nil || !livePrice.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "symbol not found or price unavailable"})
+			return
+		}
+
+		var legs []groupLeg
+		if req.Type == "bracket" {
+			legs, err = bracketLegs(req, livePrice)
+		} else {
+			legs, err = ocoLegs(req)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !checkRules(c, rules.CheckQuantity(req.Symbol, req.Quantity)) {
+			return
+		}
+		for _, leg := range legs {
+			price := estimatePrice(leg.Type, leg.side, livePrice, leg.Price, leg.TrailAmount, leg.TrailPercent)
+			if !checkRules(c,
+				checkPrice(rules, req.Symbol, "price", leg.Price),
+				checkPrice(rules, req.Symbol, "stop_price", leg.StopPrice),
+				checkPrice(rules, req.Symbol, "trail_amount", leg.TrailAmount),
+				rules.CheckNotional(req.Symbol, req.Quantity, price)) {
+				return
+			}
+		}
+
+		if req.TimeInForce == "" {
+			req.TimeInForce = "gtc"
+		}
+		now := time.Now()
+		open := cal.IsOpen(req.Symbol, req.ExtendedHours, now)
+		expiresAt, ok := orderExpiry(c, cal, req.Symbol, req.TimeInForce, req.ExtendedHours, req.ExpiresAt)
+		if !ok {
+			return
+		}
+
+		tx, err := db.BeginTx(c, &sql.TxOptions{})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		defer tx.Rollback()
+
+		var groupID string
+		if err := tx.QueryRowContext(c,
+			`INSERT INTO order_groups (user_id, type) VALUES ($1, $2) RETURNING id`,
+			userID, req.Type).Scan(&groupID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to place order group"})
+			return
+		}
+
+		// The pair's hold goes on the working leg that could cost the most.
+		holder, holderPrice, holderID := -1, decimal.Zero, ""
+		for i, leg := range legs {
+			// Trailing legs start tracking from the price at placement.
+			var waterMark decimal.NullDecimal
+			if leg.Type == "trailing_stop" || leg.Type == "trailing_percent" {
+				waterMark = decimal.NewNull(livePrice)
+			}
+			var orderID string
+			if err := tx.QueryRowContext(c, `
+				INSERT INTO orders (user_id, symbol, side, type, quantity, price, stop_price, trail_amount, trail_percent, water_mark,
+				                    time_in_force, expires_at, extended_hours, status, group_id, group_role)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+				RETURNING id`,
+				userID, req.Symbol, leg.side, leg.Type, req.Quantity, decimal.NullFrom(leg.Price),
+				decimal.NullFrom(leg.StopPrice), decimal.NullFrom(leg.TrailAmount), decimal.NullFrom(leg.TrailPercent), waterMark,
+				req.TimeInForce, expiresAt, req.ExtendedHours, leg.status, groupID, leg.role).Scan(&orderID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to place order group"})
+				return
+			}
+			if leg.status != "pending" {
+				continue
+			}
+			price := estimatePrice(leg.Type, leg.side, livePrice, leg.Price, leg.TrailAmount, leg.TrailPercent)
+			if holder < 0 || (leg.side == "buy" && price.GreaterThan(holderPrice)) {
+				holder, holderPrice, holderID = i, price, orderID
+			}
+		}
+
+		estimatedFee := feeEngine.Fee(req.Symbol, req.Quantity, holderPrice, false)
+		if !holdFunds(c, tx, priceCheck, holderID, userID, legs[holder].side, req.Symbol, req.Quantity, holderPrice, estimatedFee) {
+			return
+		}
+
+		group, err := loadOrderGroup(c, tx, groupID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "order group lookup failed"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "commit failed"})
+			return
+		}
+		if !open {
+			queuedUntil := cal.NextOpen(req.Symbol, req.ExtendedHours, now)
+			group.QueuedUntil = &queuedUntil
+		}
+		c.JSON(http.StatusCreated, group)
+	}
+}
+
+// bracketLegs builds a bracket's entry and exits and checks the exits sit on
+// either side of where the entry should fill.
+func bracketLegs(req models.OrderGroupRequest, livePrice decimal.Decimal) ([]groupLeg, error) {
+	if len(req.Legs) > 0 {
+		return nil, fmt.Errorf("legs are for oco groups; brackets take entry, take_profit and stop_loss")
+	}
+	entry := models.OrderLeg{Type: "market"}
+	if req.Entry != nil {
+		entry = *req.Entry
+	}
+	if msg := validateOrderTerms(entry.Type, entry.Price, entry.StopPrice, entry.TrailAmount, entry.TrailPercent); msg != "" {
+		return nil, fmt.Errorf("entry: %s", msg)
+	}
+	if !positive(req.TakeProfit) || !positive(req.StopLoss) {
+		return nil, fmt.Errorf("take_profit and stop_loss required for bracket orders")
+	}
+	if req.StopLossLimit != nil && !positive(req.StopLossLimit) {
+		return nil, fmt.Errorf("stop_loss_limit must be positive")
+	}
+
+	// Where the entry is expected to fill: its limit or stop, else the market.
+	reference := livePrice
+	if entry.Type == "limit" || entry.Type == "stop" || entry.Type == "stop_limit" {
+		reference = *entry.Price
+	}
+	tp, sl := *req.TakeProfit, *req.StopLoss
+	exitSide := "sell"
+	if req.Side == "buy" && !(sl.LessThan(reference) && reference.LessThan(tp)) {
+		return nil, fmt.Errorf("a long bracket needs stop_loss < %s < take_profit", reference)
+	}
+	if req.Side == "sell" {
+		exitSide = "buy"
+		if !(tp.LessThan(reference) && reference.LessThan(sl)) {
+			return nil, fmt.Errorf("a short bracket needs take_profit < %s < stop_loss", reference)
+		}
+	}
+
+	stopLoss := models.OrderLeg{Type: "stop", Price: req.StopLoss}
+	if req.StopLossLimit != nil {
+		stopLoss = models.OrderLeg{Type: "stop_limit", Price: req.StopLossLimit, StopPrice: req.StopLoss}
+	}
+	return []groupLeg{
+		{role: "entry", side: req.Side, status: "pending", OrderLeg: entry},
+		{role: "take_profit", side: exitSide, status: "inactive", OrderLeg: models.OrderLeg{Type: "limit", Price: req.TakeProfit}},
+		{role: "stop_loss", side: exitSide, status: "inactive", OrderLeg: stopLoss},
+	}, nil
+}
+
+// ocoLegs builds the two legs of an OCO pair.
+func ocoLegs(req models.OrderGroupRequest) ([]groupLeg, error) {
+	if req.Entry != nil || req.TakeProfit != nil || req.StopLoss != nil || req.StopLossLimit != nil {
+		return nil, fmt.Errorf("entry, take_profit and stop_loss are for bracket groups; oco takes legs")
+	}
+	if len(req.Legs) != 2 {
+		return nil, fmt.Errorf("oco groups need exactly two legs")
+	}
+	legs := make([]groupLeg, 0, 2)
+	for i, leg := range req.Legs {
+		if leg.Type == "market" {
+			return nil, fmt.Errorf("legs[%d]: a market leg would always fill first", i)
+		}
+		if msg := validateOrderTerms(leg.Type, leg.Price, leg.StopPrice, leg.TrailAmount, leg.TrailPercent); msg != "" {
+			return nil, fmt.Errorf("legs[%d]: %s", i, msg)
+		}
+		legs = append(legs, groupLeg{role: "leg", side: req.Side, status: "pending", OrderLeg: leg})
+	}
+	return legs, nil
+}
+
+// loadOrderGroup returns the user's group with its orders, entry first.
+func loadOrderGroup(c *gin.Context, q margin.Querier, groupID, userID string) (models.OrderGroup, error) {
+	var g models.OrderGroup
+	if err := q.QueryRowContext(c,
+		`SELECT id, type, status, created_at FROM order_groups WHERE id=$1 AND user_id=$2`,
+		groupID, userID).Scan(&g.ID, &g.Type, &g.Status, &g.CreatedAt); err != nil {
+		return g, err
+	}
+	rows, err := q.QueryContext(c, `SELECT `+orderColumns+` FROM orders WHERE group_id=$1
+		ORDER BY CASE group_role WHEN 'entry' THEN 0 WHEN 'take_profit' THEN 1 WHEN 'stop_loss' THEN 2 ELSE 3 END, created_at, id`,
+		groupID)
+	if err != nil {
+		return g, err
+	}
+	defer rows.Close()
+	g.Orders = []models.Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return g, err
+		}
+		g.Orders = append(g.Orders, o)
+	}
+	return g, rows.Err()
+}
+
+// GetOrderGroup returns a bracket or OCO group owned by the user.
+func GetOrderGroup(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !uuidPattern.MatchString(c.Param("id")) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "order group not found"})
+			return
+		}
+		g, err := loadOrderGroup(c, db, c.Param("id"), c.GetString("user_id"))
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "order group not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "order group lookup failed"})
+			return
+		}
+		c.JSON(http.StatusOK, g)
+	}
+}
+
+// CancelOrderGroup cancels every order of an active group that hasn't
+// finished, releasing their holds. Fills already made stand.
+func CancelOrderGroup(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		groupID := c.Param("id")
+		if !uuidPattern.MatchString(groupID) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "order group not found"})
+			return
+		}
+
+		tx, err := db.BeginTx(c, &sql.TxOptions{})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		defer tx.Rollback()
+
+		// Orders before the group, the same order the worker takes them in.
+		if _, err := tx.ExecContext(c,
+			`SELECT 1 FROM orders WHERE group_id=$1 AND user_id=$2 ORDER BY id FOR UPDATE`, groupID, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "order lookup failed"})
+			return
+		}
+		var status string
+		err = tx.QueryRowContext(c,
+			`SELECT status FROM order_groups WHERE id=$1 AND user_id=$2 FOR UPDATE`, groupID, userID).Scan(&status)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "order group not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "order group lookup failed"})
+			return
+		}
+		if status != "active" {
+			c.JSON(http.StatusConflict, gin.H{"error": "order group is " + status})
+			return
+		}
+
+		if _, err := groups.Cancel(c, tx, groupID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "cancel failed"})
+			return
+		}
+		g, err := loadOrderGroup(c, tx, groupID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "order group lookup failed"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "commit failed"})
+			return
+		}
+		c.JSON(http.StatusOK, g)
+	}
+}
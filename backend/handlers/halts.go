@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/halts"
+	"github.com/sahniaditya/flux-backend/models"
+	"github.com/sahniaditya/flux-backend/prices"
+)
+
+// checkHalt refuses to trade a halted symbol.
+// On failure it writes the error response and returns false.
+func checkHalt(c *gin.Context, hr *halts.Registry, symbol string) bool {
+	if err := hr.Check(symbol); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// ListHalts returns the trading halts in force.
+func ListHalts(hr *halts.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, hr.Active())
+	}
+}
+
+// PlaceHalt halts a symbol, an asset class or all trading. Admin only.
+func PlaceHalt(hr *halts.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.HaltRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid input: " + err.Error()})
+			return
+		}
+		req.Target = strings.TrimSpace(req.Target)
+		switch req.Scope {
+		case halts.ScopeSymbol:
+			req.Target = strings.ToUpper(req.Target)
+			if req.Target == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "target symbol required"})
+				return
+			}
+		case halts.ScopeAssetClass:
+			req.Target = strings.ToLower(req.Target)
+			if req.Target != prices.AssetCrypto && req.Target != prices.AssetEquity {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "target must be crypto or equity"})
+				return
+			}
+		}
+		if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+			return
+		}
+
+		h, err := hr.Place(c, req.Scope, req.Target, req.Reason, halts.SourceAdmin, c.GetString("user_id"), req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "placing halt failed"})
+			return
+		}
+		c.JSON(http.StatusCreated, h)
+	}
+}
+
+// LiftHalt ends a halt, including one the circuit breaker placed. Admin only.
+func LiftHalt(hr *halts.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !uuidPattern.MatchString(c.Param("id")) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "halt not found"})
+			return
+		}
+		ok, err := hr.Lift(c, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "lifting halt failed"})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "halt not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "trading resumed"})
+	}
+}
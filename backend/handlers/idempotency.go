@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyTTL is how long a stored response can be replayed. After that the
+// key is free to be used for a new request.
+const idempotencyTTL = 24 * time.Hour
+
+// idempotencyLease is how long a request holds its key before finishing. A
+// key still in progress after that belonged to a server that crashed or was
+// restarted mid-request, and a retry with the same body takes it over.
+const idempotencyLease = time.Minute
+
+// capturingWriter tees the response body so it can be stored for replay.
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency makes mutating endpoints safe to retry. A request carrying an
+// Idempotency-Key header is run once per user and key; retries with the same
+// body get the stored response back, and retries with a different body get 409,
+// as do retries while the first request is running, for up to idempotencyLease.
+// Must run after AuthMiddleware.
+func Idempotency(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimSpace(c.GetHeader("Idempotency-Key"))
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key too long"})
+			return
+		}
+		userID := c.GetString("user_id")
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unreadable body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256([]byte(c.Request.Method + " " + c.Request.URL.RequestURI() + "\n" + string(body)))
+		hash := hex.EncodeToString(sum[:])
+
+		// Claim the key. A row left behind by an expired request, or by the
+		// same request abandoned mid-flight, is taken over. The claim's time
+		// marks it as ours, so a request that outlived its lease can't record
+		// over the retry that took the key.
+		now := time.Now()
+		var claimed time.Time
+		err = db.QueryRowContext(c, `
+			INSERT INTO idempotency_keys (user_id, key, request_hash)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, key) DO UPDATE
+			SET request_hash=EXCLUDED.request_hash, status_code=NULL, response_body=NULL, created_at=NOW()
+			WHERE idempotency_keys.created_at < $4
+				OR (idempotency_keys.status_code IS NULL AND idempotency_keys.request_hash = EXCLUDED.request_hash
+					AND idempotency_keys.created_at < $5)
+			RETURNING created_at`,
+			userID, key, hash, now.Add(-idempotencyTTL), now.Add(-idempotencyLease)).Scan(&claimed)
+		if err != nil && err != sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "idempotency check failed"})
+			return
+		}
+
+		if err == sql.ErrNoRows {
+			// Someone already used this key: replay, or explain why we can't.
+			var storedHash string
+			var status sql.NullInt64
+			var stored []byte
+			if err := db.QueryRowContext(c,
+				`SELECT request_hash, status_code, response_body FROM idempotency_keys WHERE user_id=$1 AND key=$2`,
+				userID, key).Scan(&storedHash, &status, &stored); err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "idempotency check failed"})
+				return
+			}
+			if storedHash != hash {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Idempotency-Key was already used with a different request"})
+				return
+			}
+			if !status.Valid {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is still in progress"})
+				return
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(int(status.Int64), "application/json; charset=utf-8", stored)
+			c.Abort()
+			return
+		}
+
+		w := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		// Record the outcome even if the client has gone away; that's exactly
+		// when it will retry. Server errors aren't a final answer, so free the key.
+		ctx := context.Background()
+		if w.Status() >= http.StatusInternalServerError {
+			_, _ = db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE user_id=$1 AND key=$2 AND created_at=$3`,
+				userID, key, claimed)
+			return
+		}
+		_, _ = db.ExecContext(ctx,
+			`UPDATE idempotency_keys SET status_code=$1, response_body=$2 WHERE user_id=$3 AND key=$4 AND created_at=$5`,
+			w.Status(), w.body.Bytes(), userID, key, claimed)
+	}
+}
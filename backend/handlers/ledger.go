@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/ledger"
+)
+
+// CheckLedger recomputes every wallet, holding and margin loan from the
+// journal and reports the ones that disagree. Admin only.
+func CheckLedger(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report, err := ledger.Check(c, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ledger check failed"})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/lots"
+	"github.com/sahniaditya/flux-backend/models"
+)
+
+// checkLotIDs refuses lot selections that can't name a lot.
+// On failure it writes the error response and returns false.
+func checkLotIDs(c *gin.Context, ids []string) bool {
+	seen := make(map[string]bool, len(ids))
+	for i, id := range ids {
+		if !uuidPattern.MatchString(id) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "lot_ids must be lot ids"})
+			return false
+		}
+		ids[i] = strings.ToLower(id)
+		if seen[ids[i]] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "lot " + id + " is listed twice"})
+			return false
+		}
+		seen[ids[i]] = true
+	}
+	return true
+}
+
+// ListLots returns the user's open tax lots, oldest first, optionally for one symbol.
+func ListLots(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		method, err := lots.Method(c, db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "lot method lookup failed"})
+			return
+		}
+		symbol := strings.ToUpper(strings.TrimSpace(c.Query("symbol")))
+		rows, err := db.QueryContext(c, `
+			SELECT id, symbol, side, quantity, remaining, cost, opened_at FROM tax_lots
+			WHERE user_id=$1 AND remaining > 0 AND ($2 = '' OR symbol = $2)
+			ORDER BY symbol, opened_at, id`, userID, symbol)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "lot lookup failed"})
+			return
+		}
+		defer rows.Close()
+
+		resp := models.TaxLotsResponse{LotMethod: method, Lots: []models.TaxLot{}}
+		for rows.Next() {
+			var l models.TaxLot
+			if err := rows.Scan(&l.ID, &l.Symbol, &l.Side, &l.Quantity, &l.Remaining, &l.Cost, &l.OpenedAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "lot scan failed"})
+				return
+			}
+			l.UnitCost = l.Cost.Div(l.Remaining)
+			resp.Lots = append(resp.Lots, l)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "lot lookup failed"})
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// SetLotMethod picks the order in which the user's trades close tax lots.
+func SetLotMethod(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.LotMethodRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "method must be fifo, lifo or hifo"})
+			return
+		}
+		if _, err := db.ExecContext(c, `UPDATE users SET lot_method=$1 WHERE id=$2`, req.Method, c.GetString("user_id")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "lot method update failed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"lot_method": req.Method})
+	}
+}
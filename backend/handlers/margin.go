@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/margin"
+	"github.com/sahniaditya/flux-backend/models"
+	"github.com/sahniaditya/flux-backend/positions"
+)
+
+// checkMargin runs the margin check for a trade in a margin account.
+// On failure it writes the error response and returns false.
+func checkMargin(c *gin.Context, tx *sql.Tx, priceCheck PriceChecker, acct *margin.Account, t positions.Trade) bool {
+	err := acct.CheckTrade(c, tx, t.Side, t.Symbol, t.Quantity, t.Price, t.Fee, priceCheck.GetPrice)
+	switch {
+	case err == nil:
+		return true
+	case margin.IsUserError(err):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, margin.ErrPriceUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "margin check failed"})
+	}
+	return false
+}
+
+// marginStatus marks the user's account to market against its requirements.
+func marginStatus(c *gin.Context, q margin.Querier, priceCheck PriceChecker, userID string) (models.MarginStatus, error) {
+	acct, err := margin.Load(c, q, userID)
+	if err != nil {
+		return models.MarginStatus{}, err
+	}
+	s, err := margin.Evaluate(c, q, userID, priceCheck.GetPrice)
+	if err != nil {
+		return models.MarginStatus{}, err
+	}
+	out := models.MarginStatus{
+		Mode:       "cash",
+		Cash:       s.Cash,
+		Loan:       s.Loan,
+		LongValue:  s.LongValue,
+		ShortValue: s.ShortValue,
+		Equity:     s.Equity(),
+	}
+	if acct != nil {
+		out.Mode = "margin"
+		out.InitialMargin = acct.Initial
+		out.MaintenanceMargin = acct.Maintenance
+		out.MaxLeverage = acct.MaxLeverage
+		out.InitialRequirement = acct.Initial.Mul(s.Gross())
+		out.MaintenanceRequirement = acct.Maintenance.Mul(s.Gross())
+		out.MarginCallAt = acct.MarginCallAt
+		out.BuyingPower = acct.BuyingPower(s)
+		out.MarginUtilization = acct.Utilization(s)
+	}
+	out.ExcessEquity = out.Equity.Sub(out.MaintenanceRequirement)
+	return out, nil
+}
+
+// GetMargin reports the account's mode, equity and margin requirements.
+func GetMargin(db *sql.DB, priceCheck PriceChecker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, err := marginStatus(c, db, priceCheck, c.GetString("user_id"))
+		if errors.Is(err, margin.ErrPriceUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "margin lookup failed"})
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+// SetMargin switches the account between cash and margin and sets its
+// initial margin, maintenance margin and leverage. Going back to cash needs
+// every short closed and the loan repaid.
+func SetMargin(db *sql.DB, priceCheck PriceChecker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req models.MarginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		tx, err := db.BeginTx(c, &sql.TxOptions{})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		defer tx.Rollback()
+
+		acct, err := margin.Lock(c, tx, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "margin lookup failed"})
+			return
+		}
+
+		if req.Mode == "cash" {
+			if acct != nil {
+				var shorts int
+				if err := tx.QueryRowContext(c,
+					`SELECT COUNT(*) FROM holdings WHERE user_id=$1 AND quantity < 0`, userID).Scan(&shorts); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "holdings lookup failed"})
+					return
+				}
+				if shorts > 0 {
+					c.JSON(http.StatusConflict, gin.H{"error": "close short positions before switching to a cash account"})
+					return
+				}
+				if acct.Loan.IsPositive() {
+					c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("repay the $%.2f margin loan before switching to a cash account", acct.Loan)})
+					return
+				}
+				if _, err := tx.ExecContext(c, `DELETE FROM margin_accounts WHERE user_id=$1`, userID); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "margin update failed"})
+					return
+				}
+			}
+		} else {
+			initial, maintenance, leverage := margin.DefaultInitial, margin.DefaultMaintenance, margin.DefaultLeverage
+			if acct != nil {
+				initial, maintenance, leverage = acct.Initial, acct.Maintenance, acct.MaxLeverage
+			}
+			if req.InitialMargin != nil {
+				initial = *req.InitialMargin
+			}
+			if req.MaintenanceMargin != nil {
+				maintenance = *req.MaintenanceMargin
+			}
+			if req.MaxLeverage != nil {
+				leverage = *req.MaxLeverage
+			}
+			one := decimal.FromInt(1)
+			if !initial.IsPositive() || initial.GreaterThan(one) || !maintenance.IsPositive() || maintenance.GreaterThan(initial) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "need 0 < maintenance_margin <= initial_margin <= 1"})
+				return
+			}
+			if leverage.LessThan(one) || leverage.GreaterThan(decimal.FromInt(100)) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "max_leverage must be between 1 and 100"})
+				return
+			}
+			if _, err := tx.ExecContext(c, `
+				INSERT INTO margin_accounts (user_id, initial_margin, maintenance_margin, max_leverage) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (user_id) DO UPDATE SET initial_margin=$2, maintenance_margin=$3, max_leverage=$4`,
+				userID, initial, maintenance, leverage); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "margin update failed"})
+				return
+			}
+		}
+
+		status, err := marginStatus(c, tx, priceCheck, userID)
+		if errors.Is(err, margin.ErrPriceUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "margin lookup failed"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "commit failed"})
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	}
+}
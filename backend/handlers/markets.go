@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/calendar"
+	"github.com/sahniaditya/flux-backend/models"
+)
+
+// MarketHours reports which markets are open now. With ?symbol= it reports
+// the market that symbol trades on.
+func MarketHours(cal *calendar.Calendar) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		now := time.Now()
+		if symbol := strings.ToUpper(strings.TrimSpace(c.Query("symbol"))); symbol != "" {
+			m := cal.Market(symbol)
+			if m == nil {
+				c.JSON(http.StatusOK, models.MarketHours{
+					Symbol: symbol, Market: "crypto", Timezone: "UTC", Session: calendar.SessionRegular, IsOpen: true,
+				})
+				return
+			}
+			h := marketHours(m, now)
+			h.Symbol = symbol
+			c.JSON(http.StatusOK, h)
+			return
+		}
+
+		out := []models.MarketHours{}
+		for _, m := range cal.Markets() {
+			out = append(out, marketHours(m, now))
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func marketHours(m *calendar.Market, now time.Time) models.MarketHours {
+	h := models.MarketHours{
+		Market:   m.Name,
+		Aliases:  m.Aliases,
+		Timezone: m.Location.String(),
+		Session:  m.Session(now),
+		IsOpen:   m.IsOpen(now, false),
+	}
+	h.Holiday, _ = m.Holiday(now)
+	if !h.IsOpen {
+		next := m.NextOpen(now, false)
+		h.NextOpen = &next
+	}
+	next := m.NextClose(now, false)
+	h.NextClose = &next
+	return h
+}
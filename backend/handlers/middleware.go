@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"database/sql"
 	"net/http"
 	"os"
 	"strings"
@@ -61,3 +62,20 @@ func GenerateToken(userID string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(secret))
 }
+
+// AdminOnly lets through users flagged is_admin. Must run after AuthMiddleware.
+func AdminOnly(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var isAdmin bool
+		err := db.QueryRowContext(c, `SELECT is_admin FROM users WHERE id=$1`, c.GetString("user_id")).Scan(&isAdmin)
+		if err != nil && err != sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "user lookup failed"})
+			return
+		}
+		if !isAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin only"})
+			return
+		}
+		c.Next()
+	}
+}
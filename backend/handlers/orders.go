@@ -2,22 +2,41 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/calendar"
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/fees"
+	"github.com/sahniaditya/flux-backend/funds"
+	"github.com/sahniaditya/flux-backend/groups"
+	"github.com/sahniaditya/flux-backend/halts"
+	"github.com/sahniaditya/flux-backend/instruments"
+	"github.com/sahniaditya/flux-backend/margin"
 	"github.com/sahniaditya/flux-backend/models"
+	"github.com/sahniaditya/flux-backend/positions"
+	"github.com/sahniaditya/flux-backend/prices"
 )
 
 // PriceChecker defines the interface for fetching asset prices and checking support.
 type PriceChecker interface {
-	GetPrice(symbol string) (float64, error)
+	GetPrice(symbol string) (decimal.Decimal, error)
+	GetQuote(symbol string) (prices.Ticker, error)
 	IsSupported(symbol string) bool
+	AssetClass(symbol string) string
 }
 
-// PlaceOrder handles Market, Limit, and Stop orders with full validation.
-func PlaceOrder(db *sql.DB, priceCheck PriceChecker) gin.HandlerFunc {
+// PlaceOrder handles Market, Limit, Stop, Stop-Limit and Trailing orders with full validation.
+// Equity orders placed while their market is closed queue until it opens;
+// halted symbols take no new orders. Orders that break the symbol's
+// instrument rules (tick, lot, minimums) are refused with the rule's code.
+func PlaceOrder(db *sql.DB, priceCheck PriceChecker, feeEngine *fees.Engine, rules *instruments.Registry, cal *calendar.Calendar, hr *halts.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetString("user_id")
 		var req models.PlaceOrderRequest
@@ -26,22 +45,56 @@ func PlaceOrder(db *sql.DB, priceCheck PriceChecker) gin.HandlerFunc {
 			return
 		}
 		req.Symbol = strings.ToUpper(strings.TrimSpace(req.Symbol))
+		if !req.Quantity.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quantity must be positive"})
+			return
+		}
+		if !checkHalt(c, hr, req.Symbol) {
+			return
+		}
 
 		// 1. Validate Symbol & Get Live Price
 		// We fetch price for ALL orders to ensure symbol exists (strict validation).
 		// This prevents "APPLE" limit orders.
 		livePrice, err := priceCheck.GetPrice(req.Symbol)
-		if err != nil || livePrice <= 0 {
+		if err != nil || !livePrice.IsPositive() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "symbol not found or price unavailable"})
 			return
 		}
 
-		// Basic Validation for Limit/Stop
-		if req.Type == "limit" || req.Type == "stop" {
-			if req.Price == nil || *req.Price <= 0 {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "price required for limit/stop orders"})
-				return
-			}
+		// Basic Validation per order type
+		if msg := validateOrderTerms(req.Type, req.Price, req.StopPrice, req.TrailAmount, req.TrailPercent); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		// Orders are sized against the worst price they are expected to fill at.
+		estimatedPrice := estimatePrice(req.Type, req.Side, livePrice, req.Price, req.TrailAmount, req.TrailPercent)
+		if !checkRules(c, rules.CheckQuantity(req.Symbol, req.Quantity),
+			checkPrice(rules, req.Symbol, "price", req.Price),
+			checkPrice(rules, req.Symbol, "stop_price", req.StopPrice),
+			checkPrice(rules, req.Symbol, "trail_amount", req.TrailAmount),
+			rules.CheckNotional(req.Symbol, req.Quantity, estimatedPrice)) {
+			return
+		}
+
+		// Time in force
+		if req.TimeInForce == "" {
+			req.TimeInForce = "gtc"
+		}
+		if (req.TimeInForce == "ioc" || req.TimeInForce == "fok") && req.Type != "market" && req.Type != "limit" {
+			// Immediate-or-cancel only makes sense for orders that can be marketable right now.
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ioc and fok are only supported for market and limit orders"})
+			return
+		}
+		now := time.Now()
+		open := cal.IsOpen(req.Symbol, req.ExtendedHours, now)
+		if !open && (req.TimeInForce == "ioc" || req.TimeInForce == "fok") {
+			c.JSON(http.StatusConflict, gin.H{"error": "market is closed", "next_open": cal.NextOpen(req.Symbol, req.ExtendedHours, now)})
+			return
+		}
+		expiresAt, ok := orderExpiry(c, cal, req.Symbol, req.TimeInForce, req.ExtendedHours, req.ExpiresAt)
+		if !ok {
+			return
 		}
 
 		tx, err := db.BeginTx(c, &sql.TxOptions{})
@@ -51,65 +104,404 @@ func PlaceOrder(db *sql.DB, priceCheck PriceChecker) gin.HandlerFunc {
 		}
 		defer tx.Rollback()
 
-		// 2. Setup Cost Basis
-		estimatedPrice := livePrice
-		if req.Price != nil && *req.Price > 0 {
-			// For Limit/Stop, we validate against the limit price cost,
-			// BUT we also already validated the symbol exists via livePrice above.
-			estimatedPrice = *req.Price
+		// Insert Order into DB
+		var orderID string
+		status := "pending"
+		priceVal := decimal.NullFrom(req.Price)
+
+		// Trailing orders start tracking from the price at placement.
+		var waterMark decimal.NullDecimal
+		if req.Type == "trailing_stop" || req.Type == "trailing_percent" {
+			waterMark = decimal.NewNull(livePrice)
 		}
 
-		totalCost := req.Quantity * estimatedPrice
+		err = tx.QueryRowContext(c, `
+			INSERT INTO orders (user_id, symbol, side, type, quantity, price, stop_price, trail_amount, trail_percent, water_mark,
+			                    time_in_force, expires_at, extended_hours, status)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+			RETURNING id`,
+			userID, req.Symbol, req.Side, req.Type, req.Quantity, priceVal,
+			decimal.NullFrom(req.StopPrice), decimal.NullFrom(req.TrailAmount), decimal.NullFrom(req.TrailPercent), waterMark,
+			req.TimeInForce, expiresAt, req.ExtendedHours, status).Scan(&orderID)
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to place order"})
+			return
+		}
 
-		if req.Side == "buy" {
-			// Check wallet balance
-			var balance float64
-			if err := tx.QueryRowContext(c,
-				`SELECT balance FROM wallets WHERE user_id=$1 AND currency='USD' FOR UPDATE`,
-				userID).Scan(&balance); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "wallet not found"})
+		// 2. Hold the cash or shares the order needs at its estimated fill price.
+		// Buys also hold the worst-case (taker) commission.
+		estimatedFee := feeEngine.Fee(req.Symbol, req.Quantity, estimatedPrice, false)
+		if !holdFunds(c, tx, priceCheck, orderID, userID, req.Side, req.Symbol, req.Quantity, estimatedPrice, estimatedFee) {
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "commit failed"})
+			return
+		}
+
+		resp := gin.H{"message": "order placed", "order_id": orderID, "status": status}
+		if !open {
+			resp["queued_until"] = cal.NextOpen(req.Symbol, req.ExtendedHours, now)
+		}
+		c.JSON(http.StatusCreated, resp)
+	}
+}
+
+// validateOrderTerms checks that an order carries the prices its type needs.
+// It returns the error message, or "" when the order is well formed.
+func validateOrderTerms(orderType string, price, stopPrice, trailAmount, trailPercent *decimal.Decimal) string {
+	switch orderType {
+	case "limit", "stop":
+		if !positive(price) {
+			return "price required for limit/stop orders"
+		}
+	case "stop_limit":
+		if !positive(price) || !positive(stopPrice) {
+			return "price and stop_price required for stop_limit orders"
+		}
+	case "trailing_stop":
+		if !positive(trailAmount) {
+			return "trail_amount required for trailing_stop orders"
+		}
+	case "trailing_percent":
+		if !positive(trailPercent) || !trailPercent.LessThan(hundred) {
+			return "trail_percent must be between 0 and 100"
+		}
+	}
+	return ""
+}
+
+// orderExpiry works out when an order with the given time in force expires.
+// On failure it writes the error response and returns false.
+func orderExpiry(c *gin.Context, cal *calendar.Calendar, symbol, timeInForce string, extended bool, requested *time.Time) (sql.NullTime, bool) {
+	switch timeInForce {
+	case "day":
+		return sql.NullTime{Time: dayOrderExpiry(cal, symbol, extended, time.Now()), Valid: true}, true
+	case "gtd":
+		if requested == nil || !requested.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at in the future required for gtd orders"})
+			return sql.NullTime{}, false
+		}
+		return sql.NullTime{Time: requested.UTC(), Valid: true}, true
+	}
+	return sql.NullTime{}, true
+}
+
+// dayOrderExpiry is the session close a DAY order lives until: the end of the
+// equity market's current or next session (extended, if the order is), and
+// the next UTC midnight for 24/7 crypto.
+func dayOrderExpiry(cal *calendar.Calendar, symbol string, extended bool, now time.Time) time.Time {
+	if m := cal.Market(symbol); m != nil {
+		return m.NextClose(now, extended)
+	}
+	utc := now.UTC()
+	return time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// estimatePrice is the worst price an order is expected to fill at, used to
+// check funds before it is accepted.
+func estimatePrice(orderType, side string, livePrice decimal.Decimal, price, trailAmount, trailPercent *decimal.Decimal) decimal.Decimal {
+	switch orderType {
+	case "limit", "stop", "stop_limit":
+		// For Limit/Stop, we validate against the limit price cost,
+		// BUT we also already validated the symbol exists via livePrice above.
+		return *price
+	case "trailing_stop":
+		// A trailing buy can't fire above the current stop level.
+		if side == "buy" {
+			return livePrice.Add(*trailAmount)
+		}
+	case "trailing_percent":
+		if side == "buy" {
+			return livePrice.Add(livePrice.Mul(*trailPercent).Div(hundred))
+		}
+	}
+	return livePrice
+}
+
+// holdFunds reserves buying power for an order, or the shares it sells.
+// Margin accounts may buy on the loan or sell short, holding only the cash
+// or long shares they have, and every order they place must pass the margin
+// check at its estimated price. On failure it writes the error response and
+// returns false.
+func holdFunds(c *gin.Context, tx *sql.Tx, priceCheck PriceChecker, orderID, userID, side, symbol string, quantity, price, fee decimal.Decimal) bool {
+	acct, err := margin.Load(c, tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "margin lookup failed"})
+		return false
+	}
+	if acct != nil {
+		err = funds.HoldForMarginOrder(c, tx, orderID, userID, side, symbol, quantity, quantity.Mul(price).Add(fee))
+	} else {
+		err = funds.HoldForOrder(c, tx, orderID, userID, side, symbol, quantity, quantity.Mul(price).Add(fee))
+	}
+	if err == nil && acct != nil {
+		return checkMargin(c, tx, priceCheck, acct, positions.Trade{
+			UserID: userID, Symbol: symbol, Side: side, Quantity: quantity, Price: price, Fee: fee,
+		})
+	}
+	if err == nil {
+		return true
+	}
+	if funds.IsUserError(err) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+	}
+	return false
+}
+
+var hundred = decimal.FromInt(100)
+
+// positive reports whether an optional request value is set and above zero.
+func positive(v *decimal.Decimal) bool {
+	return v != nil && v.IsPositive()
+}
+
+// checkPrice checks an optional request price against the symbol's tick.
+func checkPrice(rules *instruments.Registry, symbol, field string, p *decimal.Decimal) error {
+	if p == nil {
+		return nil
+	}
+	return rules.CheckPrice(symbol, field, *p)
+}
+
+const orderColumns = `id, user_id, symbol, side, type, quantity, price, stop_price,
+	trail_amount, trail_percent, water_mark, time_in_force, expires_at, extended_hours, filled_quantity, average_fill_price,
+	status, source, group_id, group_role, created_at, executed_at`
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row rowScanner) (models.Order, error) {
+	var o models.Order
+	var price, stopPrice, trailAmount, trailPercent, waterMark, avgFill decimal.NullDecimal
+	var expiresAt, executedAt sql.NullTime
+	var groupID, groupRole sql.NullString
+	err := row.Scan(&o.ID, &o.UserID, &o.Symbol, &o.Side, &o.Type, &o.Quantity, &price, &stopPrice,
+		&trailAmount, &trailPercent, &waterMark, &o.TimeInForce, &expiresAt, &o.ExtendedHours, &o.FilledQuantity, &avgFill,
+		&o.Status, &o.Source, &groupID, &groupRole, &o.CreatedAt, &executedAt)
+	if err != nil {
+		return o, err
+	}
+	o.Price = price.Ptr()
+	o.StopPrice = stopPrice.Ptr()
+	o.TrailAmount = trailAmount.Ptr()
+	o.TrailPercent = trailPercent.Ptr()
+	o.WaterMark = waterMark.Ptr()
+	o.AverageFillPrice = avgFill.Ptr()
+	if expiresAt.Valid {
+		o.ExpiresAt = &expiresAt.Time
+	}
+	if executedAt.Valid {
+		o.ExecutedAt = &executedAt.Time
+	}
+	if groupID.Valid {
+		o.GroupID = &groupID.String
+	}
+	o.GroupRole = groupRole.String
+	return o, nil
+}
+
+// ListOrders returns the user's orders, newest first.
+// Query params: status, symbol, side, from, to (RFC3339 or YYYY-MM-DD, a date
+// taking in the whole day), limit, cursor.
+func ListOrders(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+
+		where := []string{"user_id=$1"}
+		args := []interface{}{userID}
+		addFilter := func(clause string, v interface{}) {
+			args = append(args, v)
+			where = append(where, fmt.Sprintf(clause, len(args)))
+		}
+
+		if v := strings.ToLower(strings.TrimSpace(c.Query("status"))); v != "" {
+			addFilter("status=$%d", v)
+		}
+		if v := strings.ToUpper(strings.TrimSpace(c.Query("symbol"))); v != "" {
+			addFilter("symbol=$%d", v)
+		}
+		if v := strings.ToLower(strings.TrimSpace(c.Query("side"))); v != "" {
+			if v != "buy" && v != "sell" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "side must be buy or sell"})
 				return
 			}
-
-			// Validate sufficient funds
-			if balance < totalCost {
-				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("insufficient funds (need $%.2f, have $%.2f)", totalCost, balance)})
+			addFilter("side=$%d", v)
+		}
+		if raw := c.Query("from"); raw != "" {
+			from, err := parseTimeParam(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from date"})
 				return
 			}
-		} else if req.Side == "sell" {
-			// Check holdings
-			var currentQty float64
-			err := tx.QueryRowContext(c,
-				`SELECT quantity FROM holdings WHERE user_id=$1 AND symbol=$2`,
-				userID, req.Symbol).Scan(&currentQty)
-
-			if err == sql.ErrNoRows {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "you don't own this asset"})
+			addFilter("created_at >= $%d", from)
+		}
+		if raw := c.Query("to"); raw != "" {
+			to, err := parseEndParam(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to date"})
 				return
-			} else if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			}
+			addFilter("created_at < $%d", to)
+		}
+
+		limit := parseLimit(c.Query("limit"))
+
+		if raw := c.Query("cursor"); raw != "" {
+			cursorTime, cursorID, err := decodeCursor(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
 				return
 			}
+			args = append(args, cursorTime, cursorID)
+			where = append(where, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+		}
+
+		args = append(args, limit+1)
+		query := fmt.Sprintf(`SELECT %s FROM orders WHERE %s ORDER BY created_at DESC, id DESC LIMIT $%d`,
+			orderColumns, strings.Join(where, " AND "), len(args))
+
+		rows, err := db.QueryContext(c, query, args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "orders lookup failed"})
+			return
+		}
+		defer rows.Close()
 
-			if req.Quantity > currentQty {
-				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("insufficient holdings (have %.4f, selling %.4f)", currentQty, req.Quantity)})
+		orders := []models.Order{}
+		for rows.Next() {
+			o, err := scanOrder(rows)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "orders scan failed"})
 				return
 			}
+			orders = append(orders, o)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "orders lookup failed"})
+			return
 		}
 
-		// Insert Order into DB
-		var orderID string
-		status := "pending"
-		priceVal := NullFloat64(req.Price)
+		resp := models.OrderListResponse{Orders: orders}
+		if len(orders) > limit {
+			resp.Orders = orders[:limit]
+			last := resp.Orders[limit-1]
+			resp.NextCursor = encodeCursor(last.CreatedAt, last.ID)
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
 
-		err = tx.QueryRowContext(c, `
-			INSERT INTO orders (user_id, symbol, side, type, quantity, price, status)
-			VALUES ($1, $2, $3, $4, $5, $6, $7)
-			RETURNING id`,
-			userID, req.Symbol, req.Side, req.Type, req.Quantity, priceVal, status).Scan(&orderID)
+// GetOrder returns a single order owned by the user.
+func GetOrder(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		if !uuidPattern.MatchString(c.Param("id")) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+			return
+		}
+		o, err := scanOrder(db.QueryRowContext(c,
+			`SELECT `+orderColumns+` FROM orders WHERE id=$1 AND user_id=$2`, c.Param("id"), userID))
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "order lookup failed"})
+			return
+		}
 
+		rows, err := db.QueryContext(c,
+			`SELECT id, quantity, price, reference_price, fee, created_at FROM order_fills WHERE order_id=$1 ORDER BY created_at`, o.ID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to place order"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "fills lookup failed"})
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var f models.OrderFill
+			var ref decimal.NullDecimal
+			if err := rows.Scan(&f.ID, &f.Quantity, &f.Price, &ref, &f.Fee, &f.CreatedAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "fills scan failed"})
+				return
+			}
+			if ref.Valid && ref.Decimal.IsPositive() {
+				f.ReferencePrice = ref.Ptr()
+				// Positive means the fill was worse than the reference for this side.
+				bps := f.Price.Sub(ref.Decimal).Div(ref.Decimal).Float64() * 10000
+				if o.Side == "sell" {
+					bps = -bps
+				}
+				f.SlippageBPS = &bps
+			}
+			o.Fills = append(o.Fills, f)
+		}
+		c.JSON(http.StatusOK, o)
+	}
+}
+
+// lockPendingOrder loads the user's working order with a row lock so the worker can't
+// execute it while we change it. On failure it writes the error response.
+func lockPendingOrder(c *gin.Context, tx *sql.Tx, userID string) (models.Order, bool) {
+	if !uuidPattern.MatchString(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return models.Order{}, false
+	}
+	o, err := scanOrder(tx.QueryRowContext(c,
+		`SELECT `+orderColumns+` FROM orders WHERE id=$1 AND user_id=$2 FOR UPDATE`, c.Param("id"), userID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return o, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "order lookup failed"})
+		return o, false
+	}
+	if o.Status != "pending" && o.Status != "partially_filled" && o.Status != "inactive" {
+		c.JSON(http.StatusConflict, gin.H{"error": "order is " + o.Status + ", only working orders can be changed"})
+		return o, false
+	}
+	if o.Source == "liquidation" {
+		c.JSON(http.StatusConflict, gin.H{"error": "liquidation orders can't be changed"})
+		return o, false
+	}
+	return o, true
+}
+
+// CancelOrder cancels a pending order, or the unfilled rest of a partially
+// filled one. Cancelling an order in a group ends the group, except that a
+// bracket entry that filled in part still gets its exits.
+func CancelOrder(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+
+		tx, err := db.BeginTx(c, &sql.TxOptions{})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		defer tx.Rollback()
+
+		o, ok := lockPendingOrder(c, tx, userID)
+		if !ok {
+			return
+		}
+
+		if err := funds.ReleaseOrder(c, tx, o.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "releasing funds failed"})
+			return
+		}
+		if _, err := tx.ExecContext(c, `UPDATE orders SET status='cancelled' WHERE id=$1`, o.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "cancel failed"})
+			return
+		}
+		if _, err := groups.OnEnd(c, tx, o.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "cancelling order group failed"})
 			return
 		}
 
@@ -118,14 +510,178 @@ func PlaceOrder(db *sql.DB, priceCheck PriceChecker) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusCreated, gin.H{"message": "order placed", "order_id": orderID, "status": status})
+		o.Status = "cancelled"
+		c.JSON(http.StatusOK, o)
 	}
 }
 
-// Helper for nullable float
-func NullFloat64(v *float64) sql.NullFloat64 {
-	if v == nil {
-		return sql.NullFloat64{Valid: false}
+// ModifyOrder changes the quantity or prices of a working order in place.
+// Like placing one, it is refused while the symbol is halted.
+func ModifyOrder(db *sql.DB, priceCheck PriceChecker, feeEngine *fees.Engine, rules *instruments.Registry, hr *halts.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req models.ModifyOrderRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid input: " + err.Error()})
+			return
+		}
+		if req.Quantity == nil && req.Price == nil && req.StopPrice == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "nothing to change"})
+			return
+		}
+		if (req.Quantity != nil && !positive(req.Quantity)) ||
+			(req.Price != nil && !positive(req.Price)) ||
+			(req.StopPrice != nil && !positive(req.StopPrice)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quantity and prices must be positive"})
+			return
+		}
+
+		tx, err := db.BeginTx(c, &sql.TxOptions{})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		defer tx.Rollback()
+
+		o, ok := lockPendingOrder(c, tx, userID)
+		if !ok {
+			return
+		}
+		if o.GroupID != nil {
+			// Group legs share a hold and are sized by the group.
+			c.JSON(http.StatusConflict, gin.H{"error": "orders in a group can't be modified; cancel the group and place it again"})
+			return
+		}
+		if !checkHalt(c, hr, o.Symbol) {
+			return
+		}
+
+		if req.Price != nil && o.Type != "limit" && o.Type != "stop" && o.Type != "stop_limit" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "price can only be changed on limit, stop and stop_limit orders"})
+			return
+		}
+		if req.StopPrice != nil && o.Type != "stop_limit" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "stop_price can only be changed on stop_limit orders"})
+			return
+		}
+		var qtyErr error
+		if req.Quantity != nil {
+			qtyErr = rules.CheckQuantity(o.Symbol, *req.Quantity)
+		}
+		if !checkRules(c, qtyErr,
+			checkPrice(rules, o.Symbol, "price", req.Price),
+			checkPrice(rules, o.Symbol, "stop_price", req.StopPrice)) {
+			return
+		}
+
+		resetTrigger := false
+		if req.Quantity != nil {
+			if !req.Quantity.GreaterThan(o.FilledQuantity) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("quantity must exceed the %s already filled", o.FilledQuantity)})
+				return
+			}
+			o.Quantity = *req.Quantity
+		}
+		if req.Price != nil {
+			o.Price = req.Price
+			// A stop's price is its stop, which has to be crossed again.
+			resetTrigger = o.Type == "stop"
+		}
+		if req.StopPrice != nil {
+			o.StopPrice = req.StopPrice
+			// A new stop has to be crossed again before the limit leg goes live.
+			resetTrigger = true
+		}
+
+		livePrice, err := priceCheck.GetPrice(o.Symbol)
+		if err != nil || !livePrice.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "price unavailable for " + o.Symbol})
+			return
+		}
+		if o.WaterMark != nil {
+			livePrice = *o.WaterMark
+		}
+		estimatedPrice := estimatePrice(o.Type, o.Side, livePrice, o.Price, o.TrailAmount, o.TrailPercent)
+		if !checkRules(c, rules.CheckNotional(o.Symbol, o.Quantity, estimatedPrice)) {
+			return
+		}
+		// Swap the old hold for one sized to the new order.
+		if err := funds.ReleaseOrder(c, tx, o.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "releasing funds failed"})
+			return
+		}
+		remaining := o.Quantity.Sub(o.FilledQuantity)
+		estimatedFee := feeEngine.Fee(o.Symbol, remaining, estimatedPrice, false)
+		if !holdFunds(c, tx, priceCheck, o.ID, userID, o.Side, o.Symbol, remaining, estimatedPrice, estimatedFee) {
+			return
+		}
+
+		if _, err := tx.ExecContext(c, `
+			UPDATE orders
+			SET quantity=$1, price=$2, stop_price=$3,
+			    triggered_at=CASE WHEN $4 THEN NULL ELSE triggered_at END
+			WHERE id=$5`,
+			o.Quantity, decimal.NullFrom(o.Price), decimal.NullFrom(o.StopPrice), resetTrigger, o.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "modify failed"})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "commit failed"})
+			return
+		}
+
+		c.JSON(http.StatusOK, o)
+	}
+}
+
+// parseTimeParam accepts either an RFC3339 timestamp or a plain YYYY-MM-DD date.
+func parseTimeParam(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", raw)
+}
+
+// parseEndParam reads the exclusive end of a range like parseTimeParam, but
+// a plain date includes the whole day: to=2026-10-01 ends at midnight after it.
+func parseEndParam(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	return t.AddDate(0, 0, 1), err
+}
+
+// parseLimit reads a page size, defaulting to 50 and capping at 200.
+func parseLimit(raw string) int {
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit <= 0 {
+		return 50
+	}
+	if limit > 200 {
+		return 200
+	}
+	return limit
+}
+
+// Cursors are opaque to clients: base64 of "<created_at>|<id>" for the last row served.
+func encodeCursor(t time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(t.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodeCursor(raw string) (time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 || !uuidPattern.MatchString(parts[1]) {
+		return time.Time{}, "", fmt.Errorf("malformed cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", err
 	}
-	return sql.NullFloat64{Float64: *v, Valid: true}
+	return t, parts[1], nil
 }
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/models"
+	"github.com/sahniaditya/flux-backend/precision"
+	"github.com/sahniaditya/flux-backend/snapshots"
+)
+
+// Price statuses of a holding.
+const (
+	priceLive        = "live"
+	priceStale       = "stale"
+	priceUnavailable = "unavailable"
+)
+
+// markToMarket values each holding at its feed price and adds it to the
+// portfolio's totals. A stale price still values the holding, flagged; a
+// missing one leaves it unvalued rather than worth zero. It returns the
+// prices it used, by symbol.
+func markToMarket(priceCheck PriceChecker, resp *models.PortfolioResponse) map[string]decimal.Decimal {
+	marks := make(map[string]decimal.Decimal, len(resp.Holdings))
+	for i := range resp.Holdings {
+		h := &resp.Holdings[i]
+		quote, err := priceCheck.GetQuote(h.Symbol)
+		if err != nil || !quote.Price.IsPositive() {
+			h.PriceStatus = priceUnavailable
+			resp.PricesComplete = false
+			continue
+		}
+		h.PriceStatus = priceLive
+		if time.Since(quote.UpdatedAt) > maxQuoteAge {
+			h.PriceStatus = priceStale
+			resp.PricesComplete = false
+		}
+		marks[h.Symbol] = quote.Price
+
+		value := precision.Cash(h.Quantity.Mul(quote.Price))
+		// Longs gain what they're worth over cost; shorts what they raised
+		// over what covering would cost.
+		pnl := value.Sub(h.CostBasis)
+		if h.Quantity.IsNegative() {
+			pnl = value.Add(h.CostBasis)
+		}
+		// The 24h move is a percentage of yesterday's price.
+		change := quote.Change24h
+		dayChange := decimal.Zero
+		if change != 0 && change > -100 {
+			dayChange = precision.Cash(value.Mul(decimal.FromFloat(change)).Div(decimal.FromFloat(100 + change)))
+		}
+
+		price, updated := quote.Price, quote.UpdatedAt
+		h.Price, h.PriceUpdatedAt = &price, &updated
+		h.MarketValue, h.UnrealizedPnL, h.DayChange, h.DayChangePercent = &value, &pnl, &dayChange, &change
+		if h.CostBasis.IsPositive() {
+			pct := pnl.Mul(hundred).Div(h.CostBasis).Round(2)
+			h.UnrealizedPnLPercent = &pct
+		}
+		resp.MarketValue = resp.MarketValue.Add(value)
+		resp.UnrealizedPnL = resp.UnrealizedPnL.Add(pnl)
+		resp.DayChange = resp.DayChange.Add(dayChange)
+	}
+	return marks
+}
+
+// weigh sets each holding's share of equity, and the cash's. Shorts weigh
+// negative. Equity at or below zero has no meaningful weights.
+func weigh(resp *models.PortfolioResponse, equity decimal.Decimal) {
+	if !equity.IsPositive() {
+		return
+	}
+	for i := range resp.Holdings {
+		h := &resp.Holdings[i]
+		if h.MarketValue != nil {
+			w := h.MarketValue.Div(equity).Round(4)
+			h.Weight = &w
+		}
+	}
+	cash := resp.Balance.Sub(resp.Loan).Div(equity).Round(4)
+	resp.CashWeight = &cash
+}
+
+// historyRange returns when a history range starts. ALL starts at the
+// beginning; YTD at the start of the UTC year.
+func historyRange(r string, now time.Time) (time.Time, bool) {
+	switch r {
+	case "1D":
+		return now.AddDate(0, 0, -1), true
+	case "1W":
+		return now.AddDate(0, 0, -7), true
+	case "1M":
+		return now.AddDate(0, -1, 0), true
+	case "3M":
+		return now.AddDate(0, -3, 0), true
+	case "6M":
+		return now.AddDate(0, -6, 0), true
+	case "1Y":
+		return now.AddDate(-1, 0, 0), true
+	case "YTD":
+		return time.Date(now.UTC().Year(), 1, 1, 0, 0, 0, 0, time.UTC), true
+	case "ALL":
+		return time.Time{}, true
+	}
+	return time.Time{}, false
+}
+
+// GetPortfolioHistory returns the account's equity snapshots over a range
+// (1D, 1W, 1M, 3M, 6M, 1Y, YTD or ALL; default 1M) at a granularity (1h or
+// 1d; default 1d), with its time- and money-weighted returns.
+func GetPortfolioHistory(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		rng := strings.ToUpper(c.DefaultQuery("range", "1M"))
+		from, ok := historyRange(rng, time.Now())
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "range must be 1D, 1W, 1M, 3M, 6M, 1Y, YTD or ALL"})
+			return
+		}
+		granularity := strings.ToLower(c.DefaultQuery("granularity", snapshots.Daily))
+		if granularity != snapshots.Daily && granularity != snapshots.Hourly {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "granularity must be 1h or 1d"})
+			return
+		}
+
+		history, err := snapshots.History(c, db, userID, granularity, from)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "history lookup failed"})
+			return
+		}
+		resp := models.PortfolioHistory{Range: rng, Granularity: granularity, Points: []models.HistoryPoint{}}
+		if len(history) == 0 {
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+		flows, err := snapshots.Flows(c, db, userID, history[0].TakenAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "cash flow lookup failed"})
+			return
+		}
+
+		last := history[len(history)-1].TakenAt
+		next := 0
+		for _, s := range history {
+			p := models.HistoryPoint{
+				Period: s.Period, TakenAt: s.TakenAt, Cash: s.Cash, Loan: s.Loan,
+				MarketValue: s.MarketValue, Equity: s.Equity, Complete: s.Complete,
+			}
+			for ; next < len(flows) && !flows[next].At.After(s.TakenAt); next++ {
+				p.NetFlow = p.NetFlow.Add(flows[next].Amount)
+			}
+			resp.Points = append(resp.Points, p)
+		}
+		for _, f := range flows {
+			if !f.At.After(last) {
+				resp.NetDeposits = resp.NetDeposits.Add(f.Amount)
+			}
+		}
+		resp.TWR = snapshots.TWR(history, flows)
+		resp.MWR = snapshots.MWR(history, flows)
+		c.JSON(http.StatusOK, resp)
+	}
+}
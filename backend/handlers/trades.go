@@ -2,21 +2,36 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/calendar"
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/fees"
+	"github.com/sahniaditya/flux-backend/halts"
+	"github.com/sahniaditya/flux-backend/instruments"
+	"github.com/sahniaditya/flux-backend/ledger"
+	"github.com/sahniaditya/flux-backend/lots"
+	"github.com/sahniaditya/flux-backend/margin"
 	"github.com/sahniaditya/flux-backend/models"
+	"github.com/sahniaditya/flux-backend/positions"
+	"github.com/sahniaditya/flux-backend/precision"
 )
 
-// GetPortfolio returns wallet and holdings for the authenticated user.
-func GetPortfolio(db *sql.DB) gin.HandlerFunc {
+// GetPortfolio returns wallet and holdings for the authenticated user, each
+// holding marked to market, with realized and unrealized P&L, the day's
+// change, allocation weights, the margin loan, equity, buying power and
+// margin utilization.
+func GetPortfolio(db *sql.DB, priceCheck PriceChecker) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetString("user_id")
-		var balance float64
+		var balance, reserved decimal.Decimal
 		err := db.QueryRowContext(c,
-			`SELECT balance FROM wallets WHERE user_id=$1 AND currency='USD'`, userID).Scan(&balance)
+			`SELECT balance, reserved FROM wallets WHERE user_id=$1 AND currency='USD'`, userID).Scan(&balance, &reserved)
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "wallet not found"})
 			return
@@ -25,8 +40,13 @@ func GetPortfolio(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		rows, err := db.QueryContext(c,
-			`SELECT symbol, quantity, average_buy_price FROM holdings WHERE user_id=$1 AND quantity > 0 ORDER BY symbol`, userID)
+		rows, err := db.QueryContext(c, `
+			SELECT h.symbol, h.quantity, h.reserved_quantity, h.average_buy_price,
+				COALESCE((SELECT SUM(l.cost) FROM tax_lots l
+					WHERE l.user_id = h.user_id AND l.symbol = h.symbol AND l.remaining > 0), ABS(h.quantity) * h.average_buy_price),
+				COALESCE((SELECT SUM(r.realized_pnl) FROM lot_closures r
+					WHERE r.user_id = h.user_id AND r.symbol = h.symbol), 0)
+			FROM holdings h WHERE h.user_id=$1 AND h.quantity <> 0 ORDER BY h.symbol`, userID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "holdings lookup failed"})
 			return
@@ -36,18 +56,63 @@ func GetPortfolio(db *sql.DB) gin.HandlerFunc {
 		holdings := []models.HoldingEntry{}
 		for rows.Next() {
 			var h models.HoldingEntry
-			if err := rows.Scan(&h.Symbol, &h.Quantity, &h.AverageBuyPrice); err != nil {
+			if err := rows.Scan(&h.Symbol, &h.Quantity, &h.ReservedQuantity, &h.AverageBuyPrice, &h.CostBasis, &h.RealizedPnL); err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "holdings scan failed"})
 				return
 			}
+			h.AvailableQuantity = decimal.Max(h.Quantity.Sub(h.ReservedQuantity), decimal.Zero)
 			holdings = append(holdings, h)
 		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "holdings lookup failed"})
+			return
+		}
+
+		resp := models.PortfolioResponse{
+			Balance:          balance,
+			ReservedBalance:  reserved,
+			AvailableBalance: balance.Sub(reserved),
+			Currency:         "USD",
+			AccountMode:      "cash",
+			PricesComplete:   true,
+			Holdings:         holdings,
+		}
+		if err := db.QueryRowContext(c,
+			`SELECT COALESCE(SUM(realized_pnl), 0) FROM lot_closures WHERE user_id=$1`, userID).Scan(&resp.RealizedPnL); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "realized P&L lookup failed"})
+			return
+		}
+		acct, err := margin.Load(c, db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "margin lookup failed"})
+			return
+		}
+		if acct != nil {
+			resp.AccountMode = "margin"
+			resp.Loan = acct.Loan
+		}
 
-		c.JSON(http.StatusOK, models.PortfolioResponse{
-			Balance:  balance,
-			Currency: "USD",
-			Holdings: holdings,
-		})
+		// Mark every holding once and value the account from the same marks.
+		marks := markToMarket(priceCheck, &resp)
+		quote := func(symbol string) (decimal.Decimal, error) {
+			if p, ok := marks[symbol]; ok {
+				return p, nil
+			}
+			return decimal.Zero, margin.ErrPriceUnavailable
+		}
+		// Equity needs every holding priced; leave it out rather than guess.
+		if s, err := margin.Evaluate(c, db, userID, quote); err == nil {
+			equity := s.Equity()
+			buyingPower := resp.AvailableBalance
+			utilization := decimal.Zero
+			if acct != nil {
+				buyingPower = acct.BuyingPower(s)
+				utilization = acct.Utilization(s)
+			}
+			resp.Equity, resp.BuyingPower, resp.MarginUtilization = &equity, &buyingPower, &utilization
+			weigh(&resp, equity)
+		}
+		c.JSON(http.StatusOK, resp)
 	}
 }
 
@@ -56,10 +121,14 @@ func TopUpWallet(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetString("user_id")
 		var req models.TopUpRequest
-		if err := c.ShouldBindJSON(&req); err != nil || req.Amount <= 0 {
+		if err := c.ShouldBindJSON(&req); err != nil || !req.Amount.IsPositive() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "amount must be positive"})
 			return
 		}
+		if precision.Cash(req.Amount) != req.Amount {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "amount must be in whole cents"})
+			return
+		}
 
 		tx, err := db.BeginTx(c, &sql.TxOptions{})
 		if err != nil {
@@ -68,9 +137,7 @@ func TopUpWallet(db *sql.DB) gin.HandlerFunc {
 		}
 		defer tx.Rollback()
 
-		if _, err := tx.ExecContext(c,
-			`UPDATE wallets SET balance = balance + $1, updated_at=$2 WHERE user_id=$3 AND currency='USD'`,
-			req.Amount, time.Now().UTC(), userID); err != nil {
+		if err := ledger.Deposit(c, tx, userID, req.Amount); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "wallet update failed"})
 			return
 		}
@@ -81,6 +148,11 @@ func TopUpWallet(db *sql.DB) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "transaction log failed"})
 			return
 		}
+		// Deposits into a margin account pay down its loan first.
+		if _, err := margin.Repay(c, tx, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "loan repayment failed"})
+			return
+		}
 
 		if err := tx.Commit(); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "commit failed"})
@@ -90,8 +162,58 @@ func TopUpWallet(db *sql.DB) gin.HandlerFunc {
 	}
 }
 
-// TradeBuy handles simulated buys with row-level locking.
-func TradeBuy(db *sql.DB) gin.HandlerFunc {
+// maxQuoteAge is how old a feed price may be before instant trades refuse it.
+const maxQuoteAge = 2 * time.Minute
+
+// livePrice fetches the execution price for an instant trade from the feed,
+// rounded to the symbol's tick. On failure it writes the error response and
+// returns false.
+func livePrice(c *gin.Context, priceCheck PriceChecker, rules *instruments.Registry, symbol string) (decimal.Decimal, bool) {
+	quote, err := priceCheck.GetQuote(symbol)
+	if err != nil || !quote.Price.IsPositive() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "price unavailable for " + symbol})
+		return decimal.Zero, false
+	}
+	if age := time.Since(quote.UpdatedAt); age > maxQuoteAge {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("price for %s is stale (%s old)", symbol, age.Round(time.Second))})
+		return decimal.Zero, false
+	}
+	return rules.Price(symbol, quote.Price), true
+}
+
+// checkRules refuses orders that break the symbol's instrument rules. It
+// takes the results of the rule checks and on the first failure writes the
+// error response, with the violation's code, and returns false.
+func checkRules(c *gin.Context, errs ...error) bool {
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		var v *instruments.Violation
+		if errors.As(err, &v) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": v.Message, "code": v.Code})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return false
+	}
+	return true
+}
+
+// marketOpen refuses instant trades in equities while their market is closed.
+// On failure it writes the error response and returns false.
+func marketOpen(c *gin.Context, cal *calendar.Calendar, symbol string, extended bool) bool {
+	now := time.Now()
+	if cal.IsOpen(symbol, extended, now) {
+		return true
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "market is closed for " + symbol, "next_open": cal.NextOpen(symbol, extended, now)})
+	return false
+}
+
+// TradeBuy handles simulated buys at the live feed price with row-level locking.
+// The commission is added to the cash spent and to the holding's cost basis.
+func TradeBuy(db *sql.DB, priceCheck PriceChecker, feeEngine *fees.Engine, rules *instruments.Registry, cal *calendar.Calendar, hr *halts.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetString("user_id")
 		var req models.TradeRequest
@@ -100,12 +222,28 @@ func TradeBuy(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 		req.Symbol = strings.ToUpper(strings.TrimSpace(req.Symbol))
-		if req.Quantity <= 0 || req.Price <= 0 || req.Symbol == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "symbol, quantity, and price must be positive"})
+		if !req.Quantity.IsPositive() || req.Symbol == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "symbol and quantity must be positive"})
+			return
+		}
+		if !checkRules(c, rules.CheckQuantity(req.Symbol, req.Quantity)) || !checkLotIDs(c, req.LotIDs) {
+			return
+		}
+		if !checkHalt(c, hr, req.Symbol) || !marketOpen(c, cal, req.Symbol, req.ExtendedHours) {
 			return
 		}
 
-		total := req.Quantity * req.Price
+		price, ok := livePrice(c, priceCheck, rules, req.Symbol)
+		if !ok || !checkRules(c, rules.CheckNotional(req.Symbol, req.Quantity, price)) {
+			return
+		}
+		if req.MaxPrice != nil && price.GreaterThan(*req.MaxPrice) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("price $%.2f is above max_price $%.2f", price, *req.MaxPrice), "price": price})
+			return
+		}
+
+		fee := feeEngine.Fee(req.Symbol, req.Quantity, price, false)
+		total := precision.Cash(req.Quantity.Mul(price)).Add(fee)
 
 		tx, err := db.BeginTx(c, &sql.TxOptions{})
 		if err != nil {
@@ -114,57 +252,41 @@ func TradeBuy(db *sql.DB) gin.HandlerFunc {
 		}
 		defer tx.Rollback()
 
-		var balance float64
+		// Cash held for pending orders isn't spendable here.
+		var balance, reserved decimal.Decimal
 		if err := tx.QueryRowContext(c,
-			`SELECT balance FROM wallets WHERE user_id=$1 AND currency='USD' FOR UPDATE`,
-			userID).Scan(&balance); err != nil {
+			`SELECT balance, reserved FROM wallets WHERE user_id=$1 AND currency='USD' FOR UPDATE`,
+			userID).Scan(&balance, &reserved); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "wallet not found"})
 			return
 		}
-		if balance < total {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "insufficient funds"})
+		trade := positions.Trade{UserID: userID, Symbol: req.Symbol, Side: "buy", Quantity: req.Quantity, Price: price, Fee: fee, LotIDs: req.LotIDs}
+		acct, err := margin.Load(c, tx, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "margin lookup failed"})
 			return
 		}
-
-		if _, err := tx.ExecContext(c,
-			`UPDATE wallets SET balance = balance - $1, updated_at=$2 WHERE user_id=$3 AND currency='USD'`,
-			total, time.Now().UTC(), userID); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "wallet update failed"})
+		if acct == nil && balance.Sub(reserved).LessThan(total) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "insufficient funds"})
 			return
 		}
-
-		var qty float64
-		var avg float64
-		err = tx.QueryRowContext(c,
-			`SELECT quantity, average_buy_price FROM holdings WHERE user_id=$1 AND symbol=$2 FOR UPDATE`,
-			userID, req.Symbol).Scan(&qty, &avg)
-
-		if err == sql.ErrNoRows {
-			if _, err := tx.ExecContext(c,
-				`INSERT INTO holdings (user_id, symbol, quantity, average_buy_price) VALUES ($1,$2,$3,$4)`,
-				userID, req.Symbol, req.Quantity, req.Price); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "insert holding failed"})
+		if acct != nil {
+			// Margin accounts borrow whatever the free cash doesn't cover.
+			if !checkMargin(c, tx, priceCheck, acct, trade) {
 				return
 			}
-		} else if err == nil {
-			newQty := qty + req.Quantity
-			newAvg := ((qty * avg) + total) / newQty
-			if _, err := tx.ExecContext(c,
-				`UPDATE holdings SET quantity=$1, average_buy_price=$2, updated_at=$3 WHERE user_id=$4 AND symbol=$5`,
-				newQty, newAvg, time.Now().UTC(), userID, req.Symbol); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "update holding failed"})
+			if err := margin.Borrow(c, tx, userID, total.Sub(decimal.Max(balance.Sub(reserved), decimal.Zero))); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "margin loan failed"})
 				return
 			}
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "holding query failed"})
-			return
 		}
 
-		if _, err := tx.ExecContext(c,
-			`INSERT INTO transactions (user_id, type, symbol, quantity, price_per_unit, total_amount) 
-			 VALUES ($1,'BUY',$2,$3,$4,$5)`,
-			userID, req.Symbol, req.Quantity, req.Price, total); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "transaction log failed"})
+		realized, err := positions.Settle(c, tx, trade)
+		if lots.IsUserError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "settlement failed"})
 			return
 		}
 
@@ -173,12 +295,14 @@ func TradeBuy(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "buy executed", "spent": total})
+		c.JSON(http.StatusOK, gin.H{"message": "buy executed", "price": price, "spent": total, "fee": fee, "realized_pnl": realized})
 	}
 }
 
-// TradeSell handles simulated sells with row-level locking.
-func TradeSell(db *sql.DB) gin.HandlerFunc {
+// TradeSell handles simulated sells at the live feed price with row-level locking.
+// The commission comes out of the proceeds. Margin accounts may sell more
+// than they hold, opening or extending a short position.
+func TradeSell(db *sql.DB, priceCheck PriceChecker, feeEngine *fees.Engine, rules *instruments.Registry, cal *calendar.Calendar, hr *halts.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetString("user_id")
 		var req models.TradeRequest
@@ -187,12 +311,32 @@ func TradeSell(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 		req.Symbol = strings.ToUpper(strings.TrimSpace(req.Symbol))
-		if req.Quantity <= 0 || req.Price <= 0 || req.Symbol == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "symbol, quantity, and price must be positive"})
+		if !req.Quantity.IsPositive() || req.Symbol == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "symbol and quantity must be positive"})
+			return
+		}
+		if !checkRules(c, rules.CheckQuantity(req.Symbol, req.Quantity)) || !checkLotIDs(c, req.LotIDs) {
+			return
+		}
+		if !checkHalt(c, hr, req.Symbol) || !marketOpen(c, cal, req.Symbol, req.ExtendedHours) {
 			return
 		}
 
-		total := req.Quantity * req.Price
+		price, ok := livePrice(c, priceCheck, rules, req.Symbol)
+		if !ok || !checkRules(c, rules.CheckNotional(req.Symbol, req.Quantity, price)) {
+			return
+		}
+		if req.MinPrice != nil && price.LessThan(*req.MinPrice) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("price $%.2f is below min_price $%.2f", price, *req.MinPrice), "price": price})
+			return
+		}
+
+		fee := feeEngine.Fee(req.Symbol, req.Quantity, price, false)
+		total := precision.Cash(req.Quantity.Mul(price)).Sub(fee)
+		if total.IsNegative() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "commission exceeds sale proceeds"})
+			return
+		}
 
 		tx, err := db.BeginTx(c, &sql.TxOptions{})
 		if err != nil {
@@ -201,53 +345,45 @@ func TradeSell(db *sql.DB) gin.HandlerFunc {
 		}
 		defer tx.Rollback()
 
-		var qty float64
-		var avg float64
-		if err := tx.QueryRowContext(c,
-			`SELECT quantity, average_buy_price FROM holdings WHERE user_id=$1 AND symbol=$2 FOR UPDATE`,
-			userID, req.Symbol).Scan(&qty, &avg); err != nil {
-			if err == sql.ErrNoRows {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "no holdings to sell"})
-				return
-			}
+		// Shares held for pending sell orders can't be sold twice. Cash accounts
+		// sell only what they own; margin accounts may sell short.
+		qty, reservedQty, err := positions.Get(c, tx, userID, req.Symbol)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "holding query failed"})
 			return
 		}
-		if qty < req.Quantity {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "insufficient quantity"})
+		trade := positions.Trade{UserID: userID, Symbol: req.Symbol, Side: "sell", Quantity: req.Quantity, Price: price, Fee: fee, LotIDs: req.LotIDs}
+		acct, err := margin.Load(c, tx, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "margin lookup failed"})
 			return
 		}
-
-		newQty := qty - req.Quantity
-		if newQty == 0 {
-			if _, err := tx.ExecContext(c,
-				`DELETE FROM holdings WHERE user_id=$1 AND symbol=$2`,
-				userID, req.Symbol); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "delete holding failed"})
-				return
-			}
-		} else {
-			if _, err := tx.ExecContext(c,
-				`UPDATE holdings SET quantity=$1, updated_at=$2 WHERE user_id=$3 AND symbol=$4`,
-				newQty, time.Now().UTC(), userID, req.Symbol); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "update holding failed"})
+		if acct != nil {
+			if !checkMargin(c, tx, priceCheck, acct, trade) {
 				return
 			}
-		}
-
-		if _, err := tx.ExecContext(c,
-			`UPDATE wallets SET balance = balance + $1, updated_at=$2 WHERE user_id=$3 AND currency='USD'`,
-			total, time.Now().UTC(), userID); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "wallet update failed"})
+		} else if !qty.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no holdings to sell"})
+			return
+		} else if qty.Sub(reservedQty).LessThan(req.Quantity) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "insufficient quantity"})
 			return
 		}
 
-		if _, err := tx.ExecContext(c,
-			`INSERT INTO transactions (user_id, type, symbol, quantity, price_per_unit, total_amount) 
-			 VALUES ($1,'SELL',$2,$3,$4,$5)`,
-			userID, req.Symbol, req.Quantity, req.Price, total); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "transaction log failed"})
+		realized, err := positions.Settle(c, tx, trade)
+		if lots.IsUserError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "settlement failed"})
+			return
+		}
+		// Proceeds pay down any margin loan first.
+		if acct != nil {
+			if _, err := margin.Repay(c, tx, userID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "loan repayment failed"})
+				return
+			}
 		}
 
 		if err := tx.Commit(); err != nil {
@@ -255,6 +391,6 @@ func TradeSell(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "sell executed", "received": total})
+		c.JSON(http.StatusOK, gin.H{"message": "sell executed", "price": price, "received": total, "fee": fee, "realized_pnl": realized})
 	}
 }
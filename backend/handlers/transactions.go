@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/models"
+)
+
+var transactionTypes = map[string]bool{
+	"DEPOSIT": true, "WITHDRAW": true, "BUY": true, "SELL": true, "BORROW_FEE": true, "INTEREST": true,
+}
+
+// transactionsQuery selects the user's ($1) transactions matching where, in
+// order, each with the gain its lot closures realized and the cash balance
+// just after it. The balance runs over the journal's cash lines rather than
+// the transactions, so it counts what they don't record: the opening
+// balance, and margin borrowing and repayment. Entries posted alongside a
+// transaction share its timestamp and count as before it.
+func transactionsQuery(where []string, order string) string {
+	return fmt.Sprintf(`
+		SELECT id, type, symbol, quantity, price_per_unit, total_amount, fee, realized_pnl, cash_balance, created_at FROM (
+			SELECT events.*, SUM(cash) OVER (ORDER BY created_at, ord, id ROWS UNBOUNDED PRECEDING) AS cash_balance
+			FROM (
+				SELECT t.id, t.created_at, 1 AS ord, t.type, t.symbol, t.quantity, t.price_per_unit, t.total_amount, t.fee,
+					(SELECT SUM(l.realized_pnl) FROM lot_closures l WHERE l.transaction_id = t.id) AS realized_pnl,
+					0 AS cash
+				FROM transactions t WHERE t.user_id=$1
+				UNION ALL
+				SELECT e.id, e.created_at, 0, NULL, NULL, NULL, NULL, NULL, NULL, NULL, SUM(j.amount)
+				FROM journal_entries e JOIN journal_lines j ON j.entry_id = e.id
+				WHERE e.user_id=$1 AND j.account='cash' AND j.asset='USD'
+				GROUP BY e.id, e.created_at
+			) events
+		) history
+		WHERE %s
+		ORDER BY %s`, strings.Join(append([]string{"type IS NOT NULL"}, where...), " AND "), order)
+}
+
+func scanTransaction(row rowScanner) (models.Transaction, error) {
+	var t models.Transaction
+	var symbol sql.NullString
+	var quantity, price, realized decimal.NullDecimal
+	err := row.Scan(&t.ID, &t.Type, &symbol, &quantity, &price, &t.TotalAmount, &t.Fee, &realized, &t.CashBalance, &t.CreatedAt)
+	if err != nil {
+		return t, err
+	}
+	if symbol.Valid {
+		t.Symbol = &symbol.String
+	}
+	t.Quantity = quantity.Ptr()
+	t.Price = price.Ptr()
+	t.RealizedPnL = realized.Ptr()
+	return t, nil
+}
+
+// transactionFilters reads the type, symbol, from and to query params into
+// WHERE clauses for transactionsQuery, whose first argument is the user.
+// On failure it writes the error response and returns false.
+func transactionFilters(c *gin.Context) (where []string, args []interface{}, ok bool) {
+	args = []interface{}{c.GetString("user_id")}
+	addFilter := func(clause string, v interface{}) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+
+	// type may list several, comma-separated.
+	if raw := strings.TrimSpace(c.Query("type")); raw != "" {
+		var in []string
+		for _, v := range strings.Split(raw, ",") {
+			v = strings.ToUpper(strings.TrimSpace(v))
+			if !transactionTypes[v] {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "type must be DEPOSIT, WITHDRAW, BUY, SELL, BORROW_FEE or INTEREST"})
+				return nil, nil, false
+			}
+			args = append(args, v)
+			in = append(in, fmt.Sprintf("$%d", len(args)))
+		}
+		where = append(where, "type IN ("+strings.Join(in, ", ")+")")
+	}
+	if v := strings.ToUpper(strings.TrimSpace(c.Query("symbol"))); v != "" {
+		addFilter("symbol=$%d", v)
+	}
+	if raw := c.Query("from"); raw != "" {
+		from, err := parseTimeParam(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from date"})
+			return nil, nil, false
+		}
+		addFilter("created_at >= $%d", from)
+	}
+	if raw := c.Query("to"); raw != "" {
+		to, err := parseEndParam(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to date"})
+			return nil, nil, false
+		}
+		addFilter("created_at < $%d", to)
+	}
+	return where, args, true
+}
+
+// ListTransactions returns the user's transactions, newest first.
+// Query params: type (comma-separated), symbol, from, to (RFC3339 or YYYY-MM-DD,
+// a date taking in the whole day), limit, cursor.
+func ListTransactions(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		where, args, ok := transactionFilters(c)
+		if !ok {
+			return
+		}
+		limit := parseLimit(c.Query("limit"))
+
+		if raw := c.Query("cursor"); raw != "" {
+			cursorTime, cursorID, err := decodeCursor(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+				return
+			}
+			args = append(args, cursorTime, cursorID)
+			where = append(where, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+		}
+
+		args = append(args, limit+1)
+		query := transactionsQuery(where, fmt.Sprintf("created_at DESC, id DESC LIMIT $%d", len(args)))
+
+		rows, err := db.QueryContext(c, query, args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "transactions lookup failed"})
+			return
+		}
+		defer rows.Close()
+
+		transactions := []models.Transaction{}
+		for rows.Next() {
+			t, err := scanTransaction(rows)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "transactions scan failed"})
+				return
+			}
+			transactions = append(transactions, t)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "transactions lookup failed"})
+			return
+		}
+
+		resp := models.TransactionListResponse{Transactions: transactions}
+		if len(transactions) > limit {
+			resp.Transactions = transactions[:limit]
+			last := resp.Transactions[limit-1]
+			resp.NextCursor = encodeCursor(last.CreatedAt, last.ID)
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// exportFlushEvery is how many rows an export writes between flushes.
+const exportFlushEvery = 100
+
+// transactionExporter writes one export format a row at a time.
+type transactionExporter interface {
+	begin() error
+	row(t models.Transaction) error
+	flush() error
+	end() error
+}
+
+// ExportTransactions streams the user's transactions, oldest first, as csv,
+// json or ofx (format, default csv). It takes the same filters as
+// ListTransactions, without paging. Rows go out as they're read, so an
+// export never holds the account's history in memory; an error midway
+// truncates it.
+func ExportTransactions(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		format := strings.ToLower(c.DefaultQuery("format", "csv"))
+		if format != "csv" && format != "json" && format != "ofx" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv, json or ofx"})
+			return
+		}
+		where, args, ok := transactionFilters(c)
+		if !ok {
+			return
+		}
+
+		var exp transactionExporter
+		var contentType string
+		switch format {
+		case "csv":
+			exp, contentType = &csvExporter{w: csv.NewWriter(c.Writer)}, "text/csv; charset=utf-8"
+		case "json":
+			exp, contentType = &jsonExporter{w: c.Writer}, "application/json; charset=utf-8"
+		case "ofx":
+			o, ok := newOFXExporter(c, db, userID)
+			if !ok {
+				return
+			}
+			exp, contentType = o, "application/x-ofx"
+		}
+
+		rows, err := db.QueryContext(c, transactionsQuery(where, "created_at, id"), args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "transactions lookup failed"})
+			return
+		}
+		defer rows.Close()
+
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", `attachment; filename="transactions.`+format+`"`)
+		c.Status(http.StatusOK)
+
+		// Headers are out, so failures from here on can only cut the export short.
+		fail := func(err error) {
+			c.Error(err)
+			c.Abort()
+		}
+		if err := exp.begin(); err != nil {
+			fail(err)
+			return
+		}
+		n := 0
+		for rows.Next() {
+			t, err := scanTransaction(rows)
+			if err != nil {
+				fail(err)
+				return
+			}
+			if err := exp.row(t); err != nil {
+				fail(err)
+				return
+			}
+			if n++; n%exportFlushEvery == 0 {
+				if err := exp.flush(); err != nil {
+					fail(err)
+					return
+				}
+				c.Writer.Flush()
+			}
+		}
+		if err := rows.Err(); err != nil {
+			fail(err)
+			return
+		}
+		if err := exp.end(); err != nil {
+			fail(err)
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+func optional(d *decimal.Decimal) string {
+	if d == nil {
+		return ""
+	}
+	return d.String()
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) begin() error {
+	return e.w.Write([]string{"id", "created_at", "type", "symbol", "quantity", "price", "total_amount", "fee", "realized_pnl", "cash_balance"})
+}
+
+func (e *csvExporter) row(t models.Transaction) error {
+	symbol := ""
+	if t.Symbol != nil {
+		symbol = *t.Symbol
+	}
+	return e.w.Write([]string{
+		t.ID, t.CreatedAt.UTC().Format(time.RFC3339), t.Type, symbol, optional(t.Quantity), optional(t.Price),
+		t.TotalAmount.String(), t.Fee.String(), optional(t.RealizedPnL), t.CashBalance.String(),
+	})
+}
+
+func (e *csvExporter) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExporter) end() error { return e.flush() }
+
+// jsonExporter writes {"transactions": [...]}, one element at a time.
+type jsonExporter struct {
+	w    io.Writer
+	rows int
+}
+
+func (e *jsonExporter) begin() error {
+	_, err := io.WriteString(e.w, `{"transactions":[`)
+	return err
+}
+
+func (e *jsonExporter) row(t models.Transaction) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if e.rows > 0 {
+		b = append([]byte{','}, b...)
+	}
+	e.rows++
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *jsonExporter) flush() error { return nil }
+
+func (e *jsonExporter) end() error {
+	_, err := io.WriteString(e.w, "]}\n")
+	return err
+}
+
+// ofxExporter writes an OFX 2 bank statement of the cash account: each
+// transaction is signed by what it did to the account (buys, withdrawals,
+// fees and interest negative), with its quantity, price, fee, realized gain
+// and the running balance in the memo.
+type ofxExporter struct {
+	w        io.Writer
+	userID   string
+	from, to time.Time
+	balance  decimal.Decimal // Cash as of to
+}
+
+// newOFXExporter looks up the statement's range and closing balance, which
+// OFX wants around the transactions: from the filter's from, or when the
+// account opened, to its to, or now. On failure it writes the error
+// response and returns false.
+func newOFXExporter(c *gin.Context, db *sql.DB, userID string) (*ofxExporter, bool) {
+	e := &ofxExporter{w: c.Writer, userID: userID, to: time.Now()}
+	if raw := c.Query("to"); raw != "" {
+		e.to, _ = parseEndParam(raw) // transactionFilters has checked it
+	}
+	var opened time.Time
+	err := db.QueryRowContext(c, `
+		SELECT COALESCE(u.created_at, NOW()), COALESCE((
+			SELECT SUM(j.amount) FROM journal_lines j JOIN journal_entries e ON e.id = j.entry_id
+			WHERE j.user_id = u.id AND j.account='cash' AND j.asset='USD' AND e.created_at < $2), 0)
+		FROM users u WHERE u.id=$1`, userID, e.to).Scan(&opened, &e.balance)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "balance lookup failed"})
+		return nil, false
+	}
+	e.from = opened
+	if raw := c.Query("from"); raw != "" {
+		e.from, _ = parseTimeParam(raw)
+	}
+	return e, true
+}
+
+func ofxTime(t time.Time) string {
+	return t.UTC().Format("20060102150405.000") + "[0:GMT]"
+}
+
+func ofxEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (e *ofxExporter) begin() error {
+	now := ofxTime(time.Now())
+	_, err := fmt.Fprintf(e.w, `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<?OFX OFXHEADER="200" VERSION="211" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS><DTSERVER>%s</DTSERVER><LANGUAGE>ENG</LANGUAGE></SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1><STMTTRNRS><TRNUID>0</TRNUID><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>
+<STMTRS><CURDEF>USD</CURDEF>
+<BANKACCTFROM><BANKID>FLUX</BANKID><ACCTID>%s</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>
+<BANKTRANLIST><DTSTART>%s</DTSTART><DTEND>%s</DTEND>
+`, now, ofxEscape(e.userID), ofxTime(e.from), ofxTime(e.to))
+	return err
+}
+
+func (e *ofxExporter) row(t models.Transaction) error {
+	trnType, amount := "DEBIT", t.TotalAmount.Neg()
+	switch t.Type {
+	case "DEPOSIT":
+		trnType, amount = "DEP", t.TotalAmount
+	case "SELL":
+		trnType, amount = "CREDIT", t.TotalAmount
+	case "BORROW_FEE":
+		trnType = "FEE"
+	case "INTEREST":
+		trnType = "INT"
+	}
+	name := t.Type
+	var memo []string
+	if t.Symbol != nil {
+		name += " " + *t.Symbol
+	}
+	if t.Quantity != nil && t.Price != nil {
+		memo = append(memo, fmt.Sprintf("%s @ %s", *t.Quantity, *t.Price))
+	}
+	if !t.Fee.IsZero() {
+		memo = append(memo, "fee "+t.Fee.StringFixed(2))
+	}
+	if t.RealizedPnL != nil {
+		memo = append(memo, "realized "+t.RealizedPnL.StringFixed(2))
+	}
+	memo = append(memo, "balance "+t.CashBalance.StringFixed(2))
+	_, err := fmt.Fprintf(e.w,
+		"<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%s</TRNAMT><FITID>%s</FITID><NAME>%s</NAME><MEMO>%s</MEMO></STMTTRN>\n",
+		trnType, ofxTime(t.CreatedAt), amount.StringFixed(2), t.ID, ofxEscape(name), ofxEscape(strings.Join(memo, ", ")))
+	return err
+}
+
+func (e *ofxExporter) flush() error { return nil }
+
+func (e *ofxExporter) end() error {
+	_, err := fmt.Fprintf(e.w, `</BANKTRANLIST>
+<LEDGERBAL><BALAMT>%s</BALAMT><DTASOF>%s</DTASOF></LEDGERBAL>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`, e.balance.StringFixed(2), ofxTime(e.to))
+	return err
+}
@@ -0,0 +1,243 @@
+// Package instruments holds the trading rules of each symbol: the price tick,
+// the quantity lot, the smallest order by quantity and by value, and whether
+// fractional units trade at all. Orders that break a rule are refused the way
+// a venue would refuse them, with a code the client can act on.
+//
+// Symbols without rules of their own use their asset class's.
+package instruments
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/prices"
+)
+
+// Error codes returned to clients.
+const (
+	CodeTickSize      = "price_not_on_tick"
+	CodeLotSize       = "quantity_not_on_lot"
+	CodeMinQuantity   = "quantity_below_minimum"
+	CodeMinNotional   = "notional_below_minimum"
+	CodeNotFractional = "fractional_not_allowed"
+)
+
+// Violation is an order that breaks its symbol's rules.
+type Violation struct {
+	Code    string
+	Message string
+}
+
+func (v *Violation) Error() string { return v.Message }
+
+// Rules are one symbol's trading rules. A zero step or minimum doesn't apply.
+type Rules struct {
+	TickSize    decimal.Decimal `json:"tick_size"`    // Smallest price step
+	LotSize     decimal.Decimal `json:"lot_size"`     // Smallest quantity step
+	MinQuantity decimal.Decimal `json:"min_quantity"` // Smallest order quantity
+	MinNotional decimal.Decimal `json:"min_notional"` // Smallest order value in USD
+	Fractional  bool            `json:"fractional"`   // False trades whole units only
+}
+
+var one = decimal.FromInt(1)
+
+// lot is the quantity step, at least one unit when fractions don't trade.
+func (r Rules) lot() decimal.Decimal {
+	if !r.Fractional && r.LotSize.LessThan(one) {
+		return one
+	}
+	return r.LotSize
+}
+
+func (r Rules) validate() error {
+	if r.TickSize.IsNegative() || r.LotSize.IsNegative() || r.MinQuantity.IsNegative() || r.MinNotional.IsNegative() {
+		return fmt.Errorf("steps and minimums can't be negative")
+	}
+	if !r.Fractional && r.LotSize.TruncateTo(one) != r.LotSize {
+		return fmt.Errorf("lot_size %s needs fractional units", r.LotSize)
+	}
+	return nil
+}
+
+// DefaultClasses prices equities in cents with fractional shares to six
+// places, and crypto in cents to the satoshi. Both take orders from $1.
+var DefaultClasses = map[string]Rules{
+	prices.AssetEquity: {
+		TickSize: decimal.New(1, -2), LotSize: decimal.New(1, -6), MinQuantity: decimal.New(1, -6),
+		MinNotional: decimal.FromInt(1), Fractional: true,
+	},
+	prices.AssetCrypto: {
+		TickSize: decimal.New(1, -2), LotSize: decimal.New(1, -8), MinQuantity: decimal.New(1, -8),
+		MinNotional: decimal.FromInt(1), Fractional: true,
+	},
+}
+
+// DefaultSymbols covers coins that trade far below a dollar: finer ticks and
+// coarser lots.
+var DefaultSymbols = map[string]Rules{
+	"ADA":  subDollar(4, 2),
+	"ALGO": subDollar(4, 2),
+	"DOGE": subDollar(5, 2),
+	"GRT":  subDollar(4, 2),
+	"HBAR": subDollar(5, 2),
+	"MANA": subDollar(4, 2),
+	"SAND": subDollar(4, 2),
+	"SHIB": subDollar(8, 0),
+	"TRX":  subDollar(5, 2),
+	"VET":  subDollar(5, 2),
+	"XLM":  subDollar(5, 2),
+	"XRP":  subDollar(4, 2),
+}
+
+func subDollar(pricePlaces, quantityPlaces int32) Rules {
+	lot := decimal.New(1, -quantityPlaces)
+	return Rules{TickSize: decimal.New(1, -pricePlaces), LotSize: lot, MinQuantity: lot,
+		MinNotional: decimal.FromInt(1), Fractional: true}
+}
+
+// fallback applies when neither the symbol nor its class is listed: any
+// quantity and price the decimals can carry.
+var fallback = Rules{Fractional: true}
+
+// Config overrides the defaults, field by field: an entry only needs the
+// rules it changes.
+type Config struct {
+	Symbols map[string]Rules `json:"symbols"`
+	Classes map[string]Rules `json:"classes"`
+}
+
+// ParseConfig reads a JSON object such as
+// {"symbols":{"DOGE":{"tick_size":0.00001}},"classes":{"equity":{"fractional":false}}}.
+// Each entry starts from the rules it overrides.
+func ParseConfig(spec string) (Config, error) {
+	cfg := Config{Symbols: map[string]Rules{}, Classes: map[string]Rules{}}
+	if strings.TrimSpace(spec) == "" {
+		return cfg, nil
+	}
+	var raw struct {
+		Symbols map[string]json.RawMessage `json:"symbols"`
+		Classes map[string]json.RawMessage `json:"classes"`
+	}
+	if err := json.Unmarshal([]byte(spec), &raw); err != nil {
+		return cfg, fmt.Errorf("parse instrument rules: %w", err)
+	}
+	for sym, msg := range raw.Symbols {
+		sym = strings.ToUpper(sym)
+		r, ok := DefaultSymbols[sym]
+		if !ok {
+			r = fallback
+		}
+		if err := overlay(&r, msg); err != nil {
+			return cfg, fmt.Errorf("instrument rules for %s: %w", sym, err)
+		}
+		cfg.Symbols[sym] = r
+	}
+	for class, msg := range raw.Classes {
+		r, ok := DefaultClasses[class]
+		if !ok {
+			r = fallback
+		}
+		if err := overlay(&r, msg); err != nil {
+			return cfg, fmt.Errorf("instrument rules for %s: %w", class, err)
+		}
+		cfg.Classes[class] = r
+	}
+	return cfg, nil
+}
+
+func overlay(r *Rules, msg json.RawMessage) error {
+	if err := json.Unmarshal(msg, r); err != nil {
+		return err
+	}
+	return r.validate()
+}
+
+// Registry picks rules by symbol, then by asset class.
+type Registry struct {
+	symbols    map[string]Rules
+	classes    map[string]Rules
+	assetClass func(symbol string) string
+}
+
+// NewRegistry builds a registry from the defaults and cfg. assetClass
+// (normally prices.Feed.AssetClass) picks the class rules.
+func NewRegistry(cfg Config, assetClass func(symbol string) string) *Registry {
+	r := &Registry{symbols: make(map[string]Rules), classes: make(map[string]Rules), assetClass: assetClass}
+	for sym, rules := range DefaultSymbols {
+		r.symbols[sym] = rules
+	}
+	for sym, rules := range cfg.Symbols {
+		r.symbols[sym] = rules
+	}
+	for class, rules := range DefaultClasses {
+		r.classes[class] = rules
+	}
+	for class, rules := range cfg.Classes {
+		r.classes[class] = rules
+	}
+	return r
+}
+
+// Rules returns the symbol's rules. A nil registry has no rules to enforce.
+func (r *Registry) Rules(symbol string) Rules {
+	if r == nil {
+		return fallback
+	}
+	symbol = prices.NormalizeSymbol(symbol)
+	if rules, ok := r.symbols[symbol]; ok {
+		return rules
+	}
+	if r.assetClass != nil {
+		if rules, ok := r.classes[r.assetClass(symbol)]; ok {
+			return rules
+		}
+	}
+	return fallback
+}
+
+// Price rounds p to the symbol's tick.
+func (r *Registry) Price(symbol string, p decimal.Decimal) decimal.Decimal {
+	return p.RoundTo(r.Rules(symbol).TickSize)
+}
+
+// Quantity rounds q down to the symbol's lot, so a fill never exceeds what
+// was available.
+func (r *Registry) Quantity(symbol string, q decimal.Decimal) decimal.Decimal {
+	return q.TruncateTo(r.Rules(symbol).lot())
+}
+
+// CheckPrice refuses a client price off the symbol's tick.
+func (r *Registry) CheckPrice(symbol, field string, p decimal.Decimal) error {
+	tick := r.Rules(symbol).TickSize
+	if p.RoundTo(tick) != p {
+		return &Violation{CodeTickSize, fmt.Sprintf("%s %s is not a multiple of %s's %s tick", field, p, symbol, tick)}
+	}
+	return nil
+}
+
+// CheckQuantity refuses a quantity that is fractional where fractions don't
+// trade, off the lot, or under the minimum.
+func (r *Registry) CheckQuantity(symbol string, q decimal.Decimal) error {
+	rules := r.Rules(symbol)
+	if !rules.Fractional && q.TruncateTo(one) != q {
+		return &Violation{CodeNotFractional, fmt.Sprintf("%s trades in whole units only", symbol)}
+	}
+	if lot := rules.lot(); q.TruncateTo(lot) != q {
+		return &Violation{CodeLotSize, fmt.Sprintf("quantity %s is not a multiple of %s's %s lot", q, symbol, lot)}
+	}
+	if q.LessThan(rules.MinQuantity) {
+		return &Violation{CodeMinQuantity, fmt.Sprintf("quantity %s is below %s's minimum of %s", q, symbol, rules.MinQuantity)}
+	}
+	return nil
+}
+
+// CheckNotional refuses an order worth less than the symbol's minimum at price.
+func (r *Registry) CheckNotional(symbol string, q, price decimal.Decimal) error {
+	minimum := r.Rules(symbol).MinNotional
+	if notional := q.Mul(price); notional.LessThan(minimum) {
+		return &Violation{CodeMinNotional, fmt.Sprintf("order value $%s is below %s's minimum of $%s", notional, symbol, minimum)}
+	}
+	return nil
+}
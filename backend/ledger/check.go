@@ -0,0 +1,89 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+)
+
+// Querier is satisfied by *sql.DB and *sql.Tx.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// Discrepancy is a running total that disagrees with the journal. Amounts
+// carry the journal's signs, so a loan is negative.
+type Discrepancy struct {
+	UserID   string          `json:"user_id"`
+	Account  string          `json:"account"`
+	Asset    string          `json:"asset"`
+	Recorded decimal.Decimal `json:"recorded"` // wallets, holdings or margin_accounts
+	Journal  decimal.Decimal `json:"journal"`
+}
+
+// Report is the outcome of Check.
+type Report struct {
+	Balanced      bool          `json:"balanced"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	Unbalanced    []string      `json:"unbalanced_entries"` // Entries whose lines don't sum to zero
+}
+
+// Check recomputes every wallet, holding and loan from the journal and
+// reports the ones that disagree, along with any entry that doesn't balance.
+func Check(ctx context.Context, q Querier) (Report, error) {
+	r := Report{Discrepancies: []Discrepancy{}, Unbalanced: []string{}}
+	rows, err := q.QueryContext(ctx, `
+		WITH recorded AS (
+			SELECT user_id, 'cash' AS account, currency AS asset, balance AS amount FROM wallets
+			UNION ALL SELECT user_id, 'position', symbol, quantity FROM holdings
+			UNION ALL SELECT user_id, 'loan', 'USD', -loan_balance FROM margin_accounts
+		), journal AS (
+			SELECT user_id, account, asset, SUM(amount) AS amount FROM journal_lines
+			WHERE account IN ('cash', 'position', 'loan')
+			GROUP BY user_id, account, asset
+		)
+		SELECT COALESCE(r.user_id, j.user_id)::text, COALESCE(r.account, j.account), COALESCE(r.asset, j.asset),
+			COALESCE(r.amount, 0), COALESCE(j.amount, 0)
+		FROM recorded r
+		FULL JOIN journal j ON j.user_id = r.user_id AND j.account = r.account AND j.asset = r.asset
+		WHERE COALESCE(r.amount, 0) <> COALESCE(j.amount, 0)
+		ORDER BY 1, 2, 3`)
+	if err != nil {
+		return r, err
+	}
+	for rows.Next() {
+		var d Discrepancy
+		if err := rows.Scan(&d.UserID, &d.Account, &d.Asset, &d.Recorded, &d.Journal); err != nil {
+			rows.Close()
+			return r, err
+		}
+		r.Discrepancies = append(r.Discrepancies, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return r, err
+	}
+
+	rows, err = q.QueryContext(ctx, `
+		SELECT DISTINCT entry_id::text FROM journal_lines
+		GROUP BY entry_id, asset HAVING SUM(amount) <> 0
+		ORDER BY 1`)
+	if err != nil {
+		return r, err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return r, err
+		}
+		r.Unbalanced = append(r.Unbalanced, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return r, err
+	}
+	r.Balanced = len(r.Discrepancies) == 0 && len(r.Unbalanced) == 0
+	return r, nil
+}
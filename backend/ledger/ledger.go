@@ -0,0 +1,203 @@
+// Package ledger keeps the books. Every change to a user's cash, positions or
+// margin loan is posted here as a balanced journal entry, and only here.
+//
+// A line moves one account in one asset: USD or a symbol's units. Amounts are
+// signed debits, so cash, positions and expenses (fees, interest) grow with
+// positive amounts while the loan and equity (capital, trading) grow with
+// negative ones. Each entry's lines sum to zero in every asset. A trade
+// swaps cash for units through the trading account, which takes the units
+// in one asset and their cost in the other.
+//
+// wallets.balance, holdings.quantity and margin_accounts.loan_balance are
+// running totals of the cash, position and loan accounts. Post moves them
+// with the journal in the same transaction; Check recomputes them from it.
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/precision"
+)
+
+// Accounts.
+const (
+	Cash     = "cash"     // The USD wallet
+	Position = "position" // Units held, one asset per symbol; negative when short
+	Loan     = "loan"     // The margin loan
+	Fees     = "fees"     // Trading and borrow fees
+	Interest = "interest" // Margin loan interest
+	Capital  = "capital"  // Deposits, and balances from before the ledger
+	Trading  = "trading"  // The other side of trades
+)
+
+// Entry kinds.
+const (
+	KindOpening   = "opening"
+	KindDeposit   = "deposit"
+	KindBuy       = "buy"
+	KindSell      = "sell"
+	KindBorrow    = "borrow"
+	KindRepay     = "repay"
+	KindInterest  = "interest"
+	KindBorrowFee = "borrow_fee"
+)
+
+// USD is the asset of cash lines.
+const USD = "USD"
+
+var ErrUnbalanced = errors.New("journal entry does not balance")
+
+// Line is one account's movement in one asset.
+type Line struct {
+	Account string
+	Asset   string
+	Amount  decimal.Decimal
+}
+
+// Entry is a set of lines booked together.
+type Entry struct {
+	UserID string
+	Kind   string
+	Lines  []Line
+}
+
+// Post records the entry and moves the wallet, holdings and loan with it.
+// Lines of zero are dropped; an entry left with none is a no-op.
+func Post(ctx context.Context, tx *sql.Tx, e Entry) error {
+	lines, err := balance(e)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+
+	var entryID string
+	if err := tx.QueryRowContext(ctx,
+		`INSERT INTO journal_entries (user_id, kind) VALUES ($1, $2) RETURNING id`,
+		e.UserID, e.Kind).Scan(&entryID); err != nil {
+		return err
+	}
+	for _, l := range lines {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO journal_lines (entry_id, user_id, account, asset, amount) VALUES ($1, $2, $3, $4, $5)`,
+			entryID, e.UserID, l.Account, l.Asset, l.Amount); err != nil {
+			return err
+		}
+		if err := apply(ctx, tx, e.UserID, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// balance returns the entry's nonzero lines once they sum to zero in every
+// asset, with cash and the loan in whole cents.
+func balance(e Entry) ([]Line, error) {
+	lines := e.Lines[:0:0]
+	sums := make(map[string]decimal.Decimal)
+	for _, l := range e.Lines {
+		if l.Amount.IsZero() {
+			continue
+		}
+		if (l.Account == Cash || l.Account == Loan) && precision.Cash(l.Amount) != l.Amount {
+			return nil, fmt.Errorf("%s line of %s is not in whole cents", l.Account, l.Amount)
+		}
+		lines = append(lines, l)
+		sums[l.Asset] = sums[l.Asset].Add(l.Amount)
+	}
+	for asset, sum := range sums {
+		if !sum.IsZero() {
+			return nil, fmt.Errorf("%w: %s %s off in %s entry", ErrUnbalanced, asset, sum, e.Kind)
+		}
+	}
+	return lines, nil
+}
+
+// apply moves the running total the line's account keeps, if any.
+func apply(ctx context.Context, tx *sql.Tx, userID string, l Line) error {
+	var res sql.Result
+	var err error
+	switch l.Account {
+	case Cash:
+		res, err = tx.ExecContext(ctx,
+			`UPDATE wallets SET balance = balance + $1, updated_at=NOW() WHERE user_id=$2 AND currency=$3`,
+			l.Amount, userID, l.Asset)
+	case Position:
+		res, err = tx.ExecContext(ctx, `
+			INSERT INTO holdings (user_id, symbol, quantity) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, symbol) DO UPDATE SET quantity = holdings.quantity + EXCLUDED.quantity, updated_at=NOW()`,
+			userID, l.Asset, l.Amount)
+	case Loan:
+		res, err = tx.ExecContext(ctx,
+			`UPDATE margin_accounts SET loan_balance = loan_balance - $1 WHERE user_id=$2`,
+			l.Amount, userID)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no %s account for user %s", l.Account, userID)
+	}
+	return nil
+}
+
+// Deposit adds paid-in cash.
+func Deposit(ctx context.Context, tx *sql.Tx, userID string, amount decimal.Decimal) error {
+	return Post(ctx, tx, Entry{UserID: userID, Kind: KindDeposit, Lines: []Line{
+		{Cash, USD, amount},
+		{Capital, USD, amount.Neg()},
+	}})
+}
+
+// Trade books an execution: quantity units of symbol, positive when bought,
+// for notional plus fee on buys and notional less fee on sells.
+func Trade(ctx context.Context, tx *sql.Tx, userID, symbol string, quantity, notional, fee decimal.Decimal) error {
+	kind, cost := KindBuy, notional
+	if quantity.IsNegative() {
+		kind, cost = KindSell, notional.Neg()
+	}
+	return Post(ctx, tx, Entry{UserID: userID, Kind: kind, Lines: []Line{
+		{Position, symbol, quantity},
+		{Trading, symbol, quantity.Neg()},
+		{Trading, USD, cost},
+		{Fees, USD, fee},
+		{Cash, USD, cost.Add(fee).Neg()},
+	}})
+}
+
+// Borrow draws amount on the margin loan into cash.
+func Borrow(ctx context.Context, tx *sql.Tx, userID string, amount decimal.Decimal) error {
+	return Post(ctx, tx, Entry{UserID: userID, Kind: KindBorrow, Lines: []Line{
+		{Cash, USD, amount},
+		{Loan, USD, amount.Neg()},
+	}})
+}
+
+// Repay pays amount of the margin loan from cash.
+func Repay(ctx context.Context, tx *sql.Tx, userID string, amount decimal.Decimal) error {
+	return Post(ctx, tx, Entry{UserID: userID, Kind: KindRepay, Lines: []Line{
+		{Loan, USD, amount},
+		{Cash, USD, amount.Neg()},
+	}})
+}
+
+// AccrueInterest adds amount of interest to the margin loan.
+func AccrueInterest(ctx context.Context, tx *sql.Tx, userID string, amount decimal.Decimal) error {
+	return Post(ctx, tx, Entry{UserID: userID, Kind: KindInterest, Lines: []Line{
+		{Interest, USD, amount},
+		{Loan, USD, amount.Neg()},
+	}})
+}
+
+// Charge books a fee of kind, paid fromCash and, for the rest, fromLoan.
+func Charge(ctx context.Context, tx *sql.Tx, userID, kind string, fromCash, fromLoan decimal.Decimal) error {
+	return Post(ctx, tx, Entry{UserID: userID, Kind: kind, Lines: []Line{
+		{Fees, USD, fromCash.Add(fromLoan)},
+		{Cash, USD, fromCash.Neg()},
+		{Loan, USD, fromLoan.Neg()},
+	}})
+}
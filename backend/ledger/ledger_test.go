@@ -0,0 +1,190 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/sahniaditya/flux-backend/db/dbtest"
+	"github.com/sahniaditya/flux-backend/decimal"
+)
+
+var (
+	ctx = context.Background()
+	d   = decimal.MustParse
+)
+
+func TestBalance(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []Line
+		want  []Line
+		err   error
+	}{
+		{"empty", nil, nil, nil},
+		{"balanced", []Line{{Cash, USD, d("10")}, {Capital, USD, d("-10")}},
+			[]Line{{Cash, USD, d("10")}, {Capital, USD, d("-10")}}, nil},
+		{"zero lines dropped", []Line{{Cash, USD, d("10")}, {Fees, USD, d("0")}, {Capital, USD, d("-10")}},
+			[]Line{{Cash, USD, d("10")}, {Capital, USD, d("-10")}}, nil},
+		{"balanced per asset", []Line{
+			{Position, "AAPL", d("2")}, {Trading, "AAPL", d("-2")},
+			{Trading, USD, d("300")}, {Cash, USD, d("-300")},
+		}, []Line{
+			{Position, "AAPL", d("2")}, {Trading, "AAPL", d("-2")},
+			{Trading, USD, d("300")}, {Cash, USD, d("-300")},
+		}, nil},
+		{"unbalanced", []Line{{Cash, USD, d("10")}, {Capital, USD, d("-9.99")}}, nil, ErrUnbalanced},
+		{"balanced across assets only", []Line{{Position, "AAPL", d("2")}, {Cash, USD, d("-2")}}, nil, ErrUnbalanced},
+	}
+	for _, tt := range tests {
+		got, err := balance(Entry{Kind: KindDeposit, Lines: tt.lines})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err %v, want %v", tt.name, err, tt.err)
+		}
+		if tt.err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: lines %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBalanceWantsWholeCents(t *testing.T) {
+	for _, account := range []string{Cash, Loan} {
+		_, err := balance(Entry{Kind: KindBorrow, Lines: []Line{{account, USD, d("0.005")}, {Capital, USD, d("-0.005")}}})
+		if err == nil {
+			t.Errorf("%s line of 0.005 accepted", account)
+		}
+	}
+	// Units are not cash.
+	if _, err := balance(Entry{Kind: KindBuy, Lines: []Line{{Position, "BTC", d("0.005")}, {Trading, "BTC", d("-0.005")}}}); err != nil {
+		t.Errorf("fractional units refused: %v", err)
+	}
+}
+
+// discrepancies returns the report's discrepancies for one user, since the
+// test database may hold others.
+func discrepancies(r Report, userID string) []Discrepancy {
+	var out []Discrepancy
+	for _, d := range r.Discrepancies {
+		if d.UserID == userID {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func TestPostMovesBalances(t *testing.T) {
+	tx := dbtest.Tx(t)
+	userID := dbtest.User(t, tx, "0")
+
+	if err := Deposit(ctx, tx, userID, d("1000")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Trade(ctx, tx, userID, "AAPL", d("2"), d("300"), d("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	var cash, units decimal.Decimal
+	if err := tx.QueryRow(`SELECT balance FROM wallets WHERE user_id=$1`, userID).Scan(&cash); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.QueryRow(`SELECT quantity FROM holdings WHERE user_id=$1 AND symbol='AAPL'`, userID).Scan(&units); err != nil {
+		t.Fatal(err)
+	}
+	if cash != d("699") || units != d("2") {
+		t.Errorf("cash %s and %s AAPL, want 699 and 2", cash, units)
+	}
+
+	r, err := Check(ctx, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := discrepancies(r, userID); len(got) != 0 {
+		t.Errorf("discrepancies after posting: %+v", got)
+	}
+}
+
+func TestPostRefusesUnbalanced(t *testing.T) {
+	tx := dbtest.Tx(t)
+	userID := dbtest.User(t, tx, "0")
+
+	err := Post(ctx, tx, Entry{UserID: userID, Kind: KindDeposit, Lines: []Line{
+		{Cash, USD, d("10")},
+		{Capital, USD, d("-9")},
+	}})
+	if !errors.Is(err, ErrUnbalanced) {
+		t.Fatalf("err %v, want ErrUnbalanced", err)
+	}
+	var entries int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM journal_entries WHERE user_id=$1`, userID).Scan(&entries); err != nil {
+		t.Fatal(err)
+	}
+	var cash decimal.Decimal
+	if err := tx.QueryRow(`SELECT balance FROM wallets WHERE user_id=$1`, userID).Scan(&cash); err != nil {
+		t.Fatal(err)
+	}
+	if entries != 0 || !cash.IsZero() {
+		t.Errorf("refused entry left %d entries and cash %s", entries, cash)
+	}
+}
+
+func TestPostWantsAccount(t *testing.T) {
+	tx := dbtest.Tx(t)
+	userID := dbtest.User(t, tx, "0")
+
+	// No margin account, so nothing to borrow on.
+	if err := Borrow(ctx, tx, userID, d("100")); err == nil {
+		t.Error("borrowed without a margin account")
+	}
+}
+
+func TestCheckFindsDrift(t *testing.T) {
+	tx := dbtest.Tx(t)
+	userID := dbtest.User(t, tx, "0")
+	if err := Deposit(ctx, tx, userID, d("50")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`UPDATE wallets SET balance = balance + 1 WHERE user_id=$1`, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Check(ctx, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Discrepancy{{UserID: userID, Account: Cash, Asset: USD, Recorded: d("51"), Journal: d("50")}}
+	if got := discrepancies(r, userID); !reflect.DeepEqual(got, want) {
+		t.Errorf("discrepancies %+v, want %+v", got, want)
+	}
+	if r.Balanced {
+		t.Error("report balanced with a drifted wallet")
+	}
+}
+
+func TestCheckFindsUnbalancedEntry(t *testing.T) {
+	tx := dbtest.Tx(t)
+	userID := dbtest.User(t, tx, "0")
+
+	// Written around Post, as a bug or a hand edit might.
+	var entryID string
+	if err := tx.QueryRow(`INSERT INTO journal_entries (user_id, kind) VALUES ($1, 'deposit') RETURNING id`,
+		userID).Scan(&entryID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`INSERT INTO journal_lines (entry_id, user_id, account, asset, amount) VALUES ($1, $2, 'capital', 'USD', -5)`,
+		entryID, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Check(ctx, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(r.Unbalanced, entryID) {
+		t.Errorf("unbalanced %v, want %s among them", r.Unbalanced, entryID)
+	}
+	if r.Balanced {
+		t.Error("report balanced with an unbalanced entry")
+	}
+}
@@ -0,0 +1,298 @@
+// Package lots tracks tax lots. Every fill that opens or adds to a position
+// opens a lot; every fill that reduces one closes lots, partly or wholly,
+// and records the gain or loss realized on each.
+//
+// Which lots close first is the user's lot method: FIFO (oldest first),
+// LIFO (newest first) or HIFO (dearest first, realizing the least gain: the
+// highest cost per unit for longs, the lowest proceeds per unit for shorts).
+// A trade may instead name the lots to close.
+//
+// A fill's cash, fees included, is split across the lots it closes and the
+// lot it opens in proportion to quantity, so the lots' cost always adds up
+// to what was paid.
+package lots
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+)
+
+// Lot methods.
+const (
+	FIFO = "fifo"
+	LIFO = "lifo"
+	HIFO = "hifo"
+)
+
+var (
+	ErrLotNotFound = errors.New("lot not found")
+	ErrLotsShort   = errors.New("the selected lots don't cover the trade")
+)
+
+// IsUserError reports whether err is a lot selection the client should see as a 400.
+func IsUserError(err error) bool {
+	return errors.Is(err, ErrLotNotFound) || errors.Is(err, ErrLotsShort)
+}
+
+// Fill is one execution to book against the lots.
+type Fill struct {
+	UserID        string
+	Symbol        string
+	TransactionID string
+	Quantity      decimal.Decimal // Positive for buys, negative for sells
+	Cash          decimal.Decimal // Paid on buys, received on sells, fees included
+	LotIDs        []string        // Lots to close, in order; empty uses the user's method
+}
+
+// Result is what a fill left behind.
+type Result struct {
+	Realized decimal.Decimal // Gain or loss on the lots it closed
+	Open     decimal.Decimal // Units still open, always positive
+	Cost     decimal.Decimal // What the open units cost, or for shorts raised
+}
+
+type lot struct {
+	id        string
+	side      string
+	remaining decimal.Decimal
+	cost      decimal.Decimal
+}
+
+// closure is the part of one lot a fill closes.
+type closure struct {
+	lot      lot
+	quantity decimal.Decimal
+	basis    decimal.Decimal // The share of the lot's cost that closes
+	cost     decimal.Decimal
+	proceeds decimal.Decimal
+	pnl      decimal.Decimal
+}
+
+// Book closes the lots the fill reduces and opens one for whatever it adds.
+func Book(ctx context.Context, tx *sql.Tx, f Fill) (Result, error) {
+	var res Result
+	side := "long"
+	if f.Quantity.IsNegative() {
+		side = "short"
+	}
+	open, err := load(ctx, tx, f.UserID, f.Symbol)
+	if err != nil {
+		return res, err
+	}
+	var method string
+	if len(f.LotIDs) == 0 && len(opposite(open, side)) > 1 {
+		if method, err = Method(ctx, tx, f.UserID); err != nil {
+			return res, err
+		}
+	}
+	closing, err := choose(f, side, open, method)
+	if err != nil {
+		return res, err
+	}
+	closures, openQty, openCost, err := allocate(f, open, closing)
+	if err != nil {
+		return res, err
+	}
+
+	for _, c := range closures {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE tax_lots SET remaining = remaining - $1, cost = cost - $2,
+				closed_at = CASE WHEN remaining = $1 THEN NOW() END
+			WHERE id=$3`, c.quantity, c.basis, c.lot.id); err != nil {
+			return res, err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO lot_closures (lot_id, transaction_id, user_id, symbol, quantity, cost_basis, proceeds, realized_pnl)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			c.lot.id, nullable(f.TransactionID), f.UserID, f.Symbol, c.quantity, c.cost, c.proceeds, c.pnl); err != nil {
+			return res, err
+		}
+		res.Realized = res.Realized.Add(c.pnl)
+	}
+
+	if openQty.IsPositive() {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO tax_lots (user_id, symbol, side, quantity, remaining, cost, transaction_id)
+			VALUES ($1, $2, $3, $4, $4, $5, $6)`,
+			f.UserID, f.Symbol, side, openQty, openCost, nullable(f.TransactionID)); err != nil {
+			return res, err
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(remaining), 0), COALESCE(SUM(cost), 0) FROM tax_lots
+		WHERE user_id=$1 AND symbol=$2 AND remaining > 0`,
+		f.UserID, f.Symbol).Scan(&res.Open, &res.Cost)
+	return res, err
+}
+
+// load locks the open lots, oldest first.
+func load(ctx context.Context, tx *sql.Tx, userID, symbol string) ([]lot, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, side, remaining, cost FROM tax_lots
+		WHERE user_id=$1 AND symbol=$2 AND remaining > 0
+		ORDER BY opened_at, id
+		FOR UPDATE`, userID, symbol)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var open []lot
+	for rows.Next() {
+		var l lot
+		if err := rows.Scan(&l.id, &l.side, &l.remaining, &l.cost); err != nil {
+			return nil, err
+		}
+		open = append(open, l)
+	}
+	return open, rows.Err()
+}
+
+// opposite returns the open lots a fill on side closes, oldest first.
+func opposite(open []lot, side string) []lot {
+	var out []lot
+	for _, l := range open {
+		if l.side != side {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// choose orders the lots a fill on side closes: the ones it names, or every
+// lot on the other side by method.
+func choose(f Fill, side string, open []lot, method string) ([]lot, error) {
+	if len(f.LotIDs) > 0 {
+		byID := make(map[string]lot, len(open))
+		for _, l := range opposite(open, side) {
+			byID[l.id] = l
+		}
+		closing := make([]lot, 0, len(f.LotIDs))
+		for _, id := range f.LotIDs {
+			l, ok := byID[id]
+			if !ok {
+				return nil, fmt.Errorf("%w: no open %s lot %s this trade can close", ErrLotNotFound, f.Symbol, id)
+			}
+			closing = append(closing, l)
+			delete(byID, id)
+		}
+		return closing, nil
+	}
+
+	closing := opposite(open, side)
+	switch method {
+	case LIFO:
+		for i, j := 0, len(closing)-1; i < j; i, j = i+1, j-1 {
+			closing[i], closing[j] = closing[j], closing[i]
+		}
+	case HIFO:
+		// Compare unit costs by cross-multiplying, which stays exact.
+		sort.SliceStable(closing, func(i, j int) bool {
+			a := closing[i].cost.Mul(closing[j].remaining)
+			b := closing[j].cost.Mul(closing[i].remaining)
+			if closing[i].side == "short" {
+				return a.LessThan(b)
+			}
+			return a.GreaterThan(b)
+		})
+	}
+	return closing, nil
+}
+
+// allocate splits the fill across the closing lots, in order, and returns
+// the closures and the quantity and cost of the lot left to open. The fill's
+// cash is shared in proportion to quantity, the last share taking what's
+// left, so the closures' cash and the opened cost add up to it exactly.
+// Named lots that fall short of the fill while other lots could close are
+// ErrLotsShort, rather than opening a lot on the other side.
+func allocate(f Fill, open, closing []lot) (closures []closure, openQty, openCost decimal.Decimal, err error) {
+	qtyLeft, cashLeft := f.Quantity.Abs(), f.Cash
+	for _, l := range closing {
+		if !qtyLeft.IsPositive() {
+			break
+		}
+		take := decimal.Min(qtyLeft, l.remaining)
+		basis := l.cost
+		if take != l.remaining {
+			basis = l.cost.Mul(take).Div(l.remaining)
+		}
+		cash := cashLeft
+		if take != qtyLeft {
+			cash = cashLeft.Mul(take).Div(qtyLeft)
+		}
+		// Selling closes longs: the cash is the proceeds. Buying closes
+		// shorts: the cash is the cost, and the lot's cost is what it raised.
+		cost, proceeds := basis, cash
+		if l.side == "short" {
+			cost, proceeds = cash, basis
+		}
+		closures = append(closures, closure{lot: l, quantity: take, basis: basis, cost: cost, proceeds: proceeds, pnl: proceeds.Sub(cost)})
+		qtyLeft, cashLeft = qtyLeft.Sub(take), cashLeft.Sub(cash)
+	}
+
+	if qtyLeft.IsPositive() && len(f.LotIDs) > 0 {
+		side := "long"
+		if f.Quantity.IsNegative() {
+			side = "short"
+		}
+		closed := f.Quantity.Abs().Sub(qtyLeft)
+		if remainingOpposite(open, side).GreaterThan(closed) {
+			return nil, decimal.Zero, decimal.Zero, fmt.Errorf("%w: %s more to close", ErrLotsShort, qtyLeft)
+		}
+	}
+	return closures, qtyLeft, cashLeft, nil
+}
+
+func remainingOpposite(open []lot, side string) decimal.Decimal {
+	total := decimal.Zero
+	for _, l := range opposite(open, side) {
+		total = total.Add(l.remaining)
+	}
+	return total
+}
+
+// Querier is satisfied by *sql.DB and *sql.Tx.
+type Querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Method returns the user's lot method.
+func Method(ctx context.Context, q Querier, userID string) (string, error) {
+	var method string
+	err := q.QueryRowContext(ctx, `SELECT lot_method FROM users WHERE id=$1`, userID).Scan(&method)
+	return method, err
+}
+
+func nullable(id string) sql.NullString {
+	return sql.NullString{String: id, Valid: id != ""}
+}
+
+// Closed summarizes the lot closures since from: how many there were, how
+// many gained and lost, and the average gain and loss.
+type Closed struct {
+	Count       int
+	Wins        int
+	Losses      int
+	AverageWin  decimal.Decimal
+	AverageLoss decimal.Decimal // Negative
+}
+
+// ClosedSince summarizes the user's lot closures since from.
+func ClosedSince(ctx context.Context, q Querier, userID string, from time.Time) (Closed, error) {
+	var c Closed
+	err := q.QueryRowContext(ctx, `
+		SELECT COUNT(*),
+			COUNT(*) FILTER (WHERE realized_pnl > 0),
+			COUNT(*) FILTER (WHERE realized_pnl < 0),
+			COALESCE(AVG(realized_pnl) FILTER (WHERE realized_pnl > 0), 0),
+			COALESCE(AVG(realized_pnl) FILTER (WHERE realized_pnl < 0), 0)
+		FROM lot_closures WHERE user_id=$1 AND closed_at >= $2`, userID, from).
+		Scan(&c.Count, &c.Wins, &c.Losses, &c.AverageWin, &c.AverageLoss)
+	return c, err
+}
@@ -0,0 +1,253 @@
+package lots
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+)
+
+var d = decimal.MustParse
+
+// Three long lots bought at 10, 30 and 20 a unit, oldest first.
+func longLots() []lot {
+	return []lot{
+		{id: "a", side: "long", remaining: d("10"), cost: d("100")},
+		{id: "b", side: "long", remaining: d("5"), cost: d("150")},
+		{id: "c", side: "long", remaining: d("10"), cost: d("200")},
+	}
+}
+
+func ids(lots []lot) string {
+	s := ""
+	for _, l := range lots {
+		s += l.id
+	}
+	return s
+}
+
+func TestChooseMethods(t *testing.T) {
+	sell := Fill{Symbol: "AAPL", Quantity: d("-12"), Cash: d("240")}
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{FIFO, "abc"},
+		{"", "abc"},
+		{LIFO, "cba"},
+		{HIFO, "bca"}, // 30, then 20, then 10 a unit
+	}
+	for _, tt := range tests {
+		closing, err := choose(sell, "short", longLots(), tt.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(closing); got != tt.want {
+			t.Errorf("%q closes %s, want %s", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestChooseHIFOShorts(t *testing.T) {
+	// Covering shorts closes the one that raised least a unit first: HIFO
+	// realizes the least gain either way.
+	shorts := []lot{
+		{id: "a", side: "short", remaining: d("4"), cost: d("200")}, // 50 a unit
+		{id: "b", side: "short", remaining: d("3"), cost: d("120")}, // 40
+		{id: "c", side: "short", remaining: d("2"), cost: d("90")},  // 45
+	}
+	closing, err := choose(Fill{Quantity: d("5")}, "long", shorts, HIFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(closing); got != "bca" {
+		t.Errorf("HIFO covers %s, want bca", got)
+	}
+}
+
+func TestChooseSkipsSameSide(t *testing.T) {
+	// A buy never closes long lots.
+	closing, err := choose(Fill{Quantity: d("5")}, "long", longLots(), FIFO)
+	if err != nil || len(closing) != 0 {
+		t.Errorf("buy closes %q, %v", ids(closing), err)
+	}
+}
+
+func TestChooseSpecificLots(t *testing.T) {
+	f := Fill{Symbol: "AAPL", Quantity: d("-12"), LotIDs: []string{"c", "a"}}
+	closing, err := choose(f, "short", longLots(), FIFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(closing); got != "ca" {
+		t.Errorf("named lots close as %s, want ca", got)
+	}
+
+	f.LotIDs = []string{"a", "z"}
+	if _, err := choose(f, "short", longLots(), FIFO); !errors.Is(err, ErrLotNotFound) {
+		t.Errorf("unknown lot: %v, want ErrLotNotFound", err)
+	}
+	f.LotIDs = []string{"a", "a"}
+	if _, err := choose(f, "short", longLots(), FIFO); !errors.Is(err, ErrLotNotFound) {
+		t.Errorf("lot named twice: %v, want ErrLotNotFound", err)
+	}
+	if !IsUserError(ErrLotNotFound) || !IsUserError(ErrLotsShort) {
+		t.Error("lot errors should be user errors")
+	}
+}
+
+func TestAllocateFIFO(t *testing.T) {
+	// Sell 12 for 300: all of a and 2 of b.
+	f := Fill{Quantity: d("-12"), Cash: d("300")}
+	open := longLots()
+	closing, _ := choose(f, "short", open, FIFO)
+	closures, openQty, openCost, err := allocate(f, open, closing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		id                              string
+		qty, basis, cost, proceeds, pnl string
+	}{
+		{"a", "10", "100", "100", "250", "150"},
+		{"b", "2", "60", "60", "50", "-10"},
+	}
+	if len(closures) != len(want) {
+		t.Fatalf("%d closures, want %d", len(closures), len(want))
+	}
+	for i, w := range want {
+		c := closures[i]
+		if c.lot.id != w.id || c.quantity != d(w.qty) || c.basis != d(w.basis) ||
+			c.cost != d(w.cost) || c.proceeds != d(w.proceeds) || c.pnl != d(w.pnl) {
+			t.Errorf("closure %d = %s %s basis %s cost %s proceeds %s pnl %s, want %+v",
+				i, c.lot.id, c.quantity, c.basis, c.cost, c.proceeds, c.pnl, w)
+		}
+	}
+	if !openQty.IsZero() || !openCost.IsZero() {
+		t.Errorf("opens %s for %s, want nothing", openQty, openCost)
+	}
+}
+
+func TestAllocatePartialClose(t *testing.T) {
+	// Selling 3 of a lot of 7 that cost 100 closes 3/7 of its cost.
+	open := []lot{{id: "a", side: "long", remaining: d("7"), cost: d("100")}}
+	f := Fill{Quantity: d("-3"), Cash: d("50")}
+	closures, openQty, _, err := allocate(f, open, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := closures[0]
+	if c.quantity != d("3") || c.basis != d("42.85714286") || c.pnl != d("7.14285714") {
+		t.Errorf("closed %s basis %s pnl %s", c.quantity, c.basis, c.pnl)
+	}
+	if !openQty.IsZero() {
+		t.Errorf("opens %s", openQty)
+	}
+	// What's left on the lot is its cost less the basis, so nothing is lost.
+	if left := open[0].cost.Sub(c.basis); left.Add(c.basis) != open[0].cost {
+		t.Errorf("lot cost %s doesn't split into %s + %s", open[0].cost, c.basis, left)
+	}
+}
+
+func TestAllocateFlip(t *testing.T) {
+	// Long 10 at 10; sell 15 for 180. Ten close the long, five open a short
+	// that raised the rest of the cash.
+	open := []lot{{id: "a", side: "long", remaining: d("10"), cost: d("100")}}
+	f := Fill{Quantity: d("-15"), Cash: d("180")}
+	closing, _ := choose(f, "short", open, FIFO)
+	closures, openQty, openCost, err := allocate(f, open, closing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closures) != 1 || closures[0].proceeds != d("120") || closures[0].pnl != d("20") {
+		t.Fatalf("closures %+v", closures)
+	}
+	if openQty != d("5") || openCost != d("60") {
+		t.Errorf("opens %s short for %s, want 5 for 60", openQty, openCost)
+	}
+
+	// And back: cover 8 of a 5-unit short for 64 (fees in) and go long 3.
+	shorts := []lot{{id: "s", side: "short", remaining: d("5"), cost: d("60")}}
+	f = Fill{Quantity: d("8"), Cash: d("64")}
+	closing, _ = choose(f, "long", shorts, FIFO)
+	closures, openQty, openCost, err = allocate(f, shorts, closing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := closures[0]
+	if c.cost != d("40") || c.proceeds != d("60") || c.pnl != d("20") {
+		t.Errorf("cover cost %s proceeds %s pnl %s, want 40, 60, 20", c.cost, c.proceeds, c.pnl)
+	}
+	if openQty != d("3") || openCost != d("24") {
+		t.Errorf("opens %s long for %s, want 3 for 24", openQty, openCost)
+	}
+}
+
+func TestAllocateLotsShort(t *testing.T) {
+	// Naming only lot b (5 units) for a 12-unit sale while a and c could
+	// cover it is refused, not turned into a short.
+	open := longLots()
+	f := Fill{Symbol: "AAPL", Quantity: d("-12"), Cash: d("240"), LotIDs: []string{"b"}}
+	closing, err := choose(f, "short", open, FIFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := allocate(f, open, closing); !errors.Is(err, ErrLotsShort) {
+		t.Errorf("err = %v, want ErrLotsShort", err)
+	}
+
+	// Naming every lot and selling past them all flips short as usual.
+	f.Quantity, f.LotIDs = d("-30"), []string{"a", "b", "c"}
+	closing, _ = choose(f, "short", open, FIFO)
+	_, openQty, _, err := allocate(f, open, closing)
+	if err != nil || openQty != d("5") {
+		t.Errorf("opens %s, %v; want 5 short", openQty, err)
+	}
+}
+
+// The closures' cash and the opened lot's cost always add up to what the
+// fill paid or received, however awkwardly the quantities divide it.
+func TestAllocateConservesCash(t *testing.T) {
+	thirds := []lot{
+		{id: "a", side: "long", remaining: d("3"), cost: d("10")},
+		{id: "b", side: "long", remaining: d("7"), cost: d("33.33")},
+		{id: "c", side: "long", remaining: d("0.33333333"), cost: d("1.01")},
+	}
+	fills := []Fill{
+		{Quantity: d("-3"), Cash: d("100")},
+		{Quantity: d("-10.33333333"), Cash: d("99.99")},
+		{Quantity: d("-11"), Cash: d("100.01")},
+		{Quantity: d("-4.5"), Cash: d("33.33")},
+		{Quantity: d("-0.00000001"), Cash: d("0.01")},
+		{Quantity: d("-9"), Cash: d("0")},
+		{Quantity: d("2"), Cash: d("7.77")}, // adds, closing nothing
+	}
+	for _, method := range []string{FIFO, LIFO, HIFO} {
+		for _, f := range fills {
+			side := "long"
+			if f.Quantity.IsNegative() {
+				side = "short"
+			}
+			closing, err := choose(f, side, thirds, method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			closures, openQty, openCost, err := allocate(f, thirds, closing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			qty, cash := openQty, openCost
+			for _, c := range closures {
+				qty = qty.Add(c.quantity)
+				cash = cash.Add(c.proceeds) // closing longs: the cash is the proceeds
+				if c.quantity.GreaterThan(c.lot.remaining) || c.basis.GreaterThan(c.lot.cost) {
+					t.Errorf("%s %s: closes %s of %s for %s of %s",
+						method, f.Quantity, c.quantity, c.lot.remaining, c.basis, c.lot.cost)
+				}
+			}
+			if qty != f.Quantity.Abs() || cash != f.Cash {
+				t.Errorf("%s %s for %s: books %s for %s", method, f.Quantity, f.Cash, qty, cash)
+			}
+		}
+	}
+}
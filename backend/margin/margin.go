@@ -0,0 +1,334 @@
+// Package margin implements margin accounts: short selling and leveraged
+// longs against posted equity, with initial and maintenance requirements.
+//
+// Equity is cash less the loan plus the market value of every position,
+// shorts counting negative. A trade that grows gross exposure (longs plus
+// absolute shorts) must leave it within the account's limit: max_leverage
+// times equity, and never more than equity over initial_margin. Buys that
+// outrun the cash borrow the difference; sale proceeds and deposits repay it.
+// An account whose equity falls below maintenance_margin of gross exposure
+// is in a margin call until it recovers or is liquidated, and may only
+// reduce exposure meanwhile.
+package margin
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/ledger"
+)
+
+var (
+	DefaultInitial     = decimal.New(5, -1)
+	DefaultMaintenance = decimal.New(25, -2)
+	DefaultLeverage    = decimal.FromInt(2)
+)
+
+var (
+	ErrInsufficientMargin = errors.New("insufficient margin")
+	ErrMarginCall         = errors.New("account is in a margin call; only trades that reduce exposure are allowed")
+	ErrPriceUnavailable   = errors.New("price unavailable")
+)
+
+// Querier is satisfied by *sql.DB and *sql.Tx.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Quote prices a symbol, usually the feed's GetPrice.
+type Quote func(symbol string) (decimal.Decimal, error)
+
+// Prequote quotes every symbol the user's margin account holds and returns
+// a Quote that answers from those prices, so checks made later under the
+// wallet and account row locks don't wait on the feed while holding them.
+// Symbols it didn't see, such as one the account has since opened, are
+// quoted live. Cash accounts have nothing to quote.
+func Prequote(ctx context.Context, q Querier, userID string, quote Quote) (Quote, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT h.symbol FROM holdings h JOIN margin_accounts m ON m.user_id = h.user_id
+		WHERE h.user_id=$1 AND h.quantity <> 0`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var symbols []string
+	for rows.Next() {
+		var symbol string
+		if err := rows.Scan(&symbol); err != nil {
+			return nil, err
+		}
+		symbols = append(symbols, symbol)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	type quoted struct {
+		price decimal.Decimal
+		err   error
+	}
+	prices := make(map[string]quoted, len(symbols))
+	for _, symbol := range symbols {
+		price, err := quote(symbol)
+		prices[symbol] = quoted{price, err}
+	}
+	return func(symbol string) (decimal.Decimal, error) {
+		if p, ok := prices[symbol]; ok {
+			return p.price, p.err
+		}
+		return quote(symbol)
+	}, nil
+}
+
+// Account is a user's margin settings and state.
+type Account struct {
+	UserID       string
+	Initial      decimal.Decimal
+	Maintenance  decimal.Decimal
+	MaxLeverage  decimal.Decimal
+	Loan         decimal.Decimal
+	MarginCallAt *time.Time
+}
+
+const accountColumns = `initial_margin, maintenance_margin, max_leverage, loan_balance, margin_call_at`
+
+// Load returns the user's margin account, or nil for a cash account.
+func Load(ctx context.Context, q Querier, userID string) (*Account, error) {
+	return load(ctx, q, `SELECT `+accountColumns+` FROM margin_accounts WHERE user_id=$1`, userID)
+}
+
+// Lock is Load that also locks the account row for the sweep.
+func Lock(ctx context.Context, tx *sql.Tx, userID string) (*Account, error) {
+	return load(ctx, tx, `SELECT `+accountColumns+` FROM margin_accounts WHERE user_id=$1 FOR UPDATE`, userID)
+}
+
+func load(ctx context.Context, q Querier, query, userID string) (*Account, error) {
+	a := Account{UserID: userID}
+	var callAt sql.NullTime
+	err := q.QueryRowContext(ctx, query, userID).Scan(&a.Initial, &a.Maintenance, &a.MaxLeverage, &a.Loan, &callAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if callAt.Valid {
+		a.MarginCallAt = &callAt.Time
+	}
+	return &a, nil
+}
+
+// Position is an open position marked at the current price.
+type Position struct {
+	Symbol   string
+	Quantity decimal.Decimal // negative for shorts
+	Price    decimal.Decimal
+}
+
+// Value is the signed market value of the position.
+func (p Position) Value() decimal.Decimal {
+	return p.Quantity.Mul(p.Price)
+}
+
+// Summary is an account marked to market.
+type Summary struct {
+	Cash       decimal.Decimal
+	Loan       decimal.Decimal
+	LongValue  decimal.Decimal
+	ShortValue decimal.Decimal // absolute
+	Positions  []Position
+}
+
+// Equity is cash less the loan, plus longs minus shorts.
+func (s Summary) Equity() decimal.Decimal {
+	return s.Cash.Sub(s.Loan).Add(s.LongValue).Sub(s.ShortValue)
+}
+
+// Gross is total exposure: longs plus absolute shorts.
+func (s Summary) Gross() decimal.Decimal {
+	return s.LongValue.Add(s.ShortValue)
+}
+
+// Evaluate marks the user's cash and positions to market.
+func Evaluate(ctx context.Context, q Querier, userID string, quote Quote) (Summary, error) {
+	var s Summary
+	if err := q.QueryRowContext(ctx, `
+		SELECT w.balance, COALESCE(m.loan_balance, 0)
+		FROM wallets w LEFT JOIN margin_accounts m ON m.user_id = w.user_id
+		WHERE w.user_id=$1 AND w.currency='USD'`, userID).Scan(&s.Cash, &s.Loan); err != nil {
+		return s, err
+	}
+
+	rows, err := q.QueryContext(ctx,
+		`SELECT symbol, quantity FROM holdings WHERE user_id=$1 AND quantity <> 0 ORDER BY symbol`, userID)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Position
+		if err := rows.Scan(&p.Symbol, &p.Quantity); err != nil {
+			return s, err
+		}
+		s.Positions = append(s.Positions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+
+	for i := range s.Positions {
+		p := &s.Positions[i]
+		price, err := quote(p.Symbol)
+		if err != nil || !price.IsPositive() {
+			return s, fmt.Errorf("%w for %s", ErrPriceUnavailable, p.Symbol)
+		}
+		p.Price = price
+		s.add(p.Value())
+	}
+	return s, nil
+}
+
+func (s *Summary) add(value decimal.Decimal) {
+	if value.IsNegative() {
+		s.ShortValue = s.ShortValue.Sub(value)
+	} else {
+		s.LongValue = s.LongValue.Add(value)
+	}
+}
+
+// Apply returns the summary as it would look after trading quantity of
+// symbol at price with the given fee.
+func (s Summary) Apply(side, symbol string, quantity, price, fee decimal.Decimal) Summary {
+	out := Summary{Cash: s.Cash, Loan: s.Loan}
+	delta := quantity
+	if side == "sell" {
+		delta = quantity.Neg()
+		out.Cash = out.Cash.Add(quantity.Mul(price)).Sub(fee)
+	} else {
+		out.Cash = out.Cash.Sub(quantity.Mul(price)).Sub(fee)
+	}
+
+	found := false
+	for _, p := range s.Positions {
+		if p.Symbol == symbol {
+			p.Quantity = p.Quantity.Add(delta)
+			p.Price = price
+			found = true
+		}
+		out.Positions = append(out.Positions, p)
+	}
+	if !found {
+		out.Positions = append(out.Positions, Position{Symbol: symbol, Quantity: delta, Price: price})
+	}
+	for _, p := range out.Positions {
+		out.add(p.Value())
+	}
+	return out
+}
+
+// GrossLimit is the most gross exposure the account may carry on equity.
+func (a *Account) GrossLimit(equity decimal.Decimal) decimal.Decimal {
+	leverage := a.MaxLeverage
+	if a.Initial.IsPositive() {
+		leverage = decimal.Min(leverage, decimal.FromInt(1).Div(a.Initial))
+	}
+	return decimal.Max(leverage.Mul(equity), decimal.Zero)
+}
+
+// BuyingPower is how much more gross exposure the account may add.
+func (a *Account) BuyingPower(s Summary) decimal.Decimal {
+	return decimal.Max(a.GrossLimit(s.Equity()).Sub(s.Gross()), decimal.Zero)
+}
+
+// Utilization is the share of the gross limit in use; 1 or more means the
+// account can only reduce exposure.
+func (a *Account) Utilization(s Summary) decimal.Decimal {
+	limit := a.GrossLimit(s.Equity())
+	if !limit.IsPositive() {
+		if s.Gross().IsPositive() {
+			return decimal.FromInt(1)
+		}
+		return decimal.Zero
+	}
+	return s.Gross().Div(limit)
+}
+
+// CheckTrade verifies the account can take the trade. Trades that don't add
+// gross exposure are always allowed so an account can trade its way out of
+// trouble; others must stay within the gross limit afterwards.
+func (a *Account) CheckTrade(ctx context.Context, q Querier, side, symbol string, quantity, price, fee decimal.Decimal, quote Quote) error {
+	// The traded symbol is marked at the trade price, the rest at the quote.
+	before, err := Evaluate(ctx, q, a.UserID, func(s string) (decimal.Decimal, error) {
+		if s == symbol {
+			return price, nil
+		}
+		return quote(s)
+	})
+	if err != nil {
+		return err
+	}
+	after := before.Apply(side, symbol, quantity, price, fee)
+	if after.Gross().Cmp(before.Gross()) <= 0 {
+		return nil
+	}
+	if a.MarginCallAt != nil {
+		return ErrMarginCall
+	}
+	if limit := a.GrossLimit(after.Equity()); after.Gross().GreaterThan(limit) {
+		return fmt.Errorf("%w (buying power $%.2f, trade needs $%.2f)",
+			ErrInsufficientMargin, a.BuyingPower(before), after.Gross().Sub(before.Gross()).RoundUp(2))
+	}
+	return nil
+}
+
+// Borrow lends the account amount, crediting it to the wallet so a buy can
+// settle against it.
+func Borrow(ctx context.Context, tx *sql.Tx, userID string, amount decimal.Decimal) error {
+	if !amount.IsPositive() {
+		return nil
+	}
+	return ledger.Borrow(ctx, tx, userID, amount)
+}
+
+// Repay pays down the loan from cash that no pending order holds. It returns
+// the amount repaid and is a no-op for cash accounts.
+func Repay(ctx context.Context, tx *sql.Tx, userID string) (decimal.Decimal, error) {
+	var balance, reserved, loan decimal.Decimal
+	err := tx.QueryRowContext(ctx, `
+		SELECT w.balance, w.reserved, m.loan_balance
+		FROM wallets w JOIN margin_accounts m ON m.user_id = w.user_id
+		WHERE w.user_id=$1 AND w.currency='USD'
+		FOR UPDATE`, userID).Scan(&balance, &reserved, &loan)
+	if err == sql.ErrNoRows {
+		return decimal.Zero, nil
+	} else if err != nil {
+		return decimal.Zero, err
+	}
+	pay := decimal.Min(loan, decimal.Max(balance.Sub(reserved), decimal.Zero))
+	if !pay.IsPositive() {
+		return decimal.Zero, nil
+	}
+	return pay, ledger.Repay(ctx, tx, userID, pay)
+}
+
+// Debit charges the account a fee of kind (a ledger entry kind), from free
+// cash first and the loan for whatever the cash can't cover.
+func Debit(ctx context.Context, tx *sql.Tx, userID, kind string, amount decimal.Decimal) error {
+	var balance, reserved decimal.Decimal
+	if err := tx.QueryRowContext(ctx,
+		`SELECT balance, reserved FROM wallets WHERE user_id=$1 AND currency='USD' FOR UPDATE`,
+		userID).Scan(&balance, &reserved); err != nil {
+		return err
+	}
+	cash := decimal.Min(amount, decimal.Max(balance.Sub(reserved), decimal.Zero))
+	return ledger.Charge(ctx, tx, userID, kind, cash, amount.Sub(cash))
+}
+
+// IsUserError reports whether err is a margin check the client should see as a 400.
+func IsUserError(err error) bool {
+	return errors.Is(err, ErrInsufficientMargin) || errors.Is(err, ErrMarginCall)
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"time"
+
+	"github.com/sahniaditya/flux-backend/decimal"
 )
 
 // User represents a trader in our system
@@ -14,11 +16,11 @@ type User struct {
 
 // Wallet represents the cash balance
 type Wallet struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Balance   float64   `json:"balance"`
-	Currency  string    `json:"currency"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        string          `json:"id"`
+	UserID    string          `json:"user_id"`
+	Balance   decimal.Decimal `json:"balance"`
+	Currency  string          `json:"currency"`
+	UpdatedAt time.Time       `json:"updated_at"`
 }
 
 // RegisterRequest is what the frontend sends us
@@ -32,47 +34,313 @@ type LoginResponse struct {
 	Token string `json:"token"`
 }
 
-// TradeRequest carries buy/sell details.
+// TradeRequest carries buy/sell details. The server prices the trade from the
+// live feed; MaxPrice (buys) and MinPrice (sells) are optional slippage guards.
 type TradeRequest struct {
-	Symbol   string  `json:"symbol" binding:"required"`
-	Quantity float64 `json:"quantity" binding:"required"`
-	Price    float64 `json:"price" binding:"required"`
+	Symbol        string           `json:"symbol" binding:"required"`
+	Quantity      decimal.Decimal  `json:"quantity"`
+	MaxPrice      *decimal.Decimal `json:"max_price"`
+	MinPrice      *decimal.Decimal `json:"min_price"`
+	ExtendedHours bool             `json:"extended_hours"` // Lets equities trade in pre- and post-market sessions
+	LotIDs        []string         `json:"lot_ids"`        // Tax lots to close, in order, instead of the account's lot method
 }
 
 // TopUpRequest adds fake USD to wallet.
 type TopUpRequest struct {
-	Amount float64 `json:"amount" binding:"required"`
+	Amount decimal.Decimal `json:"amount"`
 }
 
-// PortfolioResponse aggregates wallet + holdings.
+// PortfolioResponse aggregates wallet + holdings, marked to market.
+// Balance and Quantity are totals; the Available fields exclude what pending orders hold.
+// Equity, BuyingPower, MarginUtilization and the weights need every holding
+// priced and are omitted when one can't be; the other totals cover the
+// holdings that could be priced. Stale prices still count, flagged on the holding.
 type PortfolioResponse struct {
-	Balance  float64        `json:"balance"`
-	Currency string         `json:"currency"`
-	Holdings []HoldingEntry `json:"holdings"`
+	Balance           decimal.Decimal  `json:"balance"`
+	ReservedBalance   decimal.Decimal  `json:"reserved_balance"`
+	AvailableBalance  decimal.Decimal  `json:"available_balance"`
+	Currency          string           `json:"currency"`
+	AccountMode       string           `json:"account_mode"` // cash, margin
+	Loan              decimal.Decimal  `json:"loan"`
+	MarketValue       decimal.Decimal  `json:"market_value"` // Longs less shorts
+	UnrealizedPnL     decimal.Decimal  `json:"unrealized_pnl"`
+	RealizedPnL       decimal.Decimal  `json:"realized_pnl"` // To date, on every lot ever closed
+	DayChange         decimal.Decimal  `json:"day_change"`
+	PricesComplete    bool             `json:"prices_complete"` // Every holding has a live price
+	Equity            *decimal.Decimal `json:"equity,omitempty"`
+	CashWeight        *decimal.Decimal `json:"cash_weight,omitempty"` // Cash less the loan, as a fraction of equity
+	BuyingPower       *decimal.Decimal `json:"buying_power,omitempty"`
+	MarginUtilization *decimal.Decimal `json:"margin_utilization,omitempty"` // Gross exposure over the most the account may carry
+	Holdings          []HoldingEntry   `json:"holdings"`
 }
 
+// HoldingEntry is one position. The valuation fields are omitted when the
+// symbol has no price; PriceStatus says why.
 type HoldingEntry struct {
-	Symbol          string  `json:"symbol"`
-	Quantity        float64 `json:"quantity"`
-	AverageBuyPrice float64 `json:"average_buy_price"`
+	Symbol               string           `json:"symbol"`
+	Quantity             decimal.Decimal  `json:"quantity"`
+	ReservedQuantity     decimal.Decimal  `json:"reserved_quantity"`
+	AvailableQuantity    decimal.Decimal  `json:"available_quantity"`
+	AverageBuyPrice      decimal.Decimal  `json:"average_buy_price"`
+	CostBasis            decimal.Decimal  `json:"cost_basis"`   // Of the open lots; for shorts, what they raised
+	RealizedPnL          decimal.Decimal  `json:"realized_pnl"` // To date, in this symbol
+	PriceStatus          string           `json:"price_status"` // live, stale, unavailable
+	Price                *decimal.Decimal `json:"price,omitempty"`
+	PriceUpdatedAt       *time.Time       `json:"price_updated_at,omitempty"`
+	MarketValue          *decimal.Decimal `json:"market_value,omitempty"` // Negative for shorts
+	UnrealizedPnL        *decimal.Decimal `json:"unrealized_pnl,omitempty"`
+	UnrealizedPnLPercent *decimal.Decimal `json:"unrealized_pnl_percent,omitempty"`
+	DayChange            *decimal.Decimal `json:"day_change,omitempty"`
+	DayChangePercent     *float64         `json:"day_change_percent,omitempty"` // The symbol's 24h move
+	Weight               *decimal.Decimal `json:"weight,omitempty"`             // Market value as a fraction of equity
+}
+
+// PortfolioHistory is the account's value over a range, from its equity
+// snapshots, with returns adjusted for deposits and withdrawals. The returns
+// are for the whole range, not annualized, and are omitted until there are
+// two complete snapshots to measure between.
+type PortfolioHistory struct {
+	Range       string          `json:"range"`
+	Granularity string          `json:"granularity"` // 1h, 1d
+	Points      []HistoryPoint  `json:"points"`
+	NetDeposits decimal.Decimal `json:"net_deposits"` // Deposits less withdrawals between the first and last points
+	TWR         *float64        `json:"time_weighted_return,omitempty"`
+	MWR         *float64        `json:"money_weighted_return,omitempty"`
+}
+
+// HistoryPoint is one equity snapshot. Incomplete points are missing a
+// holding's price and leave it out of MarketValue and Equity.
+type HistoryPoint struct {
+	Period      time.Time       `json:"period"`
+	TakenAt     time.Time       `json:"taken_at"`
+	Cash        decimal.Decimal `json:"cash"`
+	Loan        decimal.Decimal `json:"loan"`
+	MarketValue decimal.Decimal `json:"market_value"`
+	Equity      decimal.Decimal `json:"equity"`
+	NetFlow     decimal.Decimal `json:"net_flow"` // Deposits less withdrawals since the previous point
+	Complete    bool            `json:"complete"`
+}
+
+// PortfolioAnalytics are risk and performance statistics over a range of
+// equity snapshots. Returns and rates are fractions (0.01 is 1%);
+// volatility, Sharpe and Sortino are annualized. A statistic is omitted
+// when there is too little history for it.
+type PortfolioAnalytics struct {
+	Range            string           `json:"range"`
+	Granularity      string           `json:"granularity"` // 1h, 1d
+	Periods          int              `json:"periods"`     // Returns measured between complete snapshots
+	RiskFreeRate     float64          `json:"risk_free_rate"`
+	TotalReturn      *float64         `json:"total_return,omitempty"` // Time-weighted
+	Volatility       *float64         `json:"volatility,omitempty"`
+	SharpeRatio      *float64         `json:"sharpe_ratio,omitempty"`
+	SortinoRatio     *float64         `json:"sortino_ratio,omitempty"`
+	MaxDrawdown      *float64         `json:"max_drawdown,omitempty"` // Deepest fall from a peak, negative
+	DrawdownPeak     *time.Time       `json:"drawdown_peak,omitempty"`
+	DrawdownTrough   *time.Time       `json:"drawdown_trough,omitempty"`
+	ClosedLots       int              `json:"closed_lots"`
+	WinRate          *float64         `json:"win_rate,omitempty"` // Closed lots that gained
+	AverageWin       *decimal.Decimal `json:"average_win,omitempty"`
+	AverageLoss      *decimal.Decimal `json:"average_loss,omitempty"` // Negative
+	Benchmark        string           `json:"benchmark"`
+	BenchmarkPeriods int              `json:"benchmark_periods"` // Periods with the benchmark priced at both ends
+	Beta             *float64         `json:"beta,omitempty"`
+	Correlation      *float64         `json:"correlation,omitempty"`
+}
+
+// TaxLot is an open lot: units bought (or sold short) together.
+type TaxLot struct {
+	ID        string          `json:"id"`
+	Symbol    string          `json:"symbol"`
+	Side      string          `json:"side"` // long, short
+	Quantity  decimal.Decimal `json:"quantity"`
+	Remaining decimal.Decimal `json:"remaining"`
+	Cost      decimal.Decimal `json:"cost"`      // Of the remaining units, fees included; for shorts, what they raised
+	UnitCost  decimal.Decimal `json:"unit_cost"` // Cost per remaining unit
+	OpenedAt  time.Time       `json:"opened_at"`
+}
+
+// TaxLotsResponse lists open lots and the method sells close them by.
+type TaxLotsResponse struct {
+	LotMethod string   `json:"lot_method"` // fifo, lifo, hifo
+	Lots      []TaxLot `json:"lots"`
+}
+
+// LotMethodRequest picks which tax lots trades close first.
+type LotMethodRequest struct {
+	Method string `json:"method" binding:"required,oneof=fifo lifo hifo"`
+}
+
+// Transaction is one entry in the account's transaction history.
+type Transaction struct {
+	ID          string           `json:"id"`
+	Type        string           `json:"type"` // DEPOSIT, WITHDRAW, BUY, SELL, BORROW_FEE, INTEREST
+	Symbol      *string          `json:"symbol,omitempty"`
+	Quantity    *decimal.Decimal `json:"quantity,omitempty"`
+	Price       *decimal.Decimal `json:"price,omitempty"`
+	TotalAmount decimal.Decimal  `json:"total_amount"` // Cash moved, fee included
+	Fee         decimal.Decimal  `json:"fee"`
+	RealizedPnL *decimal.Decimal `json:"realized_pnl,omitempty"` // On the lots it closed, if any
+	CashBalance decimal.Decimal  `json:"cash_balance"`           // Just after it
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// TransactionListResponse is one page of transactions plus the cursor for the next page.
+type TransactionListResponse struct {
+	Transactions []Transaction `json:"transactions"`
+	NextCursor   string        `json:"next_cursor,omitempty"`
 }
 
 type Order struct {
-	ID        string   `json:"id"`
-	UserID    string   `json:"user_id"`
-	Symbol    string   `json:"symbol"`
-	Side      string   `json:"side"` // buy, sell
-	Type      string   `json:"type"` // market, limit, stop
-	Quantity  float64  `json:"quantity"`
-	Price     *float64 `json:"price,omitempty"` // For limit/stop
-	Status    string   `json:"status"`          // pending, filled, cancelled
-	CreatedAt string   `json:"created_at"`
+	ID               string           `json:"id"`
+	UserID           string           `json:"user_id"`
+	Symbol           string           `json:"symbol"`
+	Side             string           `json:"side"` // buy, sell
+	Type             string           `json:"type"` // market, limit, stop, stop_limit, trailing_stop, trailing_percent
+	Quantity         decimal.Decimal  `json:"quantity"`
+	Price            *decimal.Decimal `json:"price,omitempty"`         // For limit/stop, and the limit leg of stop_limit
+	StopPrice        *decimal.Decimal `json:"stop_price,omitempty"`    // For stop_limit
+	TrailAmount      *decimal.Decimal `json:"trail_amount,omitempty"`  // For trailing_stop
+	TrailPercent     *decimal.Decimal `json:"trail_percent,omitempty"` // For trailing_percent
+	WaterMark        *decimal.Decimal `json:"water_mark,omitempty"`    // Best price seen by a trailing order
+	TimeInForce      string           `json:"time_in_force"`           // gtc, day, ioc, fok, gtd
+	ExpiresAt        *time.Time       `json:"expires_at,omitempty"`
+	ExtendedHours    bool             `json:"extended_hours"` // Equities may fill outside the regular session
+	FilledQuantity   decimal.Decimal  `json:"filled_quantity"`
+	AverageFillPrice *decimal.Decimal `json:"average_fill_price,omitempty"`
+	Status           string           `json:"status"`               // pending, partially_filled, filled, cancelled, rejected, expired; inactive while a bracket exit waits for its entry
+	Source           string           `json:"source"`               // user, liquidation
+	GroupID          *string          `json:"group_id,omitempty"`   // Set for orders in a bracket or OCO group
+	GroupRole        string           `json:"group_role,omitempty"` // entry, take_profit, stop_loss, leg
+	CreatedAt        time.Time        `json:"created_at"`
+	ExecutedAt       *time.Time       `json:"executed_at,omitempty"` // Set when the last fill completes the order
+	Fills            []OrderFill      `json:"fills,omitempty"`       // Only populated on GET /orders/:id
+}
+
+// OrderFill is one execution against an order.
+// Price is what the trader got; ReferencePrice is the feed price before
+// slippage, so SlippageBPS is the cost of crossing the spread and moving the market.
+type OrderFill struct {
+	ID             string           `json:"id"`
+	Quantity       decimal.Decimal  `json:"quantity"`
+	Price          decimal.Decimal  `json:"price"`
+	ReferencePrice *decimal.Decimal `json:"reference_price,omitempty"`
+	SlippageBPS    *float64         `json:"slippage_bps,omitempty"`
+	Fee            decimal.Decimal  `json:"fee"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+// OrderListResponse is one page of orders plus the cursor for the next page.
+type OrderListResponse struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"next_cursor,omitempty"`
 }
 
 type PlaceOrderRequest struct {
-	Symbol   string   `json:"symbol" binding:"required"`
-	Side     string   `json:"side" binding:"required,oneof=buy sell"`
-	Type     string   `json:"type" binding:"required,oneof=market limit stop"`
-	Quantity float64  `json:"quantity" binding:"required,gt=0"`
-	Price    *float64 `json:"price"` // Required for limit/stop
+	Symbol        string           `json:"symbol" binding:"required"`
+	Side          string           `json:"side" binding:"required,oneof=buy sell"`
+	Type          string           `json:"type" binding:"required,oneof=market limit stop stop_limit trailing_stop trailing_percent"`
+	Quantity      decimal.Decimal  `json:"quantity"`
+	Price         *decimal.Decimal `json:"price"`                                                       // Required for limit/stop/stop_limit
+	StopPrice     *decimal.Decimal `json:"stop_price"`                                                  // Required for stop_limit
+	TrailAmount   *decimal.Decimal `json:"trail_amount"`                                                // Required for trailing_stop
+	TrailPercent  *decimal.Decimal `json:"trail_percent"`                                               // Required for trailing_percent
+	TimeInForce   string           `json:"time_in_force" binding:"omitempty,oneof=gtc day ioc fok gtd"` // Defaults to gtc
+	ExpiresAt     *time.Time       `json:"expires_at"`                                                  // Required for gtd
+	ExtendedHours bool             `json:"extended_hours"`                                              // Equities may fill pre- and post-market; otherwise they queue until the open
+}
+
+// OrderLeg is one order of an OCO pair, or a bracket's entry.
+type OrderLeg struct {
+	Type         string           `json:"type" binding:"required,oneof=market limit stop stop_limit trailing_stop trailing_percent"`
+	Price        *decimal.Decimal `json:"price"`
+	StopPrice    *decimal.Decimal `json:"stop_price"`
+	TrailAmount  *decimal.Decimal `json:"trail_amount"`
+	TrailPercent *decimal.Decimal `json:"trail_percent"`
+}
+
+// OrderGroupRequest places a bracket or an OCO pair. A bracket's exits take
+// the opposite side of its entry and only start working once it fills; an
+// OCO pair's legs share the group's side and quantity.
+type OrderGroupRequest struct {
+	Type          string           `json:"type" binding:"required,oneof=bracket oco"`
+	Symbol        string           `json:"symbol" binding:"required"`
+	Side          string           `json:"side" binding:"required,oneof=buy sell"`
+	Quantity      decimal.Decimal  `json:"quantity"`
+	TimeInForce   string           `json:"time_in_force" binding:"omitempty,oneof=gtc day gtd"` // Defaults to gtc
+	ExpiresAt     *time.Time       `json:"expires_at"`                                          // Required for gtd
+	ExtendedHours bool             `json:"extended_hours"`                                      // Every order in the group may fill outside the regular session
+	Entry         *OrderLeg        `json:"entry"`                                               // Bracket only; defaults to a market order
+	TakeProfit    *decimal.Decimal `json:"take_profit"`                                         // Bracket only: limit price of the take-profit exit
+	StopLoss      *decimal.Decimal `json:"stop_loss"`                                           // Bracket only: stop price of the stop-loss exit
+	StopLossLimit *decimal.Decimal `json:"stop_loss_limit"`                                     // Bracket only, optional: makes the stop-loss a stop_limit
+	Legs          []OrderLeg       `json:"legs"`                                                // OCO only: exactly two
+}
+
+// OrderGroup is a bracket or OCO pair with its orders.
+type OrderGroup struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`   // bracket, oco
+	Status      string     `json:"status"` // active, completed, cancelled
+	CreatedAt   time.Time  `json:"created_at"`
+	Orders      []Order    `json:"orders"`
+	QueuedUntil *time.Time `json:"queued_until,omitempty"` // Next open, when placed while the market was closed
+}
+
+// ModifyOrderRequest changes a pending order in place. Omitted fields stay as they are.
+type ModifyOrderRequest struct {
+	Quantity  *decimal.Decimal `json:"quantity"`
+	Price     *decimal.Decimal `json:"price"`
+	StopPrice *decimal.Decimal `json:"stop_price"`
+}
+
+// MarginRequest switches an account between cash and margin. The margin
+// fractions are optional and keep their current (or default) values if unset.
+type MarginRequest struct {
+	Mode              string           `json:"mode" binding:"required,oneof=cash margin"`
+	InitialMargin     *decimal.Decimal `json:"initial_margin"`
+	MaintenanceMargin *decimal.Decimal `json:"maintenance_margin"`
+	MaxLeverage       *decimal.Decimal `json:"max_leverage"`
+}
+
+// MarginStatus is an account marked to market against its margin requirements.
+// Requirements are zero for cash accounts.
+type MarginStatus struct {
+	Mode                   string          `json:"mode"` // cash, margin
+	InitialMargin          decimal.Decimal `json:"initial_margin,omitzero"`
+	MaintenanceMargin      decimal.Decimal `json:"maintenance_margin,omitzero"`
+	MaxLeverage            decimal.Decimal `json:"max_leverage,omitzero"`
+	Cash                   decimal.Decimal `json:"cash"`
+	Loan                   decimal.Decimal `json:"loan"`
+	LongValue              decimal.Decimal `json:"long_value"`
+	ShortValue             decimal.Decimal `json:"short_value"`
+	Equity                 decimal.Decimal `json:"equity"`
+	InitialRequirement     decimal.Decimal `json:"initial_requirement"`
+	MaintenanceRequirement decimal.Decimal `json:"maintenance_requirement"`
+	ExcessEquity           decimal.Decimal `json:"excess_equity"` // Equity above the maintenance requirement
+	BuyingPower            decimal.Decimal `json:"buying_power"`
+	MarginUtilization      decimal.Decimal `json:"margin_utilization"`
+	MarginCallAt           *time.Time      `json:"margin_call_at,omitempty"`
+}
+
+// MarketHours is a market's session at the time of the request. Crypto
+// reports market "crypto" and is always open.
+type MarketHours struct {
+	Symbol    string     `json:"symbol,omitempty"`
+	Market    string     `json:"market"`
+	Aliases   []string   `json:"aliases,omitempty"` // Exchanges on the same calendar
+	Timezone  string     `json:"timezone"`
+	Session   string     `json:"session"` // pre_market, regular, post_market, closed
+	IsOpen    bool       `json:"is_open"` // Regular session in progress
+	Holiday   string     `json:"holiday,omitempty"`
+	NextOpen  *time.Time `json:"next_open,omitempty"`  // Next regular open, when closed
+	NextClose *time.Time `json:"next_close,omitempty"` // End of the current or next regular session
+}
+
+// HaltRequest places a trading halt. Target is the symbol or asset class
+// (crypto, equity) and is ignored for a global halt.
+type HaltRequest struct {
+	Scope     string     `json:"scope" binding:"required,oneof=global asset_class symbol"`
+	Target    string     `json:"target"`
+	Reason    string     `json:"reason" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at"` // Optional automatic resume
 }
@@ -0,0 +1,109 @@
+// Package positions books trades against a user's wallet and holdings.
+//
+// A position is long when its quantity is positive and, in a margin account,
+// short when it is negative. average_buy_price is the average entry price of
+// the open tax lots, fees included: what a long cost per unit, or what a
+// short raised per unit. Quantities and cash are exact decimals, so a
+// position sold down to nothing is exactly flat. The quantity and cash move
+// through the ledger. Callers check buying power, holdings or margin first;
+// Settle only records the outcome.
+package positions
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/ledger"
+	"github.com/sahniaditya/flux-backend/lots"
+	"github.com/sahniaditya/flux-backend/precision"
+)
+
+// Trade is one execution to book.
+type Trade struct {
+	UserID   string
+	Symbol   string
+	Side     string // buy, sell
+	Quantity decimal.Decimal
+	Price    decimal.Decimal
+	Fee      decimal.Decimal
+	LotIDs   []string // Tax lots to close, in order; empty uses the user's lot method
+}
+
+// Notional is the trade's value to the cent, before fees.
+func (t Trade) Notional() decimal.Decimal {
+	return precision.Cash(t.Quantity.Mul(t.Price))
+}
+
+// Total is the cash the trade moves, to the cent: notional plus fee on buys,
+// minus fee on sells.
+func (t Trade) Total() decimal.Decimal {
+	notional := t.Notional()
+	if t.Side == "sell" {
+		return notional.Sub(t.Fee)
+	}
+	return notional.Add(t.Fee)
+}
+
+// Get locks the user's position in symbol and returns its quantity and the
+// part of it held for pending sells. A missing row is a flat position.
+func Get(ctx context.Context, tx *sql.Tx, userID, symbol string) (quantity, reserved decimal.Decimal, err error) {
+	err = tx.QueryRowContext(ctx,
+		`SELECT quantity, reserved_quantity FROM holdings WHERE user_id=$1 AND symbol=$2 FOR UPDATE`,
+		userID, symbol).Scan(&quantity, &reserved)
+	if err == sql.ErrNoRows {
+		return decimal.Zero, decimal.Zero, nil
+	}
+	return quantity, reserved, err
+}
+
+// Settle books the trade in the ledger and the tax lots, moves the
+// position's entry price and logs the transaction. It returns the gain or
+// loss realized on the lots the trade closed.
+func Settle(ctx context.Context, tx *sql.Tx, t Trade) (decimal.Decimal, error) {
+	total := t.Total()
+	txType, delta := "BUY", t.Quantity
+	if t.Side == "sell" {
+		txType, delta = "SELL", delta.Neg()
+	}
+
+	var reserved decimal.Decimal
+	err := tx.QueryRowContext(ctx,
+		`SELECT reserved_quantity FROM holdings WHERE user_id=$1 AND symbol=$2 FOR UPDATE`,
+		t.UserID, t.Symbol).Scan(&reserved)
+	if err != nil && err != sql.ErrNoRows {
+		return decimal.Zero, err
+	}
+	if err := ledger.Trade(ctx, tx, t.UserID, t.Symbol, delta, t.Notional(), t.Fee); err != nil {
+		return decimal.Zero, err
+	}
+
+	var txID string
+	if err := tx.QueryRowContext(ctx, `
+		INSERT INTO transactions (user_id, type, symbol, quantity, price_per_unit, total_amount, fee)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`,
+		t.UserID, txType, t.Symbol, t.Quantity, t.Price, total, t.Fee).Scan(&txID); err != nil {
+		return decimal.Zero, err
+	}
+	res, err := lots.Book(ctx, tx, lots.Fill{
+		UserID: t.UserID, Symbol: t.Symbol, TransactionID: txID,
+		Quantity: delta, Cash: total, LotIDs: t.LotIDs,
+	})
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	if res.Open.IsZero() && reserved.IsZero() {
+		_, err = tx.ExecContext(ctx, `DELETE FROM holdings WHERE user_id=$1 AND symbol=$2`, t.UserID, t.Symbol)
+	} else {
+		avg := decimal.Zero
+		if res.Open.IsPositive() {
+			avg = res.Cost.Div(res.Open)
+		}
+		_, err = tx.ExecContext(ctx,
+			`UPDATE holdings SET average_buy_price=$1 WHERE user_id=$2 AND symbol=$3`,
+			avg, t.UserID, t.Symbol)
+	}
+	return res.Realized, err
+}
@@ -0,0 +1,13 @@
+// Package precision holds the rounding rules for cash: USD balances, holds,
+// fees and trade totals are all kept in cents.
+package precision
+
+import "github.com/sahniaditya/flux-backend/decimal"
+
+// CashPlaces is the precision of USD balances, holds and fees.
+const CashPlaces = 2
+
+// Cash rounds a USD amount to cents.
+func Cash(d decimal.Decimal) decimal.Decimal {
+	return d.Round(CashPlaces)
+}
@@ -12,13 +12,18 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/sahniaditya/flux-backend/decimal"
 )
 
 type Ticker struct {
-	Symbol    string    `json:"symbol"`
-	Price     float64   `json:"price"`
-	Change24h float64   `json:"change_24h"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Symbol    string          `json:"symbol"`
+	Price     decimal.Decimal `json:"price"`
+	Change24h float64         `json:"change_24h"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	// Set on websocket snapshots while trading in the symbol is halted.
+	Halted     bool   `json:"halted,omitempty"`
+	HaltReason string `json:"halt_reason,omitempty"`
 }
 
 // FeedConfig controls sources and intervals.
@@ -36,6 +41,9 @@ type Feed struct {
 	prices         map[string]Ticker
 	mu             sync.RWMutex
 	subscribers    map[*websocket.Conn]struct{}
+	tickSubs       map[chan Ticker]struct{}
+	tickHooks      []func(Ticker) bool
+	haltStatus     func(symbol string) (reason string, halted bool)
 	upgrader       websocket.Upgrader
 	stockSymbols   []string
 	finnhubAPIKey  string
@@ -104,6 +112,7 @@ func NewFeed(cfg FeedConfig) *Feed {
 		},
 		prices:         make(map[string]Ticker),
 		subscribers:    make(map[*websocket.Conn]struct{}),
+		tickSubs:       make(map[chan Ticker]struct{}),
 		stockSymbols:   cfg.StockSymbols,
 		finnhubAPIKey:  cfg.FinnhubAPIKey,
 		cryptoInterval: cryptoInterval,
@@ -205,26 +214,25 @@ func (f *Feed) refreshCrypto() error {
 	}
 
 	var payload map[string]struct {
-		USD           float64 `json:"usd"`
-		ChangePercent float64 `json:"usd_24h_change"`
+		USD           json.Number `json:"usd"`
+		ChangePercent float64     `json:"usd_24h_change"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
 		return err
 	}
 
 	now := time.Now().UTC()
-	f.mu.Lock()
+	ticks := make([]Ticker, 0, len(payload))
 	for id, data := range payload {
-		symbol := f.idToSymbol[id]
-		f.prices[symbol] = Ticker{
-			Symbol:    symbol,
-			Price:     data.USD,
+		ticks = append(ticks, Ticker{
+			Symbol:    f.idToSymbol[id],
+			Price:     parsePrice(data.USD),
 			Change24h: data.ChangePercent,
 			UpdatedAt: now,
-		}
+		})
 	}
-	f.mu.Unlock()
 
+	f.publishTicks(ticks)
 	f.broadcastSnapshot()
 	return nil
 }
@@ -261,8 +269,8 @@ func (f *Feed) refreshStocks() error {
 			continue
 		}
 		var payload struct {
-			Current float64 `json:"c"`
-			ChangeP float64 `json:"dp"`
+			Current json.Number `json:"c"`
+			ChangeP float64     `json:"dp"`
 		}
 		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
 			log.Printf("finnhub decode failed for %s: %v", sym, err)
@@ -271,13 +279,14 @@ func (f *Feed) refreshStocks() error {
 		}
 		resp.Body.Close()
 
-		if payload.Current <= 0 {
+		price := parsePrice(payload.Current)
+		if !price.IsPositive() {
 			log.Printf("finnhub returned zero price for %s", sym)
 			continue
 		}
 		updated[sym] = Ticker{
 			Symbol:    sym,
-			Price:     payload.Current,
+			Price:     price,
 			Change24h: payload.ChangeP,
 			UpdatedAt: now,
 		}
@@ -288,11 +297,11 @@ func (f *Feed) refreshStocks() error {
 		return nil
 	}
 
-	f.mu.Lock()
-	for k, v := range updated {
-		f.prices[k] = v
+	ticks := make([]Ticker, 0, len(updated))
+	for _, v := range updated {
+		ticks = append(ticks, v)
 	}
-	f.mu.Unlock()
+	f.publishTicks(ticks)
 	f.broadcastSnapshot()
 	return nil
 }
@@ -302,11 +311,38 @@ func (f *Feed) snapshot() map[string]Ticker {
 	defer f.mu.RUnlock()
 	out := make(map[string]Ticker, len(f.prices))
 	for k, v := range f.prices {
+		if f.haltStatus != nil {
+			v.HaltReason, v.Halted = f.haltStatus(k)
+		}
 		out[k] = v
 	}
 	return out
 }
 
+// SetHaltStatus makes snapshots flag halted symbols. Call before Start.
+func (f *Feed) SetHaltStatus(status func(symbol string) (reason string, halted bool)) {
+	f.mu.Lock()
+	f.haltStatus = status
+	f.mu.Unlock()
+}
+
+// OnTick runs hook on every price update before it is cached or subscribers
+// see it, such as a circuit breaker that must halt a symbol before anything
+// trades on the tick. A hook returning false drops the tick: quotes keep the
+// previous price. Hooks run on the polling goroutine and must not call back
+// into the feed. Call before Start.
+func (f *Feed) OnTick(hook func(Ticker) bool) {
+	f.mu.Lock()
+	f.tickHooks = append(f.tickHooks, hook)
+	f.mu.Unlock()
+}
+
+// Broadcast sends a fresh snapshot to every websocket client, e.g. when a
+// halt starts or ends between price updates.
+func (f *Feed) Broadcast() {
+	f.broadcastSnapshot()
+}
+
 func (f *Feed) addSubscriber(conn *websocket.Conn) {
 	f.mu.Lock()
 	f.subscribers[conn] = struct{}{}
@@ -346,6 +382,65 @@ func (f *Feed) broadcastSnapshot() {
 	f.mu.RUnlock()
 }
 
+// SubscribeTicks registers an in-process listener that receives every price
+// update as it lands. Sends never block the feed: a subscriber that falls more
+// than buffer ticks behind misses updates. Call the returned func to unsubscribe.
+func (f *Feed) SubscribeTicks(buffer int) (<-chan Ticker, func()) {
+	ch := make(chan Ticker, buffer)
+	f.mu.Lock()
+	f.tickSubs[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch, func() {
+		f.mu.Lock()
+		if _, ok := f.tickSubs[ch]; ok {
+			delete(f.tickSubs, ch)
+			close(ch)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// publishTicks runs the hooks over ticks, caches the ones they admit and
+// hands those to the subscribers.
+func (f *Feed) publishTicks(ticks []Ticker) {
+	f.mu.RLock()
+	hooks := f.tickHooks
+	f.mu.RUnlock()
+	admitted := ticks[:0]
+	for _, t := range ticks {
+		ok := true
+		for _, hook := range hooks {
+			ok = hook(t) && ok
+		}
+		if ok {
+			admitted = append(admitted, t)
+		}
+	}
+	ticks = admitted
+
+	f.mu.Lock()
+	for _, t := range ticks {
+		f.prices[t.Symbol] = t
+	}
+	f.mu.Unlock()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for ch := range f.tickSubs {
+		dropped := 0
+		for _, t := range ticks {
+			select {
+			case ch <- t:
+			default:
+				dropped++
+			}
+		}
+		if dropped > 0 {
+			log.Printf("tick subscriber falling behind; dropped %d updates", dropped)
+		}
+	}
+}
+
 func (f *Feed) closeAll() {
 	f.mu.Lock()
 	for conn := range f.subscribers {
@@ -356,21 +451,25 @@ func (f *Feed) closeAll() {
 }
 
 // GetPrice returns the latest price. If not in cache, validation attempts a live fetch.
-func (f *Feed) GetPrice(symbol string) (float64, error) {
-	symbol = strings.ToUpper(symbol)
-	// Normalize Crypto/TradingView symbols: "BINANCE:MKRUSDT" -> "MKRUSDT" -> "MKR"
-	if idx := strings.LastIndex(symbol, ":"); idx != -1 {
-		symbol = symbol[idx+1:]
+func (f *Feed) GetPrice(symbol string) (decimal.Decimal, error) {
+	t, err := f.GetQuote(symbol)
+	if err != nil {
+		return decimal.Zero, err
 	}
-	symbol = strings.TrimSuffix(symbol, "USDT")
-	symbol = strings.TrimSuffix(symbol, "USD")
+	return t.Price, nil
+}
+
+// GetQuote is GetPrice with the quote's timestamp, so callers can refuse to
+// trade on a stale price. Live fallback fetches are stamped with the fetch time.
+func (f *Feed) GetQuote(symbol string) (Ticker, error) {
+	symbol = NormalizeSymbol(symbol)
 
 	f.mu.RLock()
 	ticker, ok := f.prices[symbol]
 	f.mu.RUnlock()
 
-	if ok && ticker.Price > 0 {
-		return ticker.Price, nil
+	if ok && ticker.Price.IsPositive() {
+		return ticker, nil
 	}
 
 	// Not in cache?
@@ -389,11 +488,11 @@ func (f *Feed) GetPrice(symbol string) (float64, error) {
 			defer resp.Body.Close()
 			if resp.StatusCode == 200 {
 				var payload map[string]struct {
-					USD float64 `json:"usd"`
+					USD json.Number `json:"usd"`
 				}
 				if err := json.NewDecoder(resp.Body).Decode(&payload); err == nil {
-					if val, ok := payload[cryptoID]; ok && val.USD > 0 {
-						return val.USD, nil
+					if val, ok := payload[cryptoID]; ok && parsePrice(val.USD).IsPositive() {
+						return Ticker{Symbol: symbol, Price: parsePrice(val.USD), UpdatedAt: time.Now().UTC()}, nil
 					}
 				}
 			}
@@ -405,7 +504,7 @@ func (f *Feed) GetPrice(symbol string) (float64, error) {
 	if f.finnhubAPIKey != "" {
 		req, err := http.NewRequest("GET", "https://finnhub.io/api/v1/quote", nil)
 		if err != nil {
-			return 0, err
+			return Ticker{}, err
 		}
 		q := req.URL.Query()
 		q.Set("symbol", symbol)
@@ -414,19 +513,19 @@ func (f *Feed) GetPrice(symbol string) (float64, error) {
 
 		resp, err := f.client.Do(req)
 		if err != nil {
-			return 0, err
+			return Ticker{}, err
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode == 200 {
 			var payload struct {
-				Current float64 `json:"c"`
+				Current json.Number `json:"c"`
 			}
-			if err := json.NewDecoder(resp.Body).Decode(&payload); err == nil && payload.Current > 0 {
+			if err := json.NewDecoder(resp.Body).Decode(&payload); err == nil && parsePrice(payload.Current).IsPositive() {
 				// Cache it for a short while? For now, just return it.
 				// We could add it to f.prices so it gets updated in the loop,
 				// but let's just return it for validation pass.
-				return payload.Current, nil
+				return Ticker{Symbol: symbol, Price: parsePrice(payload.Current), UpdatedAt: time.Now().UTC()}, nil
 			}
 		}
 	}
@@ -434,7 +533,44 @@ func (f *Feed) GetPrice(symbol string) (float64, error) {
 	// Try CoinGecko for crypto if not in our initial list?
 	// The user wants strict crypto list or expanded?
 	// For now, if it's not in cache and finnhub failed, it's invalid.
-	return 0, fmt.Errorf("price unavailable for %s", symbol)
+	return Ticker{}, fmt.Errorf("price unavailable for %s", symbol)
+}
+
+// parsePrice reads an upstream price straight from its JSON text, so it
+// never passes through a float. Missing or malformed prices are zero.
+func parsePrice(n json.Number) decimal.Decimal {
+	d, err := decimal.Parse(string(n))
+	if err != nil {
+		return decimal.Zero
+	}
+	return d
+}
+
+// NormalizeSymbol maps Crypto/TradingView symbols to feed keys: "BINANCE:MKRUSDT" -> "MKRUSDT" -> "MKR".
+func NormalizeSymbol(symbol string) string {
+	symbol = strings.ToUpper(symbol)
+	if idx := strings.LastIndex(symbol, ":"); idx != -1 {
+		symbol = symbol[idx+1:]
+	}
+	symbol = strings.TrimSuffix(symbol, "USDT")
+	return strings.TrimSuffix(symbol, "USD")
+}
+
+// Asset classes reported by AssetClass.
+const (
+	AssetCrypto = "crypto"
+	AssetEquity = "equity"
+)
+
+// AssetClass reports whether a symbol trades as crypto (24/7) or as an equity/index.
+func (f *Feed) AssetClass(symbol string) string {
+	symbol = NormalizeSymbol(symbol)
+	for _, s := range f.idToSymbol {
+		if s == symbol {
+			return AssetCrypto
+		}
+	}
+	return AssetEquity
 }
 
 // IsSupported checks if the symbol is valid.
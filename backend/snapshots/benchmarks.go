@@ -0,0 +1,56 @@
+package snapshots
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+)
+
+// TakeBenchmarks records each benchmark symbol's price for the period at is
+// in, so account returns can be compared against it later. Periods already
+// recorded are left alone. A symbol without a price doesn't stop the rest;
+// the first failure is returned.
+func TakeBenchmarks(ctx context.Context, db *sql.DB, granularity string, at time.Time, symbols []string, quote Quote) error {
+	period := Period(granularity, at)
+	var first error
+	for _, symbol := range symbols {
+		price, err := quote(symbol)
+		if err == nil && !price.IsPositive() {
+			err = fmt.Errorf("no price for benchmark %s", symbol)
+		}
+		if err == nil {
+			_, err = db.ExecContext(ctx, `
+				INSERT INTO benchmark_prices (symbol, granularity, period, price) VALUES ($1, $2, $3, $4)
+				ON CONFLICT DO NOTHING`, symbol, granularity, period, price)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Benchmark returns the symbol's recorded prices for periods starting at or
+// after from, keyed by the period's Unix time.
+func Benchmark(ctx context.Context, q Querier, symbol, granularity string, from time.Time) (map[int64]decimal.Decimal, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT period, price FROM benchmark_prices
+		WHERE symbol=$1 AND granularity=$2 AND period >= $3`, symbol, granularity, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prices := make(map[int64]decimal.Decimal)
+	for rows.Next() {
+		var period time.Time
+		var price decimal.Decimal
+		if err := rows.Scan(&period, &price); err != nil {
+			return nil, err
+		}
+		prices[period.Unix()] = price
+	}
+	return prices, rows.Err()
+}
@@ -0,0 +1,133 @@
+package snapshots
+
+import (
+	"math"
+	"time"
+)
+
+// PeriodReturn is the Modified Dietz return between two complete
+// snapshots: the gain net of deposits and withdrawals, over the equity at
+// the start plus each flow weighted by how long it was invested.
+type PeriodReturn struct {
+	From   Snapshot
+	To     Snapshot
+	Return float64
+}
+
+// PeriodReturns returns the return of each period between complete
+// snapshots. A period that starts with nothing invested has no return and is
+// left out, so an account emptied and later funded again is measured on
+// either side of the gap.
+func PeriodReturns(history []Snapshot, flows []Flow) []PeriodReturn {
+	var returns []PeriodReturn
+	points := complete(history)
+	for i := 1; i < len(points); i++ {
+		a, b := points[i-1], points[i]
+		span := b.TakenAt.Sub(a.TakenAt).Seconds()
+		start, end := a.Equity.Float64(), b.Equity.Float64()
+		net, weighted := 0.0, 0.0
+		for _, f := range between(flows, a.TakenAt, b.TakenAt) {
+			amount := f.Amount.Float64()
+			net += amount
+			// A flow counts for the part of the period it was invested.
+			weighted += amount * b.TakenAt.Sub(f.At).Seconds() / span
+		}
+		base := start + weighted
+		if base <= 0 {
+			continue
+		}
+		returns = append(returns, PeriodReturn{From: a, To: b, Return: (end - start - net) / base})
+	}
+	return returns
+}
+
+// TWR is the time-weighted return over the snapshots: the period returns,
+// chained. Deposits and withdrawals don't move it, so it measures how the
+// holdings did; periods with nothing invested are skipped. It is nil when
+// no period has a return.
+func TWR(history []Snapshot, flows []Flow) *float64 {
+	returns := PeriodReturns(history, flows)
+	if len(returns) == 0 {
+		return nil
+	}
+	growth := 1.0
+	for _, p := range returns {
+		growth *= 1 + p.Return
+	}
+	r := growth - 1
+	return &r
+}
+
+// MWR is the money-weighted return over the snapshots: the internal rate of
+// return of the starting equity, the deposits and withdrawals, and the
+// ending equity, for the whole range rather than per year. Money that was
+// in the account longer counts for more. It is nil with fewer than two
+// complete snapshots or when no rate balances the flows.
+func MWR(history []Snapshot, flows []Flow) *float64 {
+	points := complete(history)
+	if len(points) < 2 {
+		return nil
+	}
+	first, last := points[0], points[len(points)-1]
+	span := last.TakenAt.Sub(first.TakenAt).Seconds()
+	start, end := first.Equity.Float64(), last.Equity.Float64()
+	if start <= 0 {
+		return nil
+	}
+	type weighted struct{ amount, years float64 }
+	var ins []weighted
+	for _, f := range between(flows, first.TakenAt, last.TakenAt) {
+		ins = append(ins, weighted{f.Amount.Float64(), last.TakenAt.Sub(f.At).Seconds() / span})
+	}
+	// What the start and the flows would grow to at rate r, less the end.
+	excess := func(r float64) float64 {
+		v := start * (1 + r)
+		for _, f := range ins {
+			v += f.amount * math.Pow(1+r, f.years)
+		}
+		return v - end
+	}
+
+	lo, hi := -0.999999, 1.0
+	if excess(lo) > 0 {
+		return nil
+	}
+	for excess(hi) < 0 {
+		if hi *= 2; hi > 1e9 {
+			return nil
+		}
+	}
+	for i := 0; i < 200; i++ {
+		mid := (lo + hi) / 2
+		if excess(mid) < 0 {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	r := (lo + hi) / 2
+	return &r
+}
+
+// complete drops snapshots missing a price; flows around one fall into the
+// period that spans it.
+func complete(history []Snapshot) []Snapshot {
+	var out []Snapshot
+	for _, s := range history {
+		if s.Complete {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// between returns the flows after from, up to and including to.
+func between(flows []Flow, from, to time.Time) []Flow {
+	var out []Flow
+	for _, f := range flows {
+		if f.At.After(from) && !f.At.After(to) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
@@ -0,0 +1,43 @@
+package snapshots
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+)
+
+func snapshot(day int, equity string) Snapshot {
+	at := time.Date(2026, 1, day, 0, 0, 0, 0, time.UTC)
+	return Snapshot{Period: at, TakenAt: at, Equity: decimal.MustParse(equity), Complete: true}
+}
+
+func TestPeriodReturnsSkipsEmptyPeriods(t *testing.T) {
+	// Up 10%, emptied by a withdrawal, idle, then funded again and up 5%.
+	history := []Snapshot{
+		snapshot(1, "100"), snapshot(2, "110"), snapshot(3, "0"),
+		snapshot(4, "0"), snapshot(5, "200"), snapshot(6, "210"),
+	}
+	flows := []Flow{
+		{At: history[2].TakenAt, Amount: decimal.MustParse("-110")},
+		{At: history[4].TakenAt, Amount: decimal.MustParse("200")},
+	}
+	periods := PeriodReturns(history, flows)
+	want := []float64{0.1, 0, 0.05}
+	if len(periods) != len(want) {
+		t.Fatalf("%d periods, want %d", len(periods), len(want))
+	}
+	for i, p := range periods {
+		if math.Abs(p.Return-want[i]) > 1e-9 {
+			t.Errorf("period %d returns %v, want %v", i, p.Return, want[i])
+		}
+	}
+	if r := TWR(history, flows); r == nil || math.Abs(*r-0.155) > 1e-9 {
+		t.Errorf("TWR = %v, want 0.155", r)
+	}
+
+	if r := TWR(history[2:4], nil); r != nil {
+		t.Errorf("TWR of an empty account = %v, want nil", *r)
+	}
+}
@@ -0,0 +1,221 @@
+// Package snapshots records what each account is worth over time: its cash,
+// margin loan and holdings, marked to market, once per UTC day and, when
+// enabled, once per hour. A holding that can't be priced leaves its snapshot
+// incomplete rather than counting it as worthless.
+package snapshots
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/precision"
+)
+
+// Granularities.
+const (
+	Hourly = "1h"
+	Daily  = "1d"
+)
+
+// Period returns the start of the hour or UTC day containing t.
+func Period(granularity string, t time.Time) time.Time {
+	if granularity == Hourly {
+		return t.UTC().Truncate(time.Hour)
+	}
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Quote prices a symbol, usually the feed's GetPrice.
+type Quote func(symbol string) (decimal.Decimal, error)
+
+// Holding is one position in a snapshot. Price is nil when unavailable.
+type Holding struct {
+	Symbol   string           `json:"symbol"`
+	Quantity decimal.Decimal  `json:"quantity"`
+	Price    *decimal.Decimal `json:"price"`
+}
+
+// Snapshot is an account's value at the start of a period, as of TakenAt.
+type Snapshot struct {
+	Period      time.Time       `json:"period"`
+	TakenAt     time.Time       `json:"taken_at"`
+	Cash        decimal.Decimal `json:"cash"`
+	Loan        decimal.Decimal `json:"loan"`
+	MarketValue decimal.Decimal `json:"market_value"`
+	Equity      decimal.Decimal `json:"equity"`
+	Holdings    []Holding       `json:"holdings"`
+	Complete    bool            `json:"complete"`
+}
+
+// Take snapshots every account for the period at is in. Accounts already
+// snapshotted for it are left alone, so a period is recorded once however
+// often Take runs. It returns how many snapshots it wrote.
+func Take(ctx context.Context, db *sql.DB, granularity string, at time.Time, quote Quote) (int, error) {
+	period := Period(granularity, at)
+	accounts := make(map[string]*Snapshot)
+	var order []string
+
+	// Read wallets and holdings as of one instant, so no trade lands between them.
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	takenAt := time.Now()
+	rows, err := tx.QueryContext(ctx, `
+		SELECT w.user_id, w.balance, COALESCE(m.loan_balance, 0)
+		FROM wallets w LEFT JOIN margin_accounts m ON m.user_id = w.user_id
+		WHERE w.currency='USD' AND w.user_id IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM equity_snapshots e
+				WHERE e.user_id = w.user_id AND e.granularity=$1 AND e.period=$2)`,
+		granularity, period)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var userID string
+		s := &Snapshot{Period: period, TakenAt: takenAt, Holdings: []Holding{}, Complete: true}
+		if err := rows.Scan(&userID, &s.Cash, &s.Loan); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		accounts[userID] = s
+		order = append(order, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(order) == 0 {
+		return 0, nil
+	}
+
+	rows, err = tx.QueryContext(ctx,
+		`SELECT user_id, symbol, quantity FROM holdings WHERE quantity <> 0 ORDER BY user_id, symbol`)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var userID string
+		var h Holding
+		if err := rows.Scan(&userID, &h.Symbol, &h.Quantity); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if s, ok := accounts[userID]; ok {
+			s.Holdings = append(s.Holdings, h)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// Each symbol is quoted once per run, so every account sees the same mark.
+	marks := make(map[string]*decimal.Decimal)
+	mark := func(symbol string) *decimal.Decimal {
+		if p, ok := marks[symbol]; ok {
+			return p
+		}
+		var p *decimal.Decimal
+		if price, err := quote(symbol); err == nil && price.IsPositive() {
+			p = &price
+		}
+		marks[symbol] = p
+		return p
+	}
+
+	written := 0
+	for _, userID := range order {
+		s := accounts[userID]
+		for i := range s.Holdings {
+			h := &s.Holdings[i]
+			h.Price = mark(h.Symbol)
+			if h.Price == nil {
+				s.Complete = false
+				continue
+			}
+			s.MarketValue = s.MarketValue.Add(precision.Cash(h.Quantity.Mul(*h.Price)))
+		}
+		s.Equity = s.Cash.Sub(s.Loan).Add(s.MarketValue)
+		holdings, err := json.Marshal(s.Holdings)
+		if err != nil {
+			return written, err
+		}
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO equity_snapshots (user_id, granularity, period, taken_at, cash, loan, market_value, equity, holdings, complete)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT DO NOTHING`,
+			userID, granularity, period, s.TakenAt, s.Cash, s.Loan, s.MarketValue, s.Equity, holdings, s.Complete); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+// Querier is satisfied by *sql.DB and *sql.Tx.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// History returns the user's snapshots at granularity for periods starting
+// at or after from, oldest first.
+func History(ctx context.Context, q Querier, userID, granularity string, from time.Time) ([]Snapshot, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT period, taken_at, cash, loan, market_value, equity, holdings, complete FROM equity_snapshots
+		WHERE user_id=$1 AND granularity=$2 AND period >= $3
+		ORDER BY period`, userID, granularity, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []Snapshot{}
+	for rows.Next() {
+		var s Snapshot
+		var holdings []byte
+		if err := rows.Scan(&s.Period, &s.TakenAt, &s.Cash, &s.Loan, &s.MarketValue, &s.Equity, &holdings, &s.Complete); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(holdings, &s.Holdings); err != nil {
+			return nil, err
+		}
+		history = append(history, s)
+	}
+	return history, rows.Err()
+}
+
+// Flow is money paid into (positive) or taken out of (negative) an account.
+type Flow struct {
+	At     time.Time       `json:"at"`
+	Amount decimal.Decimal `json:"amount"`
+}
+
+// Flows returns the user's deposits and withdrawals after from, oldest first.
+func Flows(ctx context.Context, q Querier, userID string, from time.Time) ([]Flow, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT created_at, CASE WHEN type='WITHDRAW' THEN -total_amount ELSE total_amount END
+		FROM transactions
+		WHERE user_id=$1 AND type IN ('DEPOSIT', 'WITHDRAW') AND created_at > $2
+		ORDER BY created_at`, userID, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var flows []Flow
+	for rows.Next() {
+		var f Flow
+		if err := rows.Scan(&f.At, &f.Amount); err != nil {
+			return nil, err
+		}
+		flows = append(flows, f)
+	}
+	return flows, rows.Err()
+}
@@ -0,0 +1,177 @@
+package worker
+
+import (
+	"sort"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/prices"
+)
+
+// Which way a resting order fires relative to its trigger price.
+const (
+	fireAlways = iota // market, trailing and triggered stop orders: look at every tick
+	fireBelow         // buy limits, sell stops: price <= trigger
+	fireAbove         // sell limits, buy stops: price >= trigger
+)
+
+// orderIndex holds the working orders in memory, bucketed per feed symbol and
+// sorted by the price at which each next needs attention, so a tick only
+// touches the orders it actually crosses. It is owned by the worker goroutine.
+type orderIndex struct {
+	books  map[string]*book
+	orders map[string]*pendingOrder
+}
+
+type book struct {
+	below  []indexEntry // highest trigger first
+	above  []indexEntry // lowest trigger first
+	always []indexEntry
+}
+
+type indexEntry struct {
+	level decimal.Decimal
+	order *pendingOrder
+}
+
+func newOrderIndex() *orderIndex {
+	return &orderIndex{books: make(map[string]*book), orders: make(map[string]*pendingOrder)}
+}
+
+// indexKey maps an order symbol onto the symbol the feed publishes ticks for.
+func indexKey(symbol string) string {
+	return prices.NormalizeSymbol(symbol)
+}
+
+// trigger reports which way the order fires and at what price. A stop_limit
+// sits on its stop until triggered, then rests as a limit; a triggered stop
+// looks at every tick until it has filled.
+func (o *pendingOrder) trigger() (int, decimal.Decimal) {
+	switch o.Type {
+	case "limit":
+		return limitSide(o.Side), o.Price.Decimal
+	case "stop":
+		if o.Triggered {
+			return fireAlways, decimal.Zero
+		}
+		return stopSide(o.Side), o.Price.Decimal
+	case "stop_limit":
+		if o.Triggered {
+			return limitSide(o.Side), o.Price.Decimal
+		}
+		return stopSide(o.Side), o.StopPrice.Decimal
+	}
+	return fireAlways, decimal.Zero
+}
+
+func limitSide(side string) int {
+	if side == "buy" {
+		return fireBelow
+	}
+	return fireAbove
+}
+
+func stopSide(side string) int {
+	if side == "buy" {
+		return fireAbove
+	}
+	return fireBelow
+}
+
+func (ix *orderIndex) get(id string) *pendingOrder {
+	return ix.orders[id]
+}
+
+// put adds the order, or re-files it if its trigger moved.
+func (ix *orderIndex) put(o *pendingOrder) {
+	ix.remove(o.ID)
+	key := indexKey(o.Symbol)
+	b := ix.books[key]
+	if b == nil {
+		b = &book{}
+		ix.books[key] = b
+	}
+	ix.orders[o.ID] = o
+
+	dir, level := o.trigger()
+	e := indexEntry{level: level, order: o}
+	switch dir {
+	case fireBelow:
+		i := sort.Search(len(b.below), func(i int) bool { return b.below[i].level.LessThan(level) })
+		b.below = insertAt(b.below, i, e)
+	case fireAbove:
+		i := sort.Search(len(b.above), func(i int) bool { return b.above[i].level.GreaterThan(level) })
+		b.above = insertAt(b.above, i, e)
+	default:
+		b.always = append(b.always, e)
+	}
+}
+
+func (ix *orderIndex) remove(id string) {
+	o, ok := ix.orders[id]
+	if !ok {
+		return
+	}
+	delete(ix.orders, id)
+	key := indexKey(o.Symbol)
+	b := ix.books[key]
+	if b == nil {
+		return
+	}
+	b.below = removeID(b.below, id)
+	b.above = removeID(b.above, id)
+	b.always = removeID(b.always, id)
+	if len(b.below)+len(b.above)+len(b.always) == 0 {
+		delete(ix.books, key)
+	}
+}
+
+// crossed returns the orders a tick at price needs to look at: every trigger
+// the price has reached, plus the orders that watch every tick.
+func (ix *orderIndex) crossed(symbol string, price decimal.Decimal) []*pendingOrder {
+	b := ix.books[indexKey(symbol)]
+	if b == nil {
+		return nil
+	}
+	var out []*pendingOrder
+	for _, e := range b.below {
+		if e.level.LessThan(price) {
+			break
+		}
+		out = append(out, e.order)
+	}
+	for _, e := range b.above {
+		if e.level.GreaterThan(price) {
+			break
+		}
+		out = append(out, e.order)
+	}
+	for _, e := range b.always {
+		out = append(out, e.order)
+	}
+	return out
+}
+
+// symbols lists the feed symbols that have working orders.
+func (ix *orderIndex) symbols() []string {
+	out := make([]string, 0, len(ix.books))
+	for s := range ix.books {
+		out = append(out, s)
+	}
+	return out
+}
+
+func insertAt(entries []indexEntry, i int, e indexEntry) []indexEntry {
+	entries = append(entries, indexEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = e
+	return entries
+}
+
+func removeID(entries []indexEntry, id string) []indexEntry {
+	for i, e := range entries {
+		if e.order.ID == id {
+			return append(entries[:i], entries[i+1:]...)
+		}
+	}
+	return entries
+}
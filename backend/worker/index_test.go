@@ -0,0 +1,132 @@
+package worker
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func crossedIDs(ix *orderIndex, symbol, live string) string {
+	var ids []string
+	for _, o := range ix.crossed(symbol, d(live)) {
+		ids = append(ids, o.ID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func testIndex() *orderIndex {
+	ix := newOrderIndex()
+	for _, o := range []*pendingOrder{
+		{ID: "buylimit99", Symbol: "AAPL", Side: "buy", Type: "limit", Price: price("99")},
+		{ID: "buylimit95", Symbol: "AAPL", Side: "buy", Type: "limit", Price: price("95")},
+		{ID: "selllimit105", Symbol: "AAPL", Side: "sell", Type: "limit", Price: price("105")},
+		{ID: "sellstop90", Symbol: "AAPL", Side: "sell", Type: "stop", Price: price("90")},
+		{ID: "buystop110", Symbol: "AAPL", Side: "buy", Type: "stop", Price: price("110")},
+		{ID: "trail", Symbol: "AAPL", Side: "sell", Type: "trailing_stop", TrailAmount: price("5")},
+		{ID: "btc", Symbol: "BTCUSDT", Side: "buy", Type: "market"},
+	} {
+		ix.put(o)
+	}
+	return ix
+}
+
+func TestIndexCrossed(t *testing.T) {
+	ix := testIndex()
+	tests := []struct {
+		live, want string
+	}{
+		{"100", "trail"},
+		{"99", "buylimit99,trail"},
+		{"95", "buylimit95,buylimit99,trail"},
+		{"90", "buylimit95,buylimit99,sellstop90,trail"},
+		{"105", "selllimit105,trail"},
+		{"110", "buystop110,selllimit105,trail"},
+	}
+	for _, tt := range tests {
+		if got := crossedIDs(ix, "AAPL", tt.live); got != tt.want {
+			t.Errorf("tick at %s crosses %s, want %s", tt.live, got, tt.want)
+		}
+	}
+	// Feed symbols and order symbols meet on the normalized key.
+	if got := crossedIDs(ix, "BTC", "1"); got != "btc" {
+		t.Errorf("BTC tick crosses %q, want btc", got)
+	}
+	if got := crossedIDs(ix, "MSFT", "1"); got != "" {
+		t.Errorf("MSFT tick crosses %q, want nothing", got)
+	}
+}
+
+func TestIndexPutRefiles(t *testing.T) {
+	ix := testIndex()
+	// Moving the limit re-files the order rather than adding a second entry.
+	ix.put(&pendingOrder{ID: "buylimit99", Symbol: "AAPL", Side: "buy", Type: "limit", Price: price("92")})
+	if got := crossedIDs(ix, "AAPL", "95"); got != "buylimit95,trail" {
+		t.Errorf("after moving the limit, 95 crosses %s", got)
+	}
+	if got := crossedIDs(ix, "AAPL", "92"); got != "buylimit95,buylimit99,trail" {
+		t.Errorf("after moving the limit, 92 crosses %s", got)
+	}
+
+	// A stop_limit waits on its stop, then on its limit once triggered.
+	sl := &pendingOrder{ID: "sl", Symbol: "AAPL", Side: "buy", Type: "stop_limit", StopPrice: price("120"), Price: price("101")}
+	ix.put(sl)
+	if got := crossedIDs(ix, "AAPL", "101"); strings.Contains(got, "sl") {
+		t.Errorf("untriggered stop_limit crossed at its limit: %s", got)
+	}
+	sl.Triggered = true
+	ix.put(sl)
+	if got := crossedIDs(ix, "AAPL", "101"); !strings.Contains(got, "sl") {
+		t.Errorf("triggered stop_limit not crossed at its limit: %s", got)
+	}
+
+	// A triggered stop watches every tick.
+	ix.put(&pendingOrder{ID: "sellstop90", Symbol: "AAPL", Side: "sell", Type: "stop", Price: price("90"), Triggered: true})
+	if got := crossedIDs(ix, "AAPL", "100"); got != "sellstop90,sl,trail" {
+		t.Errorf("triggered stop: 100 crosses %s", got)
+	}
+}
+
+func TestIndexRemove(t *testing.T) {
+	ix := testIndex()
+	ix.remove("buylimit99")
+	ix.remove("missing")
+	if ix.get("buylimit99") != nil {
+		t.Error("removed order still indexed")
+	}
+	if got := crossedIDs(ix, "AAPL", "99"); got != "trail" {
+		t.Errorf("99 crosses %s after removal", got)
+	}
+
+	ix.remove("btc")
+	for _, s := range ix.symbols() {
+		if s == "BTC" {
+			t.Error("empty book left behind for BTC")
+		}
+	}
+	if got := ix.symbols(); len(got) != 1 || got[0] != "AAPL" {
+		t.Errorf("symbols %v, want [AAPL]", got)
+	}
+}
+
+// resync rebuilds the index from the database and re-checks only the orders
+// that are new or whose terms changed.
+func TestTermsChanged(t *testing.T) {
+	o := &pendingOrder{ID: "a", Type: "limit", Quantity: d("10"), Price: price("99")}
+	same := *o
+	same.WaterMark, same.Filled, same.Triggered = price("1"), d("3"), true
+	moved := *o
+	moved.Price = price("98")
+	resized := *o
+	resized.Quantity = d("12")
+
+	if !termsChanged(nil, o) {
+		t.Error("a new order should be checked")
+	}
+	if termsChanged(o, &same) {
+		t.Error("state changes aren't new terms")
+	}
+	if !termsChanged(o, &moved) || !termsChanged(o, &resized) {
+		t.Error("a new price or quantity should be checked")
+	}
+}
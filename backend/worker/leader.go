@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// leaderLockKey identifies the advisory lock the instances compete for.
+const leaderLockKey int64 = 0x666c7578 // "flux"
+
+// leaderLock elects a single instance to run scheduled jobs (expiry, and any
+// other sweep that must not run twice) when several API replicas share one
+// database. Leadership is a session-level advisory lock held on a dedicated
+// connection, so it is released as soon as that instance goes away.
+type leaderLock struct {
+	db   *sql.DB
+	conn *sql.Conn
+}
+
+func newLeaderLock(db *sql.DB) *leaderLock {
+	return &leaderLock{db: db}
+}
+
+// held reports whether this instance is the leader, trying to take over when
+// it is not and checking the lock's connection is still alive when it is.
+func (l *leaderLock) held() bool {
+	ctx := context.Background()
+	if l.conn != nil {
+		if err := l.conn.PingContext(ctx); err == nil {
+			return true
+		}
+		log.Println("⚠️ Lost scheduler leadership: lock connection dropped")
+		l.conn.Close()
+		l.conn = nil
+	}
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		log.Println("Leader lock connection failed:", err)
+		return false
+	}
+	var ok bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, leaderLockKey).Scan(&ok); err != nil || !ok {
+		if err != nil {
+			log.Println("Leader lock failed:", err)
+		}
+		conn.Close()
+		return false
+	}
+	l.conn = conn
+	log.Println("👑 This instance now runs scheduled jobs")
+	return true
+}
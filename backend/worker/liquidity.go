@@ -0,0 +1,57 @@
+package worker
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultDepth is the notional (USD) a symbol can absorb per tick when no
+// per-symbol depth is configured.
+const DefaultDepth = 1_000_000
+
+// LiquidityModel decides how much of an order can fill on a single tick.
+type LiquidityModel interface {
+	// Available returns the maximum quantity of symbol fillable at price this tick.
+	Available(symbol string, price float64) float64
+}
+
+// DepthModel gives every symbol a fixed notional depth per tick. An order larger
+// than depth/price fills over several ticks.
+type DepthModel struct {
+	Default   float64            // USD per tick for symbols not listed below
+	PerSymbol map[string]float64 // USD per tick by symbol
+}
+
+func (m DepthModel) Available(symbol string, price float64) float64 {
+	if price <= 0 {
+		return 0
+	}
+	depth, ok := m.PerSymbol[strings.ToUpper(symbol)]
+	if !ok {
+		depth = m.Default
+	}
+	if depth <= 0 {
+		// No configured limit: the whole order fills at once.
+		return math.Inf(1)
+	}
+	return depth / price
+}
+
+// ParseDepth reads "SYM:USD,SYM2:USD" (e.g. "BTC:5000000,AAPL:2000000").
+// Malformed entries are skipped.
+func ParseDepth(spec string, def float64) DepthModel {
+	m := DepthModel{Default: def, PerSymbol: map[string]float64{}}
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			continue
+		}
+		m.PerSymbol[strings.ToUpper(strings.TrimSpace(kv[0]))] = v
+	}
+	return m
+}
@@ -0,0 +1,307 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sort"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/funds"
+	"github.com/sahniaditya/flux-backend/groups"
+	"github.com/sahniaditya/flux-backend/ledger"
+	"github.com/sahniaditya/flux-backend/margin"
+	"github.com/sahniaditya/flux-backend/precision"
+)
+
+const (
+	// DefaultBorrowRate is the annual fee for borrowing shares to sell short,
+	// charged daily on the market value of each short position.
+	DefaultBorrowRate = 0.03
+	// DefaultLoanRate is the annual interest on margin loans, accrued daily.
+	DefaultLoanRate = 0.08
+)
+
+var daysPerYear = decimal.FromInt(365)
+
+// sweepMargin accrues loan interest, charges borrow fees on short positions
+// and puts accounts whose equity fell below maintenance into a margin call,
+// liquidating positions until they are back above the initial requirement.
+// It runs off the worker loop, so the orders it cancels and places go back
+// to the loop on w.refreshes rather than into the index.
+func (w *worker) sweepMargin() {
+	rows, err := w.db.Query(`SELECT user_id FROM margin_accounts`)
+	if err != nil {
+		log.Println("Error fetching margin accounts:", err)
+		return
+	}
+	var users []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			users = append(users, id)
+		}
+	}
+	rows.Close()
+
+	for _, userID := range users {
+		w.checkAccount(userID)
+	}
+}
+
+func (w *worker) checkAccount(userID string) {
+	ctx := context.Background()
+	quote, err := margin.Prequote(ctx, w.db, userID, w.provider.GetPrice)
+	if err != nil {
+		log.Printf("Quoting %s failed: %v", userID, err)
+		return
+	}
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Tx error:", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Wallet before margin account, the same order fills take them in.
+	if _, err := tx.Exec(`SELECT 1 FROM wallets WHERE user_id=$1 AND currency='USD' FOR UPDATE`, userID); err != nil {
+		log.Println("Wallet lock failed:", err)
+		return
+	}
+	acct, err := margin.Lock(ctx, tx, userID)
+	if err != nil || acct == nil {
+		return
+	}
+
+	if err := w.accrueInterest(ctx, tx, acct); err != nil {
+		log.Printf("Loan interest for %s failed: %v", userID, err)
+		return
+	}
+	s, err := margin.Evaluate(ctx, tx, userID, quote)
+	if err != nil {
+		log.Printf("⚠️ Skipping margin check for %s: %v", userID, err)
+		return
+	}
+	if err := w.chargeBorrowFees(ctx, tx, userID, s); err != nil {
+		log.Printf("Borrow fee for %s failed: %v", userID, err)
+		return
+	}
+	if s, err = margin.Evaluate(ctx, tx, userID, quote); err != nil {
+		log.Printf("⚠️ Skipping margin check for %s: %v", userID, err)
+		return
+	}
+	// A halt usually means the price can't be trusted; don't liquidate on it.
+	for _, p := range s.Positions {
+		if halted := w.halts.Check(p.Symbol); halted != nil {
+			// Keep the interest and fees charged above.
+			if err := tx.Commit(); err != nil {
+				log.Println("Commit failed:", err)
+			}
+			log.Printf("⚠️ Skipping margin check for %s: %v", userID, halted)
+			return
+		}
+	}
+
+	if s.Equity().Cmp(acct.Maintenance.Mul(s.Gross())) >= 0 {
+		if acct.MarginCallAt != nil {
+			if _, err := tx.Exec(`UPDATE margin_accounts SET margin_call_at=NULL WHERE user_id=$1`, userID); err != nil {
+				log.Println("Clearing margin call failed:", err)
+				return
+			}
+			log.Printf("✅ Margin call met for %s", userID)
+		}
+		if err := tx.Commit(); err != nil {
+			log.Println("Commit failed:", err)
+		}
+		return
+	}
+
+	if acct.MarginCallAt == nil {
+		log.Printf("📣 Margin call for %s: equity $%.2f below maintenance $%.2f", userID, s.Equity(), acct.Maintenance.Mul(s.Gross()))
+	}
+	if _, err := tx.Exec(`UPDATE margin_accounts SET margin_call_at=COALESCE(margin_call_at, NOW()) WHERE user_id=$1`, userID); err != nil {
+		log.Println("Setting margin call failed:", err)
+		return
+	}
+	cancelled, placed, err := w.liquidate(ctx, tx, acct, s)
+	if err != nil {
+		log.Printf("Liquidating %s failed: %v", userID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit failed:", err)
+		return
+	}
+	w.refreshes <- append(cancelled, placed...)
+}
+
+// accrueInterest adds a day's interest to the margin loan, once per day.
+func (w *worker) accrueInterest(ctx context.Context, tx *sql.Tx, acct *margin.Account) error {
+	if !acct.Loan.IsPositive() || w.loanRate <= 0 {
+		return nil
+	}
+	interest := precision.Cash(acct.Loan.Mul(decimal.FromFloat(w.loanRate)).Div(daysPerYear))
+	if !interest.IsPositive() {
+		return nil
+	}
+	res, err := tx.ExecContext(ctx, `
+		UPDATE margin_accounts SET interest_charged_on=CURRENT_DATE
+		WHERE user_id=$1 AND (interest_charged_on IS NULL OR interest_charged_on < CURRENT_DATE)`,
+		acct.UserID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	if err := ledger.AccrueInterest(ctx, tx, acct.UserID, interest); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO transactions (user_id, type, total_amount) VALUES ($1, 'INTEREST', $2)`,
+		acct.UserID, interest); err != nil {
+		return err
+	}
+	log.Printf("💸 Loan interest $%.2f for %s", interest, acct.UserID)
+	return nil
+}
+
+// chargeBorrowFees charges a day's borrow fee on every short, once per day,
+// from cash or, when the cash runs out, the margin loan.
+func (w *worker) chargeBorrowFees(ctx context.Context, tx *sql.Tx, userID string, s margin.Summary) error {
+	if s.ShortValue.IsZero() || w.borrowRate <= 0 {
+		return nil
+	}
+	res, err := tx.ExecContext(ctx, `
+		UPDATE margin_accounts SET borrow_fee_charged_on=CURRENT_DATE
+		WHERE user_id=$1 AND (borrow_fee_charged_on IS NULL OR borrow_fee_charged_on < CURRENT_DATE)`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	for _, p := range s.Positions {
+		if !p.Quantity.IsNegative() {
+			continue
+		}
+		fee := precision.Cash(p.Value().Neg().Mul(decimal.FromFloat(w.borrowRate)).Div(daysPerYear))
+		if !fee.IsPositive() {
+			continue
+		}
+		if err := margin.Debit(ctx, tx, userID, ledger.KindBorrowFee, fee); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO transactions (user_id, type, symbol, quantity, price_per_unit, total_amount, fee)
+			VALUES ($1, 'BORROW_FEE', $2, $3, $4, $5, $5)`,
+			userID, p.Symbol, p.Quantity.Neg(), p.Price, fee); err != nil {
+			return err
+		}
+		log.Printf("💸 Borrow fee $%.2f on %s short for %s", fee, p.Symbol, userID)
+	}
+	return nil
+}
+
+// liquidate cancels the account's own working orders and order groups and
+// places market orders, marked source='liquidation', that close positions
+// until equity is back above the initial requirement: longs first, then the
+// largest shorts. Cancellations release holds and end groups the way a
+// user's cancel does, and the new orders hold funds like any margin order.
+// The orders run through the normal pipeline. While any are still working
+// the account is left alone. It returns the cancelled and placed order ids.
+func (w *worker) liquidate(ctx context.Context, tx *sql.Tx, acct *margin.Account, s margin.Summary) (cancelled, placed []string, err error) {
+	userID := acct.UserID
+	var inFlight bool
+	if err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM orders
+		WHERE user_id=$1 AND source='liquidation' AND status IN ('pending', 'partially_filled'))`,
+		userID).Scan(&inFlight); err != nil {
+		return nil, nil, err
+	}
+	if inFlight {
+		return nil, nil, nil
+	}
+
+	type working struct{ id, groupID string }
+	var open []working
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, COALESCE(group_id::text, '') FROM orders
+		WHERE user_id=$1 AND status IN ('pending', 'partially_filled', 'inactive')
+		ORDER BY created_at, id FOR UPDATE`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var o working
+		if err := rows.Scan(&o.id, &o.groupID); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		open = append(open, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	// A group goes as a whole, so a partly filled entry doesn't arm its exits.
+	ended := make(map[string]bool)
+	for _, o := range open {
+		if o.groupID != "" {
+			if ended[o.groupID] {
+				continue
+			}
+			ended[o.groupID] = true
+			ids, err := groups.Cancel(ctx, tx, o.groupID)
+			if err != nil {
+				return nil, nil, err
+			}
+			cancelled = append(cancelled, ids...)
+			continue
+		}
+		if err := funds.ReleaseOrder(ctx, tx, o.id); err != nil {
+			return nil, nil, err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET status='cancelled' WHERE id=$1`, o.id); err != nil {
+			return nil, nil, err
+		}
+		cancelled = append(cancelled, o.id)
+	}
+
+	order := append([]margin.Position(nil), s.Positions...)
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].Quantity.IsPositive() != order[j].Quantity.IsPositive() {
+			return order[i].Quantity.IsPositive()
+		}
+		return order[i].Value().Abs().GreaterThan(order[j].Value().Abs())
+	})
+
+	for _, p := range order {
+		if s.Equity().Cmp(acct.Initial.Mul(s.Gross())) >= 0 {
+			break
+		}
+		side, qty := "sell", p.Quantity
+		if qty.IsNegative() {
+			side, qty = "buy", qty.Neg()
+		}
+		var id string
+		if err := tx.QueryRowContext(ctx, `
+			INSERT INTO orders (user_id, symbol, side, type, quantity, time_in_force, source)
+			VALUES ($1, $2, $3, 'market', $4, 'gtc', 'liquidation')
+			RETURNING id`, userID, p.Symbol, side, qty).Scan(&id); err != nil {
+			return nil, nil, err
+		}
+		placed = append(placed, id)
+
+		// Project the close at its expected price so we stop once enough is sold.
+		price := applySlippage(w.slippage, p.Symbol, side, p.Price, qty)
+		fee := w.fees.Fee(p.Symbol, qty, price, false)
+		if err := funds.HoldForMarginOrder(ctx, tx, id, userID, side, p.Symbol, qty, qty.Mul(price).Add(fee)); err != nil {
+			return nil, nil, err
+		}
+		s = s.Apply(side, p.Symbol, qty, price, fee)
+		log.Printf("🔻 Liquidating %s: %s %s %s at market (order %s)", userID, side, qty, p.Symbol, id)
+	}
+	return cancelled, placed, nil
+}
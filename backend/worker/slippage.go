@@ -0,0 +1,175 @@
+package worker
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+)
+
+// SlippageModel prices how far a fill lands from the reference (feed) price.
+type SlippageModel interface {
+	// BPS returns the adverse move in basis points for trading quantity of
+	// symbol at reference. Buys pay reference*(1+bps/10000), sells receive
+	// reference*(1-bps/10000).
+	BPS(symbol, side string, reference, quantity float64) float64
+}
+
+// TickObserver is implemented by models that learn from the price stream.
+// The worker feeds it every tick, from its loop goroutine; fills read the
+// model from the same goroutine and from liquidation sweeps, so models that
+// keep state lock it.
+type TickObserver interface {
+	Observe(symbol string, price float64)
+}
+
+// applySlippage moves reference against the trader by the model's bps. The
+// models work in floats; the move itself is applied exactly.
+func applySlippage(m SlippageModel, symbol, side string, reference, quantity decimal.Decimal) decimal.Decimal {
+	if m == nil {
+		return reference
+	}
+	bps := m.BPS(symbol, side, reference.Float64(), quantity.Float64())
+	move := reference.Mul(decimal.FromFloat(bps)).Div(decimal.FromInt(10000))
+	if side == "buy" {
+		return reference.Add(move)
+	}
+	return reference.Sub(move)
+}
+
+// FixedSpread charges half of a constant bid/ask spread on every fill.
+type FixedSpread struct {
+	HalfSpreadBPS float64
+}
+
+func (m FixedSpread) BPS(string, string, float64, float64) float64 {
+	return m.HalfSpreadBPS
+}
+
+// VolatilitySpread widens the spread with recent realised volatility: the
+// standard deviation of tick-to-tick log returns over the last Window ticks,
+// times Multiplier.
+type VolatilitySpread struct {
+	Multiplier float64
+	Window     int
+
+	mu    sync.Mutex
+	ticks map[string][]float64
+}
+
+func NewVolatilitySpread(multiplier float64, window int) *VolatilitySpread {
+	if window < 2 {
+		window = 20
+	}
+	return &VolatilitySpread{Multiplier: multiplier, Window: window, ticks: make(map[string][]float64)}
+}
+
+func (m *VolatilitySpread) Observe(symbol string, price float64) {
+	if price <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := append(m.ticks[symbol], price)
+	if len(t) > m.Window {
+		t = t[len(t)-m.Window:]
+	}
+	m.ticks[symbol] = t
+}
+
+func (m *VolatilitySpread) BPS(symbol, _ string, _, _ float64) float64 {
+	m.mu.Lock()
+	t := append([]float64(nil), m.ticks[symbol]...)
+	m.mu.Unlock()
+	if len(t) < 3 {
+		return 0
+	}
+
+	returns := make([]float64, 0, len(t)-1)
+	var mean float64
+	for i := 1; i < len(t); i++ {
+		r := math.Log(t[i] / t[i-1])
+		returns = append(returns, r)
+		mean += r
+	}
+	mean /= float64(len(returns))
+	var variance float64
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+	}
+	variance /= float64(len(returns) - 1)
+	return m.Multiplier * math.Sqrt(variance) * 10000
+}
+
+// SizeImpact is a square-root market impact model: an order that is a fraction
+// f of the symbol's per-tick depth moves the price Coefficient*sqrt(f) bps.
+type SizeImpact struct {
+	CoefficientBPS float64
+	Liquidity      LiquidityModel
+}
+
+func (m SizeImpact) BPS(symbol, _ string, reference, quantity float64) float64 {
+	if m.Liquidity == nil {
+		return 0
+	}
+	depth := m.Liquidity.Available(symbol, reference)
+	if depth <= 0 || math.IsInf(depth, 1) {
+		return 0
+	}
+	return m.CoefficientBPS * math.Sqrt(quantity/depth)
+}
+
+// CombinedSlippage adds up the bps of several models.
+type CombinedSlippage []SlippageModel
+
+func (c CombinedSlippage) BPS(symbol, side string, reference, quantity float64) float64 {
+	var total float64
+	for _, m := range c {
+		total += m.BPS(symbol, side, reference, quantity)
+	}
+	return total
+}
+
+func (c CombinedSlippage) Observe(symbol string, price float64) {
+	for _, m := range c {
+		if o, ok := m.(TickObserver); ok {
+			o.Observe(symbol, price)
+		}
+	}
+}
+
+// ParseSlippage builds a model from "name:param" terms joined by commas:
+// "fixed:5" (half-spread bps), "volatility:1.5" (multiplier on realised vol),
+// "impact:10" (bps at an order the size of one tick's depth). An empty spec
+// or "none" disables slippage.
+func ParseSlippage(spec string, liquidity LiquidityModel) (SlippageModel, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+	var models CombinedSlippage
+	for _, term := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(term), ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("slippage term %q: want name:param", term)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("slippage term %q: %w", term, err)
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "fixed":
+			models = append(models, FixedSpread{HalfSpreadBPS: v})
+		case "volatility":
+			models = append(models, NewVolatilitySpread(v, 20))
+		case "impact":
+			models = append(models, SizeImpact{CoefficientBPS: v, Liquidity: liquidity})
+		default:
+			return nil, fmt.Errorf("unknown slippage model %q", kv[0])
+		}
+	}
+	return models, nil
+}
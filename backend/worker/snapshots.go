@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sahniaditya/flux-backend/snapshots"
+)
+
+// snapshotEquity records every account's value, and the benchmarks' prices,
+// once per UTC day and once per hour when hourly snapshots are on. A period is attempted until it
+// succeeds; snapshots.Take skips accounts it already has.
+func (w *worker) snapshotEquity() {
+	granularities := []string{snapshots.Daily}
+	if w.hourlySnapshots {
+		granularities = append(granularities, snapshots.Hourly)
+	}
+	now := time.Now()
+	for _, g := range granularities {
+		period := snapshots.Period(g, now)
+		if w.snapshotted[g].Equal(period) {
+			continue
+		}
+		n, err := snapshots.Take(context.Background(), w.db, g, now, w.provider.GetPrice)
+		if err != nil {
+			log.Printf("Equity snapshot (%s) failed: %v", g, err)
+			continue
+		}
+		w.snapshotted[g] = period
+		if n > 0 {
+			log.Printf("📸 Snapshotted %d accounts for %s (%s)", n, period.Format(time.RFC3339), g)
+		}
+		// A benchmark without a price misses this period; it isn't retried.
+		if err := snapshots.TakeBenchmarks(context.Background(), w.db, g, now, w.benchmarks, w.provider.GetPrice); err != nil {
+			log.Printf("⚠️ Benchmark prices (%s) incomplete: %v", g, err)
+		}
+	}
+}
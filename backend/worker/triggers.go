@@ -0,0 +1,132 @@
+package worker
+
+import "github.com/sahniaditya/flux-backend/decimal"
+
+// pendingOrder is a working order as the worker sees it on each pass.
+type pendingOrder struct {
+	ID           string
+	UserID       string
+	Symbol       string
+	Side         string
+	Type         string
+	Quantity     decimal.Decimal
+	Filled       decimal.Decimal     // filled_quantity so far
+	Price        decimal.NullDecimal // limit or stop price
+	StopPrice    decimal.NullDecimal // stop trigger for stop_limit
+	TrailAmount  decimal.NullDecimal
+	TrailPercent decimal.NullDecimal
+	WaterMark    decimal.NullDecimal // high-water for trailing sells, low-water for trailing buys
+	Triggered    bool                // stop already crossed; the order stays live through partial fills
+	TimeInForce  string
+	Extended     bool // may fill in pre- and post-market sessions
+}
+
+// evaluate checks the order against the live price. It reports whether the
+// order should fill now, and whether its persisted state (trailing mark or
+// stop trigger) moved and needs saving.
+//
+// A crossed stop stays triggered until the order is done: stops and trailing
+// stops fill at market and stop_limits rest as limits, even if the market
+// later moves back through the stop, so a partial fill doesn't send the rest
+// back to waiting on it.
+func (o *pendingOrder) evaluate(live decimal.Decimal) (fill, changed bool) {
+	switch o.Type {
+	case "market":
+		return true, false
+	case "limit":
+		return limitReached(o.Side, o.Price, live), false
+	case "stop":
+		if o.Triggered {
+			return true, false
+		}
+		if !stopCrossed(o.Side, o.Price, live) {
+			return false, false
+		}
+		o.Triggered = true
+		return true, true
+	case "stop_limit":
+		if !o.Triggered {
+			if !stopCrossed(o.Side, o.StopPrice, live) {
+				return false, false
+			}
+			o.Triggered = true
+			changed = true
+		}
+		return limitReached(o.Side, o.Price, live), changed
+	case "trailing_stop", "trailing_percent":
+		if o.Triggered {
+			return true, false
+		}
+		changed = o.trail(live)
+		stop, ok := o.trailingStop()
+		if !ok || !stopCrossed(o.Side, decimal.NewNull(stop), live) {
+			return false, changed
+		}
+		o.Triggered = true
+		return true, true
+	}
+	return false, false
+}
+
+// isMaker reports whether the order rested on the book before filling. Resting
+// limit orders pay maker rates; everything that crosses immediately pays taker.
+func (o *pendingOrder) isMaker() bool {
+	if o.TimeInForce == "ioc" || o.TimeInForce == "fok" {
+		return false
+	}
+	return o.Type == "limit" || o.Type == "stop_limit"
+}
+
+// trail moves the water mark in the order's favour: up for sells, down for buys.
+func (o *pendingOrder) trail(live decimal.Decimal) bool {
+	if !o.WaterMark.Valid ||
+		(o.Side == "sell" && live.GreaterThan(o.WaterMark.Decimal)) ||
+		(o.Side == "buy" && live.LessThan(o.WaterMark.Decimal)) {
+		o.WaterMark = decimal.NewNull(live)
+		return true
+	}
+	return false
+}
+
+// trailingStop derives the current stop level from the water mark and offset.
+func (o *pendingOrder) trailingStop() (decimal.Decimal, bool) {
+	if !o.WaterMark.Valid {
+		return decimal.Zero, false
+	}
+	var offset decimal.Decimal
+	switch {
+	case o.Type == "trailing_stop" && o.TrailAmount.Valid && o.TrailAmount.Decimal.IsPositive():
+		offset = o.TrailAmount.Decimal
+	case o.Type == "trailing_percent" && o.TrailPercent.Valid && o.TrailPercent.Decimal.IsPositive():
+		offset = o.WaterMark.Decimal.Mul(o.TrailPercent.Decimal).Div(decimal.FromInt(100))
+	default:
+		return decimal.Zero, false
+	}
+	if o.Side == "buy" {
+		return o.WaterMark.Decimal.Add(offset), true
+	}
+	return o.WaterMark.Decimal.Sub(offset), true
+}
+
+// limitReached: buy limits fill at or below the limit, sell limits at or above it.
+func limitReached(side string, limit decimal.NullDecimal, live decimal.Decimal) bool {
+	if !limit.Valid || !limit.Decimal.IsPositive() {
+		return false
+	}
+	if side == "buy" {
+		return live.Cmp(limit.Decimal) <= 0
+	}
+	return live.Cmp(limit.Decimal) >= 0
+}
+
+// stopCrossed: buy stops fire once the market trades up through the stop,
+// sell stops once it trades down through it.
+func stopCrossed(side string, stop decimal.NullDecimal, live decimal.Decimal) bool {
+	if !stop.Valid || !stop.Decimal.IsPositive() {
+		return false
+	}
+	if side == "buy" {
+		return live.Cmp(stop.Decimal) >= 0
+	}
+	return live.Cmp(stop.Decimal) <= 0
+}
@@ -0,0 +1,117 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/sahniaditya/flux-backend/decimal"
+)
+
+var d = decimal.MustParse
+
+func price(s string) decimal.NullDecimal {
+	return decimal.NewNull(d(s))
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name          string
+		order         pendingOrder
+		live          string
+		fill, changed bool
+		triggered     bool
+	}{
+		{"market", pendingOrder{Type: "market", Side: "buy"}, "100", true, false, false},
+
+		{"buy limit above", pendingOrder{Type: "limit", Side: "buy", Price: price("100")}, "100.01", false, false, false},
+		{"buy limit at", pendingOrder{Type: "limit", Side: "buy", Price: price("100")}, "100", true, false, false},
+		{"sell limit below", pendingOrder{Type: "limit", Side: "sell", Price: price("100")}, "99.99", false, false, false},
+		{"sell limit above", pendingOrder{Type: "limit", Side: "sell", Price: price("100")}, "101", true, false, false},
+
+		{"sell stop not crossed", pendingOrder{Type: "stop", Side: "sell", Price: price("90")}, "90.01", false, false, false},
+		{"sell stop crossed", pendingOrder{Type: "stop", Side: "sell", Price: price("90")}, "90", true, true, true},
+		{"buy stop crossed", pendingOrder{Type: "stop", Side: "buy", Price: price("110")}, "111", true, true, true},
+		// A triggered stop keeps filling after the market moves back.
+		{"triggered stop", pendingOrder{Type: "stop", Side: "sell", Price: price("90"), Triggered: true}, "95", true, false, true},
+
+		{"stop_limit waiting", pendingOrder{Type: "stop_limit", Side: "buy", StopPrice: price("110"), Price: price("112")}, "109", false, false, false},
+		{"stop_limit triggers and fills", pendingOrder{Type: "stop_limit", Side: "buy", StopPrice: price("110"), Price: price("112")}, "111", true, true, true},
+		{"stop_limit triggers past limit", pendingOrder{Type: "stop_limit", Side: "buy", StopPrice: price("110"), Price: price("112")}, "113", false, true, true},
+		{"triggered stop_limit rests", pendingOrder{Type: "stop_limit", Side: "buy", StopPrice: price("110"), Price: price("112"), Triggered: true}, "105", true, false, true},
+
+		// Sell trailing 5 below a mark of 100: a new high moves the mark, 95 fires.
+		{"trail new high", pendingOrder{Type: "trailing_stop", Side: "sell", TrailAmount: price("5"), WaterMark: price("100")}, "102", false, true, false},
+		{"trail holds", pendingOrder{Type: "trailing_stop", Side: "sell", TrailAmount: price("5"), WaterMark: price("100")}, "96", false, false, false},
+		{"trail fires", pendingOrder{Type: "trailing_stop", Side: "sell", TrailAmount: price("5"), WaterMark: price("100")}, "95", true, true, true},
+		{"trail no mark", pendingOrder{Type: "trailing_stop", Side: "sell", TrailAmount: price("5")}, "100", false, true, false},
+		{"trail percent buy fires", pendingOrder{Type: "trailing_percent", Side: "buy", TrailPercent: price("10"), WaterMark: price("50")}, "55", true, true, true},
+		{"triggered trail", pendingOrder{Type: "trailing_stop", Side: "sell", TrailAmount: price("5"), WaterMark: price("100"), Triggered: true}, "120", true, false, true},
+
+		{"unknown type", pendingOrder{Type: "iceberg", Side: "buy"}, "100", false, false, false},
+	}
+	for _, tt := range tests {
+		o := tt.order
+		fill, changed := o.evaluate(d(tt.live))
+		if fill != tt.fill || changed != tt.changed || o.Triggered != tt.triggered {
+			t.Errorf("%s at %s: fill %v changed %v triggered %v, want %v %v %v",
+				tt.name, tt.live, fill, changed, o.Triggered, tt.fill, tt.changed, tt.triggered)
+		}
+	}
+}
+
+func TestEvaluateTrailMovesMark(t *testing.T) {
+	o := pendingOrder{Type: "trailing_stop", Side: "sell", TrailAmount: price("5"), WaterMark: price("100")}
+	for _, live := range []string{"104", "103", "106", "101.01"} {
+		if fill, _ := o.evaluate(d(live)); fill {
+			t.Fatalf("filled at %s with mark %s", live, o.WaterMark.Decimal)
+		}
+	}
+	if o.WaterMark.Decimal != d("106") {
+		t.Errorf("mark %s, want 106", o.WaterMark.Decimal)
+	}
+	if fill, _ := o.evaluate(d("101")); !fill {
+		t.Error("didn't fire at 101, 5 below the 106 mark")
+	}
+}
+
+func TestTrailingStop(t *testing.T) {
+	tests := []struct {
+		name  string
+		order pendingOrder
+		want  string
+		ok    bool
+	}{
+		{"sell amount", pendingOrder{Type: "trailing_stop", Side: "sell", TrailAmount: price("2.5"), WaterMark: price("100")}, "97.5", true},
+		{"buy amount", pendingOrder{Type: "trailing_stop", Side: "buy", TrailAmount: price("2.5"), WaterMark: price("100")}, "102.5", true},
+		{"sell percent", pendingOrder{Type: "trailing_percent", Side: "sell", TrailPercent: price("1.25"), WaterMark: price("80")}, "79", true},
+		{"buy percent", pendingOrder{Type: "trailing_percent", Side: "buy", TrailPercent: price("0.5"), WaterMark: price("200")}, "201", true},
+		{"no mark", pendingOrder{Type: "trailing_stop", Side: "sell", TrailAmount: price("1")}, "0", false},
+		{"no offset", pendingOrder{Type: "trailing_stop", Side: "sell", WaterMark: price("100")}, "0", false},
+		{"offset of the wrong kind", pendingOrder{Type: "trailing_percent", Side: "sell", TrailAmount: price("1"), WaterMark: price("100")}, "0", false},
+	}
+	for _, tt := range tests {
+		stop, ok := tt.order.trailingStop()
+		if ok != tt.ok || stop != d(tt.want) {
+			t.Errorf("%s: stop %s, %v; want %s, %v", tt.name, stop, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestIsMaker(t *testing.T) {
+	tests := []struct {
+		typ, tif string
+		want     bool
+	}{
+		{"limit", "gtc", true},
+		{"stop_limit", "day", true},
+		{"limit", "ioc", false},
+		{"limit", "fok", false},
+		{"market", "gtc", false},
+		{"stop", "gtc", false},
+	}
+	for _, tt := range tests {
+		o := pendingOrder{Type: tt.typ, TimeInForce: tt.tif}
+		if got := o.isMaker(); got != tt.want {
+			t.Errorf("%s %s: maker %v, want %v", tt.typ, tt.tif, got, tt.want)
+		}
+	}
+}
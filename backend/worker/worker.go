@@ -1,172 +1,743 @@
 package worker
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"math"
+	"sync/atomic"
 	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/sahniaditya/flux-backend/calendar"
+	"github.com/sahniaditya/flux-backend/decimal"
+	"github.com/sahniaditya/flux-backend/fees"
+	"github.com/sahniaditya/flux-backend/funds"
+	"github.com/sahniaditya/flux-backend/groups"
+	"github.com/sahniaditya/flux-backend/halts"
+	"github.com/sahniaditya/flux-backend/instruments"
+	"github.com/sahniaditya/flux-backend/margin"
+	"github.com/sahniaditya/flux-backend/positions"
+	"github.com/sahniaditya/flux-backend/precision"
+	"github.com/sahniaditya/flux-backend/prices"
 )
 
 const (
-	checkInterval = 5 * time.Second
+	checkInterval  = 5 * time.Second
+	resyncInterval = time.Minute
+	tickBuffer     = 1024
+	refreshBuffer  = 64
+
+	// orderEventsChannel carries the id of every inserted or updated order;
+	// see notify_order_change in schema.sql.
+	orderEventsChannel = "order_events"
 )
 
 type PriceProvider interface {
-	GetPrice(symbol string) (float64, error)
+	GetPrice(symbol string) (decimal.Decimal, error)
+	SubscribeTicks(buffer int) (<-chan prices.Ticker, func())
+}
+
+// Config holds the pluggable execution models. Zero values fall back to defaults.
+type Config struct {
+	Liquidity       LiquidityModel
+	Fees            *fees.Engine          // nil trades commission-free
+	Slippage        SlippageModel         // nil fills at the feed price
+	ListenDSN       string                // LISTEN/NOTIFY connection for order changes; empty polls every checkInterval
+	BorrowRate      float64               // annual fee on short positions; zero uses DefaultBorrowRate, negative disables
+	LoanRate        float64               // annual interest on margin loans; zero uses DefaultLoanRate, negative disables
+	Calendar        *calendar.Calendar    // nil fills around the clock
+	Halts           *halts.Registry       // nil never halts
+	Rules           *instruments.Registry // nil fills at any tick and lot
+	HourlySnapshots bool                  // snapshot equity every hour as well as every day
+	Benchmarks      []string              // symbols whose prices are recorded with each snapshot
+}
+
+type worker struct {
+	db              *sql.DB
+	provider        PriceProvider
+	liquidity       LiquidityModel
+	fees            *fees.Engine
+	slippage        SlippageModel
+	index           *orderIndex
+	lastTick        map[string]time.Time
+	leader          *leaderLock
+	borrowRate      float64
+	loanRate        float64
+	calendar        *calendar.Calendar
+	halts           *halts.Registry
+	rules           *instruments.Registry
+	hourlySnapshots bool
+	benchmarks      []string
+	snapshotted     map[string]time.Time // last period snapshotted, by granularity; owned by the sweep
+	sweeping        atomic.Bool          // a background sweep is running
+	refreshes       chan []string        // orders the sweep touched, for the loop to reload
 }
 
-// Start initializes the background worker to process orders.
-func Start(db *sql.DB, provider PriceProvider) {
+// Start initializes the background worker to process orders. Orders are
+// triggered by feed ticks against an in-memory index; new and modified
+// orders reach the index through Postgres notifications, with a periodic
+// resync as the safety net.
+func Start(db *sql.DB, provider PriceProvider, cfg Config) {
+	w := &worker{
+		db:              db,
+		provider:        provider,
+		liquidity:       cfg.Liquidity,
+		fees:            cfg.Fees,
+		slippage:        cfg.Slippage,
+		index:           newOrderIndex(),
+		lastTick:        make(map[string]time.Time),
+		leader:          newLeaderLock(db),
+		borrowRate:      cfg.BorrowRate,
+		loanRate:        cfg.LoanRate,
+		calendar:        cfg.Calendar,
+		halts:           cfg.Halts,
+		rules:           cfg.Rules,
+		hourlySnapshots: cfg.HourlySnapshots,
+		benchmarks:      cfg.Benchmarks,
+		snapshotted:     make(map[string]time.Time),
+		refreshes:       make(chan []string, refreshBuffer),
+	}
+	if w.borrowRate == 0 {
+		w.borrowRate = DefaultBorrowRate
+	}
+	if w.loanRate == 0 {
+		w.loanRate = DefaultLoanRate
+	}
+	if w.liquidity == nil {
+		w.liquidity = DepthModel{Default: DefaultDepth}
+	}
+
+	ticks, _ := provider.SubscribeTicks(tickBuffer)
 	fmt.Println("🚀 Order Worker Started (Integrated)...")
-	go func() {
-		ticker := time.NewTicker(checkInterval)
-		for range ticker.C {
-			processOrders(db, provider)
+	go w.run(ticks, cfg.ListenDSN)
+}
+
+func (w *worker) run(ticks <-chan prices.Ticker, dsn string) {
+	var events <-chan *pq.Notification
+	resyncEvery := checkInterval
+	if dsn != "" {
+		listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Println("Order listener:", err)
+			}
+		})
+		if err := listener.Listen(orderEventsChannel); err != nil {
+			log.Println("⚠️ Order notifications unavailable, polling instead:", err)
+			listener.Close()
+		} else {
+			events = listener.Notify
+			resyncEvery = resyncInterval
 		}
-	}()
+	}
+
+	w.runScheduled()
+	w.resync()
+
+	expiry := time.NewTicker(checkInterval)
+	resync := time.NewTicker(resyncEvery)
+	for {
+		select {
+		case t, ok := <-ticks:
+			if !ok {
+				ticks = nil
+				continue
+			}
+			w.onTick(t)
+		case n := <-events:
+			if n == nil {
+				// The listener reconnected and may have missed notifications.
+				w.resync()
+				continue
+			}
+			w.refresh(n.Extra)
+		case ids := <-w.refreshes:
+			for _, id := range ids {
+				w.refresh(id)
+			}
+		case <-expiry.C:
+			w.runScheduled()
+		case <-resync.C:
+			w.resync()
+			w.pollQuiet(resyncEvery)
+		}
+	}
 }
 
-func processOrders(db *sql.DB, provider PriceProvider) {
-	rows, err := db.Query(`
-		SELECT id, user_id, symbol, side, type, quantity, price, created_at 
-		FROM orders 
-		WHERE status='pending'
-	`)
+// runScheduled runs the periodic sweeps. Only the elected leader runs them, so
+// replicas behind a load balancer don't expire the same orders twice.
+// Expiry is quick and stays on the loop; the margin sweep and snapshots
+// quote prices from the feed, so they run in the background, one run at a
+// time, and the loop keeps answering ticks meanwhile.
+func (w *worker) runScheduled() {
+	if !w.leader.held() {
+		return
+	}
+	w.expireOrders()
+	if w.sweeping.CompareAndSwap(false, true) {
+		go func() {
+			defer w.sweeping.Store(false)
+			w.sweepMargin()
+			w.snapshotEquity()
+		}()
+	}
+}
+
+// onTick fires the orders whose trigger the new price has reached.
+func (w *worker) onTick(t prices.Ticker) {
+	if !t.Price.IsPositive() {
+		return
+	}
+	w.lastTick[t.Symbol] = time.Now()
+	if obs, ok := w.slippage.(TickObserver); ok {
+		obs.Observe(t.Symbol, t.Price.Float64())
+	}
+	for _, o := range w.index.crossed(t.Symbol, t.Price) {
+		w.attempt(o, t.Price, nil)
+	}
+}
+
+// pollQuiet quotes symbols that have working orders but no recent ticks, such
+// as stocks outside the feed's streamed basket, and treats the quote as a tick.
+func (w *worker) pollQuiet(within time.Duration) {
+	for _, sym := range w.index.symbols() {
+		if time.Since(w.lastTick[sym]) < within {
+			continue
+		}
+		p, err := w.provider.GetPrice(sym)
+		if err != nil {
+			log.Printf("⚠️ No price for %s: %v", sym, err)
+			continue
+		}
+		w.onTick(prices.Ticker{Symbol: sym, Price: p})
+	}
+}
+
+const pendingColumns = `id, user_id, symbol, side, type, quantity, filled_quantity, price, stop_price,
+	trail_amount, trail_percent, water_mark, triggered_at IS NOT NULL, time_in_force, extended_hours`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPending(r rowScanner) (*pendingOrder, error) {
+	var o pendingOrder
+	err := r.Scan(&o.ID, &o.UserID, &o.Symbol, &o.Side, &o.Type, &o.Quantity, &o.Filled, &o.Price, &o.StopPrice,
+		&o.TrailAmount, &o.TrailPercent, &o.WaterMark, &o.Triggered, &o.TimeInForce, &o.Extended)
+	return &o, err
+}
+
+// resync rebuilds the index from the database. Orders it has not seen before,
+// or whose terms changed, get an immediate look at the market.
+func (w *worker) resync() {
+	rows, err := w.db.Query(`SELECT ` + pendingColumns + ` FROM orders
+		WHERE status IN ('pending', 'partially_filled')
+		ORDER BY created_at`)
 	if err != nil {
 		log.Println("Error fetching orders:", err)
 		return
 	}
 	defer rows.Close()
 
+	next := newOrderIndex()
+	var arrived []*pendingOrder
 	for rows.Next() {
-		var id, userID, symbol, side, orderType string
-		var qty float64
-		var targetPrice sql.NullFloat64
-		var createdAt time.Time
-
-		if err := rows.Scan(&id, &userID, &symbol, &side, &orderType, &qty, &targetPrice, &createdAt); err != nil {
+		o, err := scanPending(rows)
+		if err != nil {
 			log.Println("Scan error:", err)
 			continue
 		}
+		if termsChanged(w.index.get(o.ID), o) {
+			arrived = append(arrived, o)
+		}
+		next.put(o)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error fetching orders:", err)
+		return
+	}
+	rows.Close()
 
-		price := 0.0
-		if targetPrice.Valid && targetPrice.Float64 > 0 {
-			// Limit/Stop orders use the set price (simplified)
-			price = targetPrice.Float64
-		} else {
-			// Market order: Get live price
-			livePrice, err := provider.GetPrice(symbol)
-			if err != nil || livePrice <= 0 {
-				log.Printf("⚠️ Skipping order %s: price unavailable for %s", id, symbol)
-				continue
-			}
-			price = livePrice
-			log.Printf("ℹ️ Market Price for %s: %f", symbol, price)
+	w.index = next
+	for _, o := range arrived {
+		w.arrive(o)
+	}
+}
+
+// refresh reloads one order after a notification or after the worker touched
+// it, dropping it from the index once it stops working.
+func (w *worker) refresh(orderID string) {
+	o, err := scanPending(w.db.QueryRow(`SELECT `+pendingColumns+` FROM orders
+		WHERE id=$1 AND status IN ('pending', 'partially_filled')`, orderID))
+	if err == sql.ErrNoRows {
+		w.index.remove(orderID)
+		return
+	}
+	if err != nil {
+		log.Printf("Reloading order %s failed: %v", orderID, err)
+		return
+	}
+	prev := w.index.get(orderID)
+	w.index.put(o)
+	if termsChanged(prev, o) {
+		w.arrive(o)
+	}
+}
+
+// termsChanged reports whether next is new or was modified in a way that
+// deserves a fresh look rather than waiting for the next crossing tick.
+func termsChanged(prev, next *pendingOrder) bool {
+	return prev == nil || prev.Quantity != next.Quantity || prev.Price != next.Price ||
+		prev.StopPrice != next.StopPrice || prev.TrailAmount != next.TrailAmount || prev.TrailPercent != next.TrailPercent
+}
+
+// arrive checks a new or modified order against the current price, so market
+// orders and marketable limits fill without waiting for a tick.
+func (w *worker) arrive(o *pendingOrder) {
+	live, err := w.provider.GetPrice(o.Symbol)
+	w.attempt(o, live, err)
+}
+
+// attempt evaluates one order against a price and fills it if it triggers.
+func (w *worker) attempt(o *pendingOrder, livePrice decimal.Decimal, priceErr error) {
+	immediate := o.TimeInForce == "ioc" || o.TimeInForce == "fok"
+
+	// Equity orders queue while their market is shut and get their look on
+	// the first tick after the open; orders in a halted symbol wait for the
+	// halt to lift. Immediate orders can't wait.
+	if err := w.halts.Check(o.Symbol); err != nil {
+		if immediate {
+			w.cancelOrder(o.ID, err.Error())
 		}
+		return
+	}
+	if !w.calendar.IsOpen(o.Symbol, o.Extended, time.Now()) {
+		if immediate {
+			w.cancelOrder(o.ID, "market closed")
+		}
+		return
+	}
 
-		// Execute orders after 5 seconds
-		if time.Since(createdAt) > 5*time.Second {
-			executeOrder(db, id, userID, symbol, side, qty, price)
+	if priceErr != nil || !livePrice.IsPositive() {
+		if immediate {
+			w.cancelOrder(o.ID, "price unavailable")
+			return
 		}
+		log.Printf("⚠️ Skipping order %s: price unavailable for %s", o.ID, o.Symbol)
+		return
 	}
+
+	fill, changed := o.evaluate(livePrice)
+	if immediate && !fill {
+		// IOC/FOK get exactly one look at the market.
+		w.cancelOrder(o.ID, "not marketable")
+		return
+	}
+	if changed {
+		// Persist trailing marks and stop triggers before filling, so they
+		// survive a restart and a fill that comes up short or fails leaves
+		// the order triggered, and re-file the order under its new trigger.
+		w.saveOrderState(o)
+		w.index.put(o)
+	}
+	if !fill {
+		return
+	}
+
+	// Every fill starts from the live price. For a limit this is at least as
+	// good as the limit itself; for a stop it is wherever the market was
+	// when the stop got crossed. Slippage is applied on top in executeOrder.
+	w.executeOrder(o, livePrice)
+	w.refresh(o.ID)
 }
 
-func executeOrder(db *sql.DB, orderID, userID, symbol, side string, qty, price float64) {
-	log.Printf("⚡ Executing Order %s: %s %s %f @ $%f\n", orderID, side, symbol, qty, price)
+// executionPrice applies slippage to the reference price, never letting a
+// limit order fill worse than its limit, and rounds it to the symbol's tick.
+func (w *worker) executionPrice(o *pendingOrder, reference, qty decimal.Decimal) decimal.Decimal {
+	price := w.rules.Price(o.Symbol, applySlippage(w.slippage, o.Symbol, o.Side, reference, qty))
+	if (o.Type == "limit" || o.Type == "stop_limit") && o.Price.Valid {
+		if o.Side == "buy" {
+			price = decimal.Min(price, o.Price.Decimal)
+		} else {
+			price = decimal.Max(price, o.Price.Decimal)
+		}
+	}
+	return price
+}
 
-	tx, err := db.Begin()
+// expireOrders retires DAY orders past their session close and GTD orders
+// past their date, releasing what they held.
+func (w *worker) expireOrders() {
+	ctx := context.Background()
+	tx, err := w.db.BeginTx(ctx, nil)
 	if err != nil {
 		log.Println("Tx error:", err)
 		return
 	}
 	defer tx.Rollback()
 
-	total := qty * price
+	rows, err := tx.Query(`
+		UPDATE orders SET status='expired'
+		WHERE status IN ('pending', 'partially_filled') AND expires_at <= NOW()
+		RETURNING id`)
+	if err != nil {
+		log.Println("Expiring orders failed:", err)
+		return
+	}
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			expired = append(expired, id)
+		}
+	}
+	rows.Close()
+	if len(expired) == 0 {
+		return
+	}
 
-	if side == "buy" {
-		// Validate balance before deducting
-		var balance float64
-		if err := tx.QueryRow(`SELECT balance FROM wallets WHERE user_id=$1 AND currency='USD' FOR UPDATE`, userID).Scan(&balance); err != nil {
-			log.Println("Wallet query failed:", err)
+	var touched []string
+	for _, id := range expired {
+		if err := funds.ReleaseOrder(ctx, tx, id); err != nil {
+			log.Printf("Release hold for expired order %s failed: %v", id, err)
 			return
 		}
-		if balance < total {
-			log.Printf("❌ Order %s rejected: insufficient funds (%.2f < %.2f)", orderID, balance, total)
-			tx.Exec(`UPDATE orders SET status='rejected' WHERE id=$1`, orderID)
-			tx.Commit()
+		ids, err := groups.OnEnd(ctx, tx, id)
+		if err != nil {
+			log.Printf("Ending group of expired order %s failed: %v", id, err)
 			return
 		}
+		touched = append(touched, ids...)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit failed:", err)
+		return
+	}
+	for _, id := range expired {
+		w.index.remove(id)
+	}
+	for _, id := range touched {
+		w.refresh(id)
+	}
+	log.Printf("⌛ Expired %d orders", len(expired))
+}
+
+func (w *worker) cancelOrder(orderID, reason string) {
+	ctx := context.Background()
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Tx error:", err)
+		return
+	}
+	defer tx.Rollback()
 
-		// Deduct Cash
-		if _, err := tx.Exec(`UPDATE wallets SET balance = balance - $1 WHERE user_id=$2`, total, userID); err != nil {
-			log.Println("Wallet deduct failed:", err)
+	res, err := tx.Exec(`UPDATE orders SET status='cancelled' WHERE id=$1 AND status IN ('pending', 'partially_filled')`, orderID)
+	if err != nil {
+		log.Printf("Cancelling order %s failed: %v", orderID, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		w.index.remove(orderID)
+		return
+	}
+	if err := funds.ReleaseOrder(ctx, tx, orderID); err != nil {
+		log.Printf("Release hold for order %s failed: %v", orderID, err)
+		return
+	}
+	touched, err := groups.OnEnd(ctx, tx, orderID)
+	if err != nil {
+		log.Printf("Ending group of order %s failed: %v", orderID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit failed:", err)
+		return
+	}
+	w.index.remove(orderID)
+	for _, id := range touched {
+		w.refresh(id)
+	}
+	log.Printf("🚫 Order %s cancelled: %s", orderID, reason)
+}
+
+func (w *worker) saveOrderState(o *pendingOrder) {
+	if _, err := w.db.Exec(`
+		UPDATE orders
+		SET water_mark=$1, triggered_at=CASE WHEN $2 THEN COALESCE(triggered_at, NOW()) END
+		WHERE id=$3 AND status IN ('pending', 'partially_filled')`,
+		o.WaterMark, o.Triggered, o.ID); err != nil {
+		log.Printf("Saving state for order %s failed: %v", o.ID, err)
+	}
+}
+
+// executeOrder fills as much of the order as the liquidity model allows this
+// tick. Large orders fill over several ticks, each fill recorded in order_fills
+// and applied to the wallet and holdings as it happens.
+func (w *worker) executeOrder(o *pendingOrder, reference decimal.Decimal) {
+	orderID, userID, symbol, side := o.ID, o.UserID, o.Symbol, o.Side
+
+	ctx := context.Background()
+	// Quote a margin account's other positions now, before the wallet lock.
+	quote, err := margin.Prequote(ctx, w.db, userID, w.provider.GetPrice)
+	if err != nil {
+		log.Printf("Quoting positions for order %s failed: %v", orderID, err)
+		return
+	}
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Tx error:", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Claim the order. SKIP LOCKED lets another instance (or a cancel in
+	// flight) keep it; the status check is repeated under the lock so an order
+	// that finished while we weren't looking is never filled twice.
+	var lockedQty, lockedFilled, prevAvg decimal.Decimal
+	var lockedPrice, lockedStop decimal.NullDecimal
+	err = tx.QueryRow(`
+		SELECT quantity, filled_quantity, COALESCE(average_fill_price, 0), price, stop_price
+		FROM orders WHERE id=$1 AND status IN ('pending', 'partially_filled')
+		FOR UPDATE SKIP LOCKED`, orderID).
+		Scan(&lockedQty, &lockedFilled, &prevAvg, &lockedPrice, &lockedStop)
+	if err == sql.ErrNoRows {
+		log.Printf("↩️ Order %s is claimed elsewhere or no longer working", orderID)
+		return
+	}
+	if err != nil {
+		log.Println("Order lock failed:", err)
+		return
+	}
+	// Make sure nobody modified it or filled part of it since we read it.
+	if lockedQty != o.Quantity || lockedFilled != o.Filled || lockedPrice != o.Price || lockedStop != o.StopPrice {
+		log.Printf("↩️ Order %s changed since it was read; reloading", orderID)
+		return
+	}
+
+	// The liquidity model sizes fills in floats; what it allows is cut down
+	// to the symbol's lot.
+	remaining := o.Quantity.Sub(o.Filled)
+	qty := remaining
+	if available := w.liquidity.Available(symbol, reference.Float64()); !math.IsInf(available, 1) {
+		qty = decimal.Min(remaining, w.rules.Quantity(symbol, decimal.FromFloat(available)))
+	}
+	if !qty.IsPositive() {
+		return
+	}
+	price := w.executionPrice(o, reference, qty)
+	complete := qty == remaining
+
+	// Fill-or-kill needs the whole order in one go.
+	if o.TimeInForce == "fok" && !complete {
+		w.rejectInTx(tx, orderID, "cancelled", "not enough liquidity to fill or kill")
+		return
+	}
+
+	log.Printf("⚡ Executing Order %s: %s %s %s @ $%s (ref $%s)\n", orderID, side, symbol, qty, price, reference)
+
+	// A filling exit or OCO leg cancels its siblings first, which frees the
+	// pair's shared hold for the checks below. A check that rejects the fill
+	// rolls back to the savepoint, so the siblings go on working.
+	if _, err := tx.Exec(`SAVEPOINT group_fill`); err != nil {
+		log.Println("Savepoint failed:", err)
+		return
+	}
+	reject := func(status, reason string) {
+		if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT group_fill`); err != nil {
+			log.Println("Rollback to savepoint failed:", err)
 			return
 		}
+		w.rejectInTx(tx, orderID, status, reason)
+	}
+	touched, err := groups.OnFill(ctx, tx, orderID)
+	if err != nil {
+		log.Println("Order group update failed:", err)
+		return
+	}
 
-		// Add Holding
-		var currentQty, avgPrice float64
-		err := tx.QueryRow(`SELECT quantity, average_buy_price FROM holdings WHERE user_id=$1 AND symbol=$2`, userID, symbol).Scan(&currentQty, &avgPrice)
+	// A complete fill ends the hold; a partial fill gives back the share of
+	// the hold that this slice used. Rejections free the whole hold below.
+	if complete {
+		err = funds.ReleaseOrder(ctx, tx, orderID)
+	} else {
+		err = funds.ReleaseFill(ctx, tx, orderID, qty, remaining)
+	}
+	if err != nil {
+		log.Println("Release hold failed:", err)
+		return
+	}
 
-		if err == sql.ErrNoRows {
-			if _, err := tx.Exec(`INSERT INTO holdings (user_id, symbol, quantity, average_buy_price) VALUES ($1, $2, $3, $4)`, userID, symbol, qty, price); err != nil {
-				log.Println("Insert holding failed:", err)
-				return
-			}
-		} else if err == nil {
-			newQty := currentQty + qty
-			newAvg := ((currentQty * avgPrice) + total) / newQty
-			if _, err := tx.Exec(`UPDATE holdings SET quantity=$1, average_buy_price=$2 WHERE user_id=$3 AND symbol=$4`, newQty, newAvg, userID, symbol); err != nil {
-				log.Println("Update holding failed:", err)
-				return
-			}
+	// Commission is priced on the order's cumulative fills so flat fees and
+	// minimums are charged once per order, not once per slice.
+	var feesSoFar decimal.Decimal
+	if err := tx.QueryRow(`SELECT COALESCE(SUM(fee), 0) FROM order_fills WHERE order_id=$1`, orderID).Scan(&feesSoFar); err != nil {
+		log.Println("Fee lookup failed:", err)
+		return
+	}
+	filled := o.Filled.Add(qty)
+	avgFill := prevAvg.Mul(o.Filled).Add(qty.Mul(price)).Div(filled)
+	fee := decimal.Max(decimal.Zero, w.fees.Fee(symbol, filled, avgFill, o.isMaker()).Sub(feesSoFar))
+
+	// total is the cash that moves: notional plus fee on buys, minus fee on sells.
+	notional := precision.Cash(qty.Mul(price))
+	total := notional.Add(fee)
+	if side == "sell" {
+		total = notional.Sub(fee)
+		if total.IsNegative() {
+			reject("rejected", "commission exceeds sale proceeds")
+			return
 		}
-	} else {
-		// SELL - Validate holdings first
-		var currentQty float64
-		if err := tx.QueryRow(`SELECT quantity FROM holdings WHERE user_id=$1 AND symbol=$2 FOR UPDATE`, userID, symbol).Scan(&currentQty); err != nil {
-			log.Printf("❌ Order %s rejected: no holdings found for %s", orderID, symbol)
-			tx.Exec(`UPDATE orders SET status='rejected' WHERE id=$1`, orderID)
-			tx.Commit()
+	}
+
+	trade := positions.Trade{UserID: userID, Symbol: symbol, Side: side, Quantity: qty, Price: price, Fee: fee}
+	acct, err := margin.Load(ctx, tx, userID)
+	if err != nil {
+		log.Println("Margin lookup failed:", err)
+		return
+	}
+	var free decimal.Decimal
+	if side == "buy" {
+		// Validate balance before deducting; other orders' holds aren't spendable.
+		var balance, reserved decimal.Decimal
+		if err := tx.QueryRow(`SELECT balance, reserved FROM wallets WHERE user_id=$1 AND currency='USD' FOR UPDATE`, userID).Scan(&balance, &reserved); err != nil {
+			log.Println("Wallet query failed:", err)
 			return
 		}
-		if currentQty < qty {
-			log.Printf("❌ Order %s rejected: insufficient holdings (%.2f < %.2f)", orderID, currentQty, qty)
-			tx.Exec(`UPDATE orders SET status='rejected' WHERE id=$1`, orderID)
-			tx.Commit()
+		free = decimal.Max(balance.Sub(reserved), decimal.Zero)
+		if acct == nil && free.LessThan(total) {
+			reject("rejected", fmt.Sprintf("insufficient funds (%.2f < %.2f)", balance.Sub(reserved), total))
 			return
 		}
-
-		// Reduce holding
-		newQty := currentQty - qty
-		if newQty <= 0 {
-			// Delete holding if 0
-			if _, err := tx.Exec(`DELETE FROM holdings WHERE user_id=$1 AND symbol=$2`, userID, symbol); err != nil {
-				log.Println("Delete holding failed:", err)
+	} else if acct == nil {
+		// Cash accounts sell only what they own.
+		currentQty, reservedQty, err := positions.Get(ctx, tx, userID, symbol)
+		if err != nil {
+			log.Println("Holding query failed:", err)
+			return
+		}
+		if !currentQty.IsPositive() {
+			reject("rejected", "no holdings found for "+symbol)
+			return
+		}
+		if currentQty.Sub(reservedQty).LessThan(qty) {
+			reject("rejected", fmt.Sprintf("insufficient holdings (%s < %s)", currentQty.Sub(reservedQty), qty))
+			return
+		}
+	}
+	if acct != nil {
+		if err := acct.CheckTrade(ctx, tx, side, symbol, qty, price, fee, quote); err != nil {
+			if margin.IsUserError(err) {
+				reject("rejected", err.Error())
 				return
 			}
-		} else {
-			if _, err := tx.Exec(`UPDATE holdings SET quantity=$1 WHERE user_id=$2 AND symbol=$3`, newQty, userID, symbol); err != nil {
-				log.Println("Update holding failed:", err)
+			log.Printf("Margin check for order %s failed: %v", orderID, err)
+			return
+		}
+		// Margin buys borrow what the free cash doesn't cover.
+		if side == "buy" {
+			if err := margin.Borrow(ctx, tx, userID, total.Sub(free)); err != nil {
+				log.Println("Margin loan failed:", err)
 				return
 			}
 		}
-
-		// Add Cash
-		if _, err := tx.Exec(`UPDATE wallets SET balance = balance + $1 WHERE user_id=$2`, total, userID); err != nil {
-			log.Println("Wallet add failed:", err)
+	}
+	if _, err := positions.Settle(ctx, tx, trade); err != nil {
+		log.Println("Settlement failed:", err)
+		return
+	}
+	// Sale proceeds pay down any margin loan first.
+	if acct != nil && side == "sell" {
+		if _, err := margin.Repay(ctx, tx, userID); err != nil {
+			log.Println("Loan repayment failed:", err)
 			return
 		}
 	}
 
-	// Update Order Status to filled
-	if _, err := tx.Exec(`UPDATE orders SET status='filled', executed_at=$1 WHERE id=$2`, time.Now(), orderID); err != nil {
+	// Record the fill and roll it into the order's running totals.
+	if _, err := tx.Exec(`
+		INSERT INTO order_fills (order_id, user_id, symbol, side, quantity, price, reference_price, fee)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		orderID, userID, symbol, side, qty, price, reference, fee); err != nil {
+		log.Println("Insert fill failed:", err)
+		return
+	}
+
+	newStatus := "partially_filled"
+	var executedAt sql.NullTime
+	if complete {
+		newStatus = "filled"
+		executedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+	if _, err := tx.Exec(`
+		UPDATE orders SET status=$1, filled_quantity=$2, average_fill_price=$3, executed_at=COALESCE($4, executed_at)
+		WHERE id=$5`,
+		newStatus, filled, avgFill, executedAt, orderID); err != nil {
 		log.Println("Update status failed:", err)
 		return
 	}
 
+	// Immediate-or-cancel takes what it got and drops the rest.
+	var ids []string
+	if o.TimeInForce == "ioc" && !complete {
+		if _, err := tx.Exec(`UPDATE orders SET status='cancelled' WHERE id=$1`, orderID); err != nil {
+			log.Println("Cancel remainder failed:", err)
+			return
+		}
+		if err := funds.ReleaseOrder(ctx, tx, orderID); err != nil {
+			log.Println("Release hold failed:", err)
+			return
+		}
+		ids, err = groups.OnEnd(ctx, tx, orderID)
+	} else if complete {
+		// A filled bracket entry puts its exits to work.
+		ids, err = groups.OnEntryDone(ctx, tx, orderID, filled)
+	}
+	if err != nil {
+		log.Println("Order group update failed:", err)
+		return
+	}
+	touched = append(touched, ids...)
+
 	if err := tx.Commit(); err != nil {
 		log.Println("Commit failed:", err)
 		return
 	}
-	log.Printf("✅ Order %s executed successfully", orderID)
+	for _, id := range touched {
+		w.refresh(id)
+	}
+	if complete {
+		log.Printf("✅ Order %s executed successfully", orderID)
+	} else {
+		log.Printf("◐ Order %s partially filled: %s of %s", orderID, filled, o.Quantity)
+	}
+}
+
+// rejectInTx ends the order with the given status, settles its order group,
+// frees whatever hold the group didn't take over and commits whatever the
+// transaction has done so far.
+func (w *worker) rejectInTx(tx *sql.Tx, orderID, status, reason string) {
+	ctx := context.Background()
+	if _, err := tx.Exec(`UPDATE orders SET status=$1 WHERE id=$2`, status, orderID); err != nil {
+		log.Println("Update status failed:", err)
+		return
+	}
+	touched, err := groups.OnReject(ctx, tx, orderID)
+	if err != nil {
+		log.Println("Order group update failed:", err)
+		return
+	}
+	if err := funds.ReleaseOrder(ctx, tx, orderID); err != nil {
+		log.Println("Release hold failed:", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit failed:", err)
+		return
+	}
+	for _, id := range touched {
+		w.refresh(id)
+	}
+	log.Printf("❌ Order %s %s: %s", orderID, status, reason)
 }